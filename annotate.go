@@ -0,0 +1,102 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// glyphWidth and glyphHeight are the dimensions of the glyphs of the
+// bitmap font in font pixels
+const (
+	glyphWidth  = 3
+	glyphHeight = 5
+)
+
+// glyphs is a bitmap font for percentages. Every row is a bit mask
+// of glyphWidth bits with the most significant bit on the left.
+var glyphs = map[rune][glyphHeight]uint8{
+	'0': {7, 5, 5, 5, 7},
+	'1': {2, 6, 2, 2, 7},
+	'2': {7, 1, 7, 4, 7},
+	'3': {7, 1, 3, 1, 7},
+	'4': {5, 5, 7, 1, 1},
+	'5': {7, 4, 7, 1, 7},
+	'6': {7, 4, 7, 5, 7},
+	'7': {7, 1, 1, 2, 2},
+	'8': {7, 5, 7, 5, 7},
+	'9': {7, 5, 7, 1, 7},
+	'.': {0, 0, 0, 0, 2},
+	'%': {5, 1, 2, 4, 5},
+	' ': {0, 0, 0, 0, 0},
+}
+
+// colors of the annotations
+var (
+	annotationText       = color.NRGBA{255, 255, 255, 255}
+	annotationBackground = color.NRGBA{0, 0, 0, 255}
+	annotationRegion     = color.NRGBA{0, 0, 255, 255}
+)
+
+// annotationScale returns the size of a font pixel in image pixels,
+// such that the text remains legible in large images
+func annotationScale(w int) int {
+	scale := w / 200
+	if scale < 1 {
+		scale = 1
+	}
+	return scale
+}
+
+// fillRect sets all pixels of `r` within `i` to `c`
+func fillRect(i *image.NRGBA, r image.Rectangle, c color.NRGBA) {
+	r = r.Intersect(i.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i.SetNRGBA(x, y, c)
+		}
+	}
+}
+
+// drawText renders `text` with the bitmap font on a background box
+// at the top left corner of `i`. Runes without glyph are skipped.
+func drawText(i *image.NRGBA, text string, scale int) {
+	var runes []rune
+	for _, r := range text {
+		if _, ok := glyphs[r]; ok {
+			runes = append(runes, r)
+		}
+	}
+	// glyphs are separated and surrounded by one font pixel
+	box := image.Rect(0, 0, (len(runes)*(glyphWidth+1)+1)*scale, (glyphHeight+2)*scale)
+	fillRect(i, box, annotationBackground)
+	for n, r := range runes {
+		x0 := (1 + n*(glyphWidth+1)) * scale
+		for row, bits := range glyphs[r] {
+			for col := 0; col < glyphWidth; col++ {
+				if bits&(1<<uint(glyphWidth-1-col)) == 0 {
+					continue
+				}
+				x, y := x0+col*scale, (1+row)*scale
+				fillRect(i, image.Rect(x, y, x+scale, y+scale), annotationText)
+			}
+		}
+	}
+}
+
+// drawRectangle draws the outline of `r` with a line width of `width`
+func drawRectangle(i *image.NRGBA, r image.Rectangle, width int, c color.NRGBA) {
+	fillRect(i, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+width), c)
+	fillRect(i, image.Rect(r.Min.X, r.Max.Y-width, r.Max.X, r.Max.Y), c)
+	fillRect(i, image.Rect(r.Min.X, r.Min.Y, r.Min.X+width, r.Max.Y), c)
+	fillRect(i, image.Rect(r.Max.X-width, r.Min.Y, r.Max.X, r.Max.Y), c)
+}
+
+// annotate draws the outline of the changed `region` and `text`,
+// e.g. the difference percentage, onto the triage image `i`
+func annotate(i *image.NRGBA, text string, region image.Rectangle) {
+	scale := annotationScale(i.Bounds().Dx())
+	if !region.Empty() {
+		drawRectangle(i, region, scale, annotationRegion)
+	}
+	drawText(i, text, scale)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestAnnotate(t *testing.T) {
+	i := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	fillRect(i, i.Bounds(), triageIdentical)
+	annotate(i, "1x", image.Rect(10, 2, 15, 8))
+
+	expected := map[image.Point]color.NRGBA{
+		// background of the text box
+		image.Pt(0, 0): annotationBackground,
+		// top of the stem of '1'
+		image.Pt(2, 1): annotationText,
+		image.Pt(1, 1): annotationBackground,
+		// 'x' has no glyph, hence the box ends after '1'
+		image.Pt(5, 1): triageIdentical,
+		// outline and inside of the changed region
+		image.Pt(10, 5): annotationRegion,
+		image.Pt(14, 2): annotationRegion,
+		image.Pt(12, 5): triageIdentical,
+	}
+	for p, c := range expected {
+		if got := i.NRGBAAt(p.X, p.Y); got != c {
+			t.Fatalf("Expected %v at %v; got %v", c, p, got)
+		}
+	}
+
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--annotate", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for --annotate without a triage image")
+	}
+}
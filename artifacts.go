@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+)
+
+// jpegBlock is the width and height of the blocks of the JPEG DCT
+const jpegBlock = 8
+
+// artifactEstimate is the estimated share of a difference caused by
+// JPEG block artifacts
+type artifactEstimate struct {
+	// percentage of the difference between 0 and 100
+	Percentage float64
+	// share of the discontinuities at block boundaries between 0 and 1
+	// which exceed the discontinuities within blocks
+	Blockiness float64
+}
+
+// onBlockBoundary reports whether pixel (x,y) borders on another block
+func onBlockBoundary(x, y int) bool {
+	bx, by := x%jpegBlock, y%jpegBlock
+	return bx == 0 || bx == jpegBlock-1 || by == 0 || by == jpegBlock-1
+}
+
+// blockiness returns the share of the block-edge energy of `i` caused by
+// blocking between 0 and 1. The block-edge energy is the mean absolute
+// luma step between horizontally or vertically adjacent pixels of
+// different blocks. Steps within blocks estimate the energy of the
+// content, and the excess at block boundaries is attributed to blocking.
+func blockiness(i *img) float64 {
+	lumas := lumaValues(i.i)
+	var boundary, inner float64
+	var nBoundary, nInner int
+	step := func(a, b int, crossing bool) {
+		d := math.Abs(lumas[a] - lumas[b])
+		if crossing {
+			boundary += d
+			nBoundary++
+		} else {
+			inner += d
+			nInner++
+		}
+	}
+	for y := 0; y < i.h; y++ {
+		for x := 0; x < i.w; x++ {
+			if x+1 < i.w {
+				step(y*i.w+x, y*i.w+x+1, (x+1)%jpegBlock == 0)
+			}
+			if y+1 < i.h {
+				step(y*i.w+x, (y+1)*i.w+x, (y+1)%jpegBlock == 0)
+			}
+		}
+	}
+	if nBoundary == 0 || nInner == 0 || boundary == 0.0 {
+		return 0.0
+	}
+	boundary, inner = boundary/float64(nBoundary), inner/float64(nInner)
+	return math.Max(boundary-inner, 0.0) / boundary
+}
+
+// estimateArtifacts estimates the share of the difference of `baseImg`
+// and `refImg` caused by block artifacts of the JPEG image `jpeg`, one
+// of both. The share of the distance on pixels at block boundaries in
+// excess of their share of all pixels, i.e. of a difference spread
+// evenly, is weighted by the blockiness of `jpeg`. Blocks are assumed to
+// start at the top left corner of the compared images.
+func estimateArtifacts(s *Settings, jpeg, baseImg, refImg *img) artifactEstimate {
+	estimate := artifactEstimate{Blockiness: blockiness(jpeg)}
+	prepareEdges(s, baseImg)
+	maxDist := maxDistanceFor(s)
+	var total, boundary float64
+	var pixels, boundaryPixels int
+	for y := 0; y < baseImg.h; y++ {
+		for x := 0; x < baseImg.w; x++ {
+			px := comparePixel(s, baseImg, refImg, x, y, maxDist)
+			if px.skip {
+				continue
+			}
+			pixels++
+			total += px.d
+			if onBlockBoundary(x, y) {
+				boundaryPixels++
+				boundary += px.d
+			}
+		}
+	}
+	if total == 0.0 || boundaryPixels == pixels {
+		return estimate
+	}
+	expected := float64(boundaryPixels) / float64(pixels)
+	excess := math.Max(boundary/total-expected, 0.0) / (1.0 - expected)
+	estimate.Percentage = 100.0 * estimate.Blockiness * excess
+	return estimate
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// blockyImage returns a `w`×`h` gray image whose 8×8 blocks alternate
+// between two similar gray levels like a coarsely quantized gradient
+func blockyImage(w, h int) *img {
+	i := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := uint8(120 + 8*((x/jpegBlock+y/jpegBlock)%2))
+			i.SetNRGBA(x, y, color.NRGBA{c, c, c, 255})
+		}
+	}
+	return imgFromImage(i)
+}
+
+// gradientImage returns a `w`×`h` image with a smooth horizontal gradient
+func gradientImage(w, h int) *img {
+	i := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := uint8(x * 255 / w)
+			i.SetNRGBA(x, y, color.NRGBA{c, c, c, 255})
+		}
+	}
+	return imgFromImage(i)
+}
+
+func TestBlockiness(t *testing.T) {
+	if b := blockiness(blockyImage(32, 32)); b < 0.99 {
+		t.Fatalf("Expected steps only at block boundaries; got %f", b)
+	}
+	if b := blockiness(gradientImage(64, 64)); b > 0.1 {
+		t.Fatalf("Expected almost no blockiness of a gradient; got %f", b)
+	}
+}
+
+func TestEstimateArtifacts(t *testing.T) {
+	s := newSettings()
+	flat := solidImage(32, 32, color.NRGBA{124, 124, 124, 255})
+	blocky := blockyImage(32, 32)
+	estimate := estimateArtifacts(&s, blocky, flat, blocky)
+	if estimate.Percentage != 0.0 {
+		t.Fatalf("Expected no artifacts for a difference spread evenly; got %f", estimate.Percentage)
+	}
+
+	// a difference along the block boundaries only
+	edges := imgFromImage(image.NewNRGBA(image.Rect(0, 0, 32, 32)))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			c := uint8(124)
+			if onBlockBoundary(x, y) {
+				c = 140
+			}
+			edges.i.(*image.NRGBA).SetNRGBA(x, y, color.NRGBA{c, c, c, 255})
+		}
+	}
+	estimate = estimateArtifacts(&s, blocky, flat, edges)
+	if estimate.Percentage < 99.0 {
+		t.Fatalf("Expected the difference at block boundaries to be attributed to artifacts; got %f", estimate.Percentage)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// batchReporter writes the results of a batch as they become available
+type batchReporter interface {
+	pair(base, ref string, diff difference)
+	skipped(base, ref string, e stateEntry)
+	pairError(base, ref string, err error)
+	lineError(lineNo int, line string)
+	unmatched(path, dir string)
+	abort(base, ref, reason string)
+	summary(pairs, errors int, worst float64, code int, meaning string)
+}
+
+// textReporter writes one line of text per result
+type textReporter struct {
+	w         io.Writer
+	precision int
+}
+
+func (r textReporter) pair(base, ref string, diff difference) {
+	fmt.Fprintf(r.w, "%s %s %.*f %%\n", base, ref, r.precision, diff.percentage())
+}
+
+func (r textReporter) skipped(base, ref string, e stateEntry) {
+	fmt.Fprintf(r.w, "%s %s %.*f %% (unchanged, skipped)\n", base, ref, r.precision, e.Percentage)
+}
+
+func (r textReporter) pairError(base, ref string, err error) {
+	fmt.Fprintf(r.w, "%s %s error: %s\n", base, ref, strings.TrimSpace(err.Error()))
+}
+
+func (r textReporter) lineError(lineNo int, line string) {
+	fmt.Fprintf(r.w, "error: line %d: expected base and reference filepath; got '%s'\n", lineNo, line)
+}
+
+func (r textReporter) unmatched(path, dir string) {
+	fmt.Fprintf(r.w, "%s error: no file of the same name in '%s'\n", path, dir)
+}
+
+func (r textReporter) abort(base, ref, reason string) {
+	fmt.Fprintf(r.w, "aborted: %s %s %s\n", base, ref, reason)
+}
+
+func (r textReporter) summary(pairs, errors int, worst float64, code int, meaning string) {}
+
+// jsonReporter writes one JSON object per line (JSON lines) per result
+// and a final summary object
+type jsonReporter struct {
+	enc     *json.Encoder
+	aborted string
+}
+
+type jsonPair struct {
+	Base       string   `json:"base,omitempty"`
+	Ref        string   `json:"ref,omitempty"`
+	Line       int      `json:"line,omitempty"`
+	Path       string   `json:"path,omitempty"`
+	Percentage *float64 `json:"percentage,omitempty"`
+	Score      *float64 `json:"score,omitempty"`
+	Identical  *bool    `json:"identical,omitempty"`
+	Skipped    bool     `json:"skipped,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+type jsonSummary struct {
+	Summary struct {
+		Pairs           int     `json:"pairs"`
+		Errors          int     `json:"errors"`
+		WorstPercentage float64 `json:"worst_percentage"`
+		ExitCode        int     `json:"exit_code"`
+		ExitCodeMeaning string  `json:"exit_code_meaning"`
+		Aborted         bool    `json:"aborted"`
+		AbortReason     string  `json:"abort_reason,omitempty"`
+	} `json:"summary"`
+}
+
+func (r *jsonReporter) write(v interface{}) {
+	// os.Stdout is unbuffered, hence every line is flushed immediately
+	if err := r.enc.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+	}
+}
+
+func (r *jsonReporter) pair(base, ref string, diff difference) {
+	percent, score, identical := diff.percentage(), diff.score, diff.identical
+	r.write(jsonPair{Base: base, Ref: ref, Percentage: &percent, Score: &score, Identical: &identical})
+}
+
+func (r *jsonReporter) skipped(base, ref string, e stateEntry) {
+	r.write(jsonPair{Base: base, Ref: ref, Percentage: &e.Percentage, Score: &e.Score, Identical: &e.Identical, Skipped: true})
+}
+
+func (r *jsonReporter) pairError(base, ref string, err error) {
+	r.write(jsonPair{Base: base, Ref: ref, Error: strings.TrimSpace(err.Error())})
+}
+
+func (r *jsonReporter) lineError(lineNo int, line string) {
+	r.write(jsonPair{Line: lineNo, Error: fmt.Sprintf("expected base and reference filepath; got '%s'", line)})
+}
+
+func (r *jsonReporter) unmatched(path, dir string) {
+	r.write(jsonPair{Path: path, Error: fmt.Sprintf("no file of the same name in '%s'", dir)})
+}
+
+func (r *jsonReporter) abort(base, ref, reason string) {
+	r.aborted = fmt.Sprintf("%s %s %s", base, ref, reason)
+}
+
+func (r *jsonReporter) summary(pairs, errors int, worst float64, code int, meaning string) {
+	var sum jsonSummary
+	sum.Summary.Pairs = pairs
+	sum.Summary.Errors = errors
+	sum.Summary.WorstPercentage = worst
+	sum.Summary.ExitCode = code
+	sum.Summary.ExitCodeMeaning = meaning
+	sum.Summary.Aborted = r.aborted != ""
+	sum.Summary.AbortReason = r.aborted
+	r.write(sum)
+}
+
+// newBatchReporter returns the reporter for the output format given in Settings
+func newBatchReporter(s *Settings, w io.Writer) batchReporter {
+	if s.Format == "json" {
+		return &jsonReporter{enc: json.NewEncoder(w)}
+	}
+	return textReporter{w, s.Precision}
+}
+
+// runBatch compares all pairs of images listed in the manifest or found
+// in the directories given in Settings and prints one result line per pair.
+// It returns the exit code of the worst result.
+func runBatch(s *Settings) int {
+	if s.BaseDir != "" {
+		return compareDirectories(s, os.Stdout)
+	}
+	var r io.Reader = os.Stdin
+	if s.Batch != "-" {
+		fd, err := os.Open(s.Batch)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			return 101
+		}
+		defer fd.Close()
+		r = fd
+	}
+	return compareBatch(s, r, os.Stdout)
+}
+
+// batch accumulates the results of the pairs of a batch
+type batch struct {
+	s        *Settings
+	reporter batchReporter
+	cache    *decodeCache
+	state    *compareState
+	code     int
+	pairs    int
+	errors   int
+	worst    float64
+	// pairs with different pixels
+	differing int
+	// meaning of the first error
+	failure string
+}
+
+// newBatch returns an empty batch writing its results to `w`.
+// The state is read from the StateFile if given.
+func newBatch(s *Settings, w io.Writer) (*batch, error) {
+	b := &batch{s: s, reporter: newBatchReporter(s, w), cache: newDecodeCache(s.CacheSize)}
+	if s.StateFile != "" {
+		state, err := readState(s.StateFile, settingsFingerprint(s))
+		if err != nil {
+			return nil, err
+		}
+		b.state = state
+	}
+	return b, nil
+}
+
+// fail registers an error which is not related to a pair
+func (b *batch) fail() {
+	b.errors++
+	b.code = maxInt(b.code, 101)
+	if b.failure == "" {
+		b.failure = "invalid-args"
+	}
+}
+
+// compare compares the images at `base` and `ref` and reports the result.
+// With SkipUnchanged, the recorded result is reported if neither file
+// was modified since. If fail-fast is enabled and the pair exceeds the
+// threshold or fails to compare, the batch is aborted and false is returned.
+// Once the comparisons are stopped, e.g. by SIGINT, the batch is aborted too.
+func (b *batch) compare(base, ref string) bool {
+	if err := b.s.stop.stopped(); err != nil {
+		b.stopped(base, ref, err)
+		return false
+	}
+	pair := *b.s
+	pair.BaseImg = base
+	pair.RefImg = ref
+	b.pairs++
+
+	var baseTime, refTime time.Time
+	var statErr error
+	if b.state != nil {
+		baseTime, refTime, statErr = modTimes(base, ref)
+		if statErr == nil && b.s.SkipUnchanged {
+			if e, ok := b.state.unchanged(base, ref, baseTime, refTime); ok {
+				b.reporter.skipped(base, ref, e)
+				return b.account(base, ref, e.Percentage, e.Identical)
+			}
+		}
+	}
+
+	diff, err := compareFiles(&pair, b.cache)
+	if stopped := b.s.stop.stopped(); err != nil && stopped != nil {
+		b.stopped(base, ref, stopped)
+		return false
+	}
+	if err != nil {
+		b.reporter.pairError(base, ref, err)
+		b.errors++
+		// a later error must not lower the return code
+		b.code = maxInt(b.code, errorCode(b.s, err))
+		if b.failure == "" {
+			b.failure = errorMeaning(err)
+		}
+		if b.s.FailFast {
+			b.abort(base, ref, "failed to compare")
+			return false
+		}
+		return true
+	}
+
+	b.reporter.pair(base, ref, diff)
+	if b.state != nil && statErr == nil {
+		b.state.record(base, ref, baseTime, refTime, diff)
+	}
+	return b.account(base, ref, diff.percentage(), diff.identical)
+}
+
+// account registers the difference percentage `percent` of the pair
+// `base` and `ref` and aborts the batch like compare
+func (b *batch) account(base, ref string, percent float64, identical bool) bool {
+	if !identical {
+		b.differing++
+	}
+	if percent > b.worst {
+		b.worst = percent
+	}
+	if b.s.FailFast && percent > b.s.Threshold {
+		b.code = maxInt(b.code, maxInt(int(percent), 1))
+		b.abort(base, ref, fmt.Sprintf("exceeds threshold of %.3f %%", b.s.Threshold))
+		return false
+	}
+	b.code = maxInt(b.code, int(percent))
+	return true
+}
+
+// abort reports the pair which aborted the batch
+func (b *batch) abort(base, ref, reason string) {
+	b.reporter.abort(base, ref, reason)
+}
+
+// stopped aborts the batch at the pair `base` and `ref`, because the
+// comparisons were stopped with `err`. Its return code takes precedence.
+func (b *batch) stopped(base, ref string, err error) {
+	b.code = errorCode(b.s, err)
+	b.failure = errorMeaning(err)
+	b.abort(base, ref, err.Error())
+}
+
+// finish stores the state, reports the summary and returns the exit
+// code of the batch
+func (b *batch) finish() int {
+	if b.state != nil {
+		if err := b.state.write(b.s.StateFile); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			b.code = maxInt(b.code, 101)
+		}
+	}
+	b.reporter.summary(b.pairs, b.errors, b.worst, b.code, b.meaning())
+	return b.code
+}
+
+// meaning describes the outcome of the batch like resultMeaning
+func (b *batch) meaning() string {
+	switch {
+	case b.failure != "":
+		return b.failure
+	case b.differing == 0:
+		return "identical"
+	case b.worst > b.s.Threshold:
+		return "difference"
+	}
+	return "within-threshold"
+}
+
+// compareBatch reads pairs of filepaths line by line from `r`
+// and writes one result line per pair to `w`. If fail-fast is enabled,
+// it stops at the first pair exceeding the threshold or failing to compare.
+func compareBatch(s *Settings, r io.Reader, w io.Writer) int {
+	b, err := newBatch(s, w)
+	if err != nil {
+		fmt.Fprintf(w, "error: %s\n", err.Error())
+		return 101
+	}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			b.reporter.lineError(lineNo, line)
+			b.fail()
+			continue
+		}
+		if !b.compare(fields[0], fields[1]) {
+			return b.finish()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(w, "error: %s\n", err.Error())
+		return 101
+	}
+	return b.finish()
+}
+
+// regularFiles returns the names of all regular files in directory `dir`
+// sorted by name
+func regularFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// compareDirectories pairs the files of BaseDir and RefDir with identical
+// filenames and writes one result line per pair to `w`. Files without
+// counterpart in the other directory are reported as errors.
+func compareDirectories(s *Settings, w io.Writer) int {
+	b, err := newBatch(s, w)
+	if err != nil {
+		fmt.Fprintf(w, "error: %s\n", err.Error())
+		return 101
+	}
+	baseNames, err := regularFiles(s.BaseDir)
+	if err != nil {
+		fmt.Fprintf(w, "error: %s\n", err.Error())
+		return 101
+	}
+	refNames, err := regularFiles(s.RefDir)
+	if err != nil {
+		fmt.Fprintf(w, "error: %s\n", err.Error())
+		return 101
+	}
+
+	// both lists are sorted, so they are merged like in merge sort
+	i, j := 0, 0
+	for i < len(baseNames) || j < len(refNames) {
+		switch {
+		case j == len(refNames) || (i < len(baseNames) && baseNames[i] < refNames[j]):
+			b.reporter.unmatched(filepath.Join(s.BaseDir, baseNames[i]), s.RefDir)
+			b.fail()
+			i++
+		case i == len(baseNames) || refNames[j] < baseNames[i]:
+			b.reporter.unmatched(filepath.Join(s.RefDir, refNames[j]), s.BaseDir)
+			b.fail()
+			j++
+		default:
+			if !b.compare(filepath.Join(s.BaseDir, baseNames[i]), filepath.Join(s.RefDir, refNames[j])) {
+				return b.finish()
+			}
+			i++
+			j++
+		}
+	}
+	return b.finish()
+}
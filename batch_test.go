@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	s := newSettings()
+	manifest := strings.Join([]string{
+		FILES["black"] + " " + FILES["white"],
+		"malformed",
+		FILES["grml_kB"] + " " + FILES["grml_MB"],
+	}, "\n")
+
+	var out bytes.Buffer
+	code := compareBatch(&s, strings.NewReader(manifest), &out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected one result line per manifest line; got %q", out.String())
+	}
+	if !strings.HasPrefix(lines[1], "error:") {
+		t.Fatalf("Malformed line must produce an error line; got '%s'", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], "0.017 %") {
+		t.Fatalf("Malformed line must not abort the batch; got '%s'", lines[2])
+	}
+	if code != 101 {
+		t.Fatalf("Expected exit code 101 for a batch with malformed lines; got %d", code)
+	}
+
+	// a load error must not lower the return code of a previous pair
+	loadErrorCode := 3
+	s.LoadErrorCode = &loadErrorCode
+	manifest = FILES["black"] + " " + FILES["white"] + "\n" + filepath.Join("tests", "does_not_exist.png") + " " + FILES["g"]
+	if code := compareBatch(&s, strings.NewReader(manifest), &out); code != 100 {
+		t.Fatalf("Expected exit code 100 of the worst pair; got %d", code)
+	}
+}
+
+func TestBatchFailFast(t *testing.T) {
+	s := newSettings()
+	s.FailFast = true
+	s.Threshold = 10.0
+	manifest := strings.Join([]string{
+		FILES["grml_kB"] + " " + FILES["grml_MB"],
+		FILES["black"] + " " + FILES["white"],
+		FILES["g"] + " " + FILES["g"],
+	}, "\n")
+
+	var out bytes.Buffer
+	code := compareBatch(&s, strings.NewReader(manifest), &out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[2], "aborted:") {
+		t.Fatalf("Expected abort after the second pair; got %q", out.String())
+	}
+	if code != 100 {
+		t.Fatalf("Expected exit code 100 of the aborting pair; got %d", code)
+	}
+}
+
+func TestBatchJSON(t *testing.T) {
+	s := newSettings()
+	s.Format = "json"
+	manifest := strings.Join([]string{
+		FILES["black"] + " " + FILES["white"],
+		"malformed",
+		FILES["g"] + " " + FILES["g"],
+	}, "\n")
+
+	var out bytes.Buffer
+	code := compareBatch(&s, strings.NewReader(manifest), &out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected one JSON line per manifest line and a summary; got %q", out.String())
+	}
+
+	var first jsonPair
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("Expected a JSON object per line; got '%s': %s", lines[0], err)
+	}
+	if first.Base != FILES["black"] || first.Percentage == nil || *first.Percentage != 100.0 {
+		t.Fatalf("Unexpected result of the first pair: '%s'", lines[0])
+	}
+	var malformed jsonPair
+	if err := json.Unmarshal([]byte(lines[1]), &malformed); err != nil || malformed.Line != 2 || malformed.Error == "" {
+		t.Fatalf("Malformed line must produce an error object; got '%s'", lines[1])
+	}
+
+	var sum jsonSummary
+	if err := json.Unmarshal([]byte(lines[3]), &sum); err != nil {
+		t.Fatalf("Expected a summary object; got '%s': %s", lines[3], err)
+	}
+	if sum.Summary.Pairs != 2 || sum.Summary.Errors != 1 || sum.Summary.ExitCode != code || code != 101 ||
+		sum.Summary.ExitCodeMeaning != "invalid-args" {
+		t.Fatalf("Unexpected summary '%s' for exit code %d", lines[3], code)
+	}
+
+	// the meaning follows the error regardless of the return code
+	out.Reset()
+	loadErrorCode := 3
+	s.LoadErrorCode = &loadErrorCode
+	compareBatch(&s, strings.NewReader(filepath.Join("tests", "does_not_exist.png")+" "+FILES["g"]), &out)
+	if !strings.Contains(out.String(), `"exit_code":3,"exit_code_meaning":"load-error"`) {
+		t.Fatalf("Expected a load error in the summary; got %q", out.String())
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newSettings()
+	s.BaseDir = filepath.Join(dir, "base")
+	s.RefDir = filepath.Join(dir, "ref")
+	black := solidImage(2, 2, color.NRGBA{0, 0, 0, 255})
+	files := []string{
+		filepath.Join(s.BaseDir, "a.png"),
+		filepath.Join(s.BaseDir, "b.png"),
+		filepath.Join(s.RefDir, "a.png"),
+		filepath.Join(s.RefDir, "c.png"),
+	}
+	for _, path := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := writePNG(path, black.i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	code := compareDirectories(&s, &out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected one line per pair and unmatched file; got %q", out.String())
+	}
+	if lines[0] != files[0]+" "+files[2]+" 0.000 %" {
+		t.Fatalf("Expected files of the same name to be paired; got '%s'", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], files[1]+" error:") || !strings.HasPrefix(lines[2], files[3]+" error:") {
+		t.Fatalf("Expected unmatched files to be reported; got %q", out.String())
+	}
+	if code != 101 {
+		t.Fatalf("Expected exit code 101 for unmatched files; got %d", code)
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base, ref := filepath.Join(dir, "base.png"), filepath.Join(dir, "ref.png")
+	if err := writePNG(base, solidImage(2, 2, color.NRGBA{0, 0, 0, 255}).i); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePNG(ref, solidImage(2, 2, color.NRGBA{255, 255, 255, 255}).i); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSettings()
+	s.StateFile = filepath.Join(dir, "state.json")
+	s.SkipUnchanged = true
+	manifest := base + " " + ref
+	run := func() (string, int) {
+		var out bytes.Buffer
+		code := compareBatch(&s, strings.NewReader(manifest), &out)
+		return strings.TrimSpace(out.String()), code
+	}
+
+	if out, code := run(); out != manifest+" 100.000 %" || code != 100 {
+		t.Fatalf("Expected the first run to compare; got '%s' with exit code %d", out, code)
+	}
+	// the recorded result counts like a comparison
+	if out, code := run(); out != manifest+" 100.000 % (unchanged, skipped)" || code != 100 {
+		t.Fatalf("Expected the second run to skip; got '%s' with exit code %d", out, code)
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(ref, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := run(); strings.Contains(out, "skipped") {
+		t.Fatalf("Expected a modified file to be compared again; got '%s'", out)
+	}
+	if out, _ := run(); !strings.Contains(out, "skipped") {
+		t.Fatalf("Expected the recompared pair to skip; got '%s'", out)
+	}
+
+	// results of other settings are not reused
+	s.Tolerance = 0.5
+	if out, _ := run(); strings.Contains(out, "skipped") {
+		t.Fatalf("Expected changed settings to compare again; got '%s'", out)
+	}
+	s.Format, s.MaxWorkers = "text", 1
+	if out, _ := run(); !strings.Contains(out, "skipped") {
+		t.Fatalf("Expected output settings not to affect the state; got '%s'", out)
+	}
+
+	// editing the overlay changes the expected result
+	s.Overlay = filepath.Join(dir, "overlay.png")
+	if err := writePNG(s.Overlay, solidImage(2, 2, color.NRGBA{0, 0, 0, 0}).i); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	if out, _ := run(); !strings.Contains(out, "skipped") {
+		t.Fatalf("Expected the pair with the same overlay to skip; got '%s'", out)
+	}
+	if err := os.Chtimes(s.Overlay, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := run(); strings.Contains(out, "skipped") {
+		t.Fatalf("Expected a modified overlay to compare again; got '%s'", out)
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--state-file", "state.json", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for a state file without batch mode")
+	}
+}
+
+func TestBatchStopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stopped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newSettings()
+	s.Format = "json"
+	s.StateFile = filepath.Join(dir, "state.json")
+	s.stop = newStopSignal()
+	s.stop.stop(&stopError{130, 0, ""})
+	var out bytes.Buffer
+	code := compareBatch(&s, strings.NewReader(FILES["g"]+" "+FILES["g"]), &out)
+
+	var sum jsonSummary
+	if err := json.Unmarshal(out.Bytes(), &sum); err != nil {
+		t.Fatalf("Expected only the summary; got %q: %s", out.String(), err)
+	}
+	if code != 130 || !sum.Summary.Aborted || sum.Summary.ExitCodeMeaning != "interrupted" {
+		t.Fatalf("Expected an interrupted summary with exit code 130; got %q and %d", out.String(), code)
+	}
+	if _, err := os.Stat(s.StateFile); err != nil {
+		t.Fatalf("Expected the state file to be written: %s", err)
+	}
+}
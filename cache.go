@@ -0,0 +1,79 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+)
+
+// decodeCache keeps the most recently used decoded images, e.g. for
+// a reference image compared against many base images in a batch.
+// Entries are keyed by filepath and invalidated if the modification
+// time of the file changes. A nil cache reads every image. Images are
+// decoded outside of the lock, hence concurrent reads decode in parallel.
+type decodeCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// cacheEntry is a decoded image with the modification time of its file
+type cacheEntry struct {
+	filepath string
+	modTime  time.Time
+	i        img
+}
+
+// newDecodeCache returns a cache of at most `size` images or nil
+// if `size` is 0
+func newDecodeCache(size int) *decodeCache {
+	if size <= 0 {
+		return nil
+	}
+	return &decodeCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// read reads the image at `filepath` like readImageMetadata unless
+// an up-to-date decoded image is cached
+func (c *decodeCache) read(filepath string, i *img) error {
+	if c == nil {
+		return readImageMetadata(filepath, i)
+	}
+	info, err := os.Stat(filepath)
+	if err != nil || !info.Mode().IsRegular() {
+		// named pipes cannot be read twice anyway
+		return readImageMetadata(filepath, i)
+	}
+	c.mu.Lock()
+	if e, ok := c.entries[filepath]; ok {
+		entry := e.Value.(*cacheEntry)
+		if entry.modTime.Equal(info.ModTime()) {
+			c.order.MoveToFront(e)
+			*i = entry.i
+			c.mu.Unlock()
+			return nil
+		}
+		c.order.Remove(e)
+		delete(c.entries, filepath)
+	}
+	c.mu.Unlock()
+
+	if err := readImageMetadata(filepath, i); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[filepath]; ok {
+		// decoded concurrently
+		c.order.Remove(e)
+	}
+	c.entries[filepath] = c.order.PushFront(&cacheEntry{filepath, info.ModTime(), *i})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).filepath)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDecodeCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decode-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, b := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")
+	for _, path := range []string{a, b} {
+		if err := writePNG(path, solidImage(2, 2, color.NRGBA{0, 0, 0, 255}).i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(c *decodeCache, path string) img {
+		var i img
+		if err := c.read(path, &i); err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+
+	c := newDecodeCache(1)
+	first := read(c, a)
+	if read(c, a).i != first.i {
+		t.Fatal("Expected the cached image for an unmodified file")
+	}
+
+	// a modified file is decoded again
+	if err := writePNG(a, solidImage(3, 3, color.NRGBA{0, 0, 0, 255}).i); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(a, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if i := read(c, a); i.w != 3 {
+		t.Fatalf("Expected the modified 3×3 image; got %d×%d", i.w, i.h)
+	}
+
+	// the least recently used image is evicted
+	read(c, b)
+	if _, ok := c.entries[a]; ok || c.order.Len() != 1 {
+		t.Fatalf("Expected only the most recently used image in a cache of size 1; got %d entries", c.order.Len())
+	}
+
+	if newDecodeCache(0) != nil {
+		t.Fatal("Cache size 0 must disable the cache")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"os"
+	"time"
+)
+
+// cycleFrames returns the frames of the cycle GIF of `frames` on
+// canvases of the dimensions of the first frame. Colors are mapped to
+// the nearest color of the Plan 9 palette without dithering, such that
+// unchanged pixels never flicker. Changes within a palette step are
+// lost, but the triage frame shows them.
+func cycleFrames(frames []image.Image) []*image.Paletted {
+	canvas := image.Rect(0, 0, frames[0].Bounds().Dx(), frames[0].Bounds().Dy())
+	paletted := make([]*image.Paletted, len(frames))
+	for n, frame := range frames {
+		paletted[n] = image.NewPaletted(canvas, palette.Plan9)
+		draw.Draw(paletted[n], canvas, frame, frame.Bounds().Min, draw.Src)
+	}
+	return paletted
+}
+
+// writeCycleGIF stores an endlessly looping GIF at `filepath` which
+// shows every one of `frames` for `delay`
+func writeCycleGIF(filepath string, frames []image.Image, delay time.Duration) error {
+	anim := gif.GIF{Image: cycleFrames(frames)}
+	// GIF delays are given in hundredths of a second
+	centiseconds := int(delay / (10 * time.Millisecond))
+	if centiseconds < 1 {
+		centiseconds = 1
+	}
+	for range anim.Image {
+		anim.Delay = append(anim.Delay, centiseconds)
+	}
+
+	fd, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return gif.EncodeAll(fd, &anim)
+}
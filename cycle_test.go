@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteCycleGIF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := solidImage(8, 8, color.NRGBA{100, 150, 200, 255})
+	ref := solidImage(8, 8, color.NRGBA{100, 150, 200, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(3, 3, color.NRGBA{255, 0, 0, 255})
+	// a smaller triage image, e.g. of an aligned overlap
+	triage := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+
+	path := filepath.Join(dir, "cycle.gif")
+	if err := writeCycleGIF(path, []image.Image{base.i, ref.i, triage}, 250*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) != 3 || anim.Delay[0] != 25 || anim.LoopCount != 0 {
+		t.Fatalf("Expected 3 frames of 25 centiseconds looping forever; got %d frames of %v, loop count %d", len(anim.Image), anim.Delay, anim.LoopCount)
+	}
+	for _, frame := range anim.Image {
+		if frame.Bounds() != image.Rect(0, 0, 8, 8) {
+			t.Fatalf("Expected frames of the base dimensions; got %v", frame.Bounds())
+		}
+	}
+
+	// only the changed pixel flickers
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			same := anim.Image[0].ColorIndexAt(x, y) == anim.Image[1].ColorIndexAt(x, y)
+			if same == (x == 3 && y == 3) {
+				t.Fatalf("Expected only (3,3) to differ between base and reference frame; (%d,%d) differs: %t", x, y, !same)
+			}
+		}
+	}
+
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--cycle-gif", "c.gif", "--cycle-delay", "0", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for a cycle delay of 0")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+)
+
+// jndThresholds are the ΔE00 values counted as just noticeable
+// difference and as clearly noticeable difference
+var jndThresholds = [2]float64{1.0, 2.0}
+
+// jndExceedance summarizes the CIEDE2000 color differences of the pixels
+// of two images in just noticeable differences (JND), where a ΔE00 of 1
+// is about the smallest difference perceptible side by side
+type jndExceedance struct {
+	// mean ΔE00 of all pixels
+	Mean float64
+	// percentage of the pixels whose ΔE00 exceeds 1 and 2
+	Above1 float64
+	Above2 float64
+}
+
+// degrees converts `rad` to degrees between 0 and 360
+func degrees(rad float64) float64 {
+	d := rad * 180 / math.Pi
+	if d < 0 {
+		d += 360
+	}
+	return d
+}
+
+// radians converts `deg` to radians
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// deltaE2000 returns the CIEDE2000 color difference of the CIELAB colors
+// (l1, a1, b1) and (l2, a2, b2) with the weighting factors kL = kC = kH = 1
+func deltaE2000(l1, a1, b1, l2, a2, b2 float64) float64 {
+	c1, c2 := math.Hypot(a1, b1), math.Hypot(a2, b2)
+	cMean7 := math.Pow((c1+c2)/2, 7)
+	g := 0.5 * (1 - math.Sqrt(cMean7/(cMean7+math.Pow(25, 7))))
+	a1, a2 = (1+g)*a1, (1+g)*a2
+	c1, c2 = math.Hypot(a1, b1), math.Hypot(a2, b2)
+	var h1, h2 float64
+	if c1 != 0.0 {
+		h1 = degrees(math.Atan2(b1, a1))
+	}
+	if c2 != 0.0 {
+		h2 = degrees(math.Atan2(b2, a2))
+	}
+
+	dL, dC := l2-l1, c2-c1
+	var dh float64
+	if c1*c2 != 0.0 {
+		dh = h2 - h1
+		if dh > 180 {
+			dh -= 360
+		} else if dh < -180 {
+			dh += 360
+		}
+	}
+	dH := 2 * math.Sqrt(c1*c2) * math.Sin(radians(dh/2))
+
+	lMean, cMean := (l1+l2)/2, (c1+c2)/2
+	hMean := h1 + h2
+	if c1*c2 != 0.0 {
+		switch {
+		case math.Abs(h1-h2) <= 180:
+			hMean /= 2
+		case h1+h2 < 360:
+			hMean = (hMean + 360) / 2
+		default:
+			hMean = (hMean - 360) / 2
+		}
+	}
+	t := 1 - 0.17*math.Cos(radians(hMean-30)) + 0.24*math.Cos(radians(2*hMean)) +
+		0.32*math.Cos(radians(3*hMean+6)) - 0.20*math.Cos(radians(4*hMean-63))
+	dTheta := 30 * math.Exp(-math.Pow((hMean-275)/25, 2))
+	cMean7 = math.Pow(cMean, 7)
+	rC := 2 * math.Sqrt(cMean7/(cMean7+math.Pow(25, 7)))
+	l50 := (lMean - 50) * (lMean - 50)
+	sL := 1 + 0.015*l50/math.Sqrt(20+l50)
+	sC := 1 + 0.045*cMean
+	sH := 1 + 0.015*cMean*t
+	rT := -math.Sin(radians(2*dTheta)) * rC
+
+	return math.Sqrt((dL/sL)*(dL/sL) + (dC/sC)*(dC/sC) + (dH/sH)*(dH/sH) + rT*(dC/sC)*(dH/sH))
+}
+
+// compareDeltaE2000 compares the CIEDE2000 color differences of the
+// pixels of `baseImg` and `refImg`, ignoring transparency. The score is
+// the fraction of pixels whose difference exceeds 1 JND, i.e. the share
+// of perceptibly different pixels.
+func compareDeltaE2000(baseImg, refImg *img) difference {
+	diff := newDifference()
+	if baseImg.w == 0 || baseImg.h == 0 {
+		return diff
+	}
+	var sum float64
+	var above [len(jndThresholds)]int
+	for y := 0; y < baseImg.h; y++ {
+		for x := 0; x < baseImg.w; x++ {
+			r1, g1, b1, _ := pixelAt(baseImg, x, y)
+			r2, g2, b2, _ := pixelAt(refImg, x, y)
+			l1, a1, bb1 := toLab(r1, g1, b1)
+			l2, a2, bb2 := toLab(r2, g2, b2)
+			d := deltaE2000(l1, a1, bb1, l2, a2, bb2)
+			sum += d
+			for n, threshold := range jndThresholds {
+				if d > threshold {
+					above[n]++
+				}
+			}
+		}
+	}
+	pixels := float64(baseImg.w * baseImg.h)
+	diff.jnd = &jndExceedance{
+		Mean:   sum / pixels,
+		Above1: 100.0 * float64(above[0]) / pixels,
+		Above2: 100.0 * float64(above[1]) / pixels,
+	}
+	diff.rawScore = float64(above[0]) / pixels
+	diff.score = diff.rawScore
+	return diff
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+func TestDeltaE2000(t *testing.T) {
+	// test data of Sharma, Wu and Dalal (2005)
+	pairs := []struct {
+		lab1, lab2 [3]float64
+		expected   float64
+	}{
+		{[3]float64{50, 2.6772, -79.7751}, [3]float64{50, 0, -82.7485}, 2.0425},
+		{[3]float64{50, 0, 0}, [3]float64{50, -1, 2}, 2.3669},
+		{[3]float64{50, 2.5, 0}, [3]float64{73, 25, -18}, 27.1492},
+		{[3]float64{2.0776, 0.0795, -1.1350}, [3]float64{0.9033, -0.0636, -0.5514}, 0.9082},
+		{[3]float64{50, 0, 0}, [3]float64{50, 0, 0}, 0.0},
+	}
+	for _, p := range pairs {
+		d := deltaE2000(p.lab1[0], p.lab1[1], p.lab1[2], p.lab2[0], p.lab2[1], p.lab2[2])
+		if math.Abs(d-p.expected) > 1e-4 {
+			t.Fatalf("Expected ΔE00 %.4f of %v and %v; got %.4f", p.expected, p.lab1, p.lab2, d)
+		}
+	}
+}
+
+func TestCompareDeltaE2000(t *testing.T) {
+	gray := solidImage(10, 10, color.NRGBA{128, 128, 128, 255})
+	if diff := compareDeltaE2000(gray, gray); diff.score != 0.0 || diff.jnd.Mean != 0.0 {
+		t.Fatalf("Expected no difference of identical images; got %f", diff.score)
+	}
+
+	// 30 % of the pixels barely differ, 20 % differ clearly
+	ref := solidImage(10, 10, color.NRGBA{128, 128, 128, 255})
+	draw.Draw(ref.i.(*image.NRGBA), image.Rect(0, 0, 10, 3), image.NewUniform(color.NRGBA{129, 128, 128, 255}), image.ZP, draw.Src)
+	draw.Draw(ref.i.(*image.NRGBA), image.Rect(0, 8, 10, 10), image.NewUniform(color.NRGBA{160, 128, 128, 255}), image.ZP, draw.Src)
+	diff := compareDeltaE2000(gray, ref)
+	if diff.jnd.Above1 != 20.0 || diff.jnd.Above2 != 20.0 {
+		t.Fatalf("Expected 20 %% of the pixels above 1 and 2 JND; got %f and %f", diff.jnd.Above1, diff.jnd.Above2)
+	}
+	if math.Abs(diff.score-0.2) > 1e-9 || diff.jnd.Mean <= 0.0 {
+		t.Fatalf("Expected score 0.2 and a positive mean; got %f and %f", diff.score, diff.jnd.Mean)
+	}
+}
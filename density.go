@@ -0,0 +1,58 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// inkDensity returns the fraction of dark pixels of every block of
+// `size`×`size` pixels of `i`. Incomplete blocks at the right and bottom
+// border consider their existing pixels only. Transparent pixels are no ink.
+func inkDensity(i *img, size int) [][]float64 {
+	cols, rows := (i.w+size-1)/size, (i.h+size-1)/size
+	density := make([][]float64, rows)
+	for by := 0; by < rows; by++ {
+		density[by] = make([]float64, cols)
+		for bx := 0; bx < cols; bx++ {
+			ink, n := 0, 0
+			for y := by * size; y < (by+1)*size && y < i.h; y++ {
+				for x := bx * size; x < (bx+1)*size && x < i.w; x++ {
+					r, g, b, a := toNRGBA(i.i.At(x, y).RGBA())
+					if a >= 32768 && luma(r, g, b) < 32768 {
+						ink++
+					}
+					n++
+				}
+			}
+			density[by][bx] = float64(ink) / float64(n)
+		}
+	}
+	return density
+}
+
+// compareTextDensity compares the ink density maps of `baseImg` and
+// `refImg` with blocks of TextBlockSize pixels. The score is the average
+// absolute difference of the densities. Hence subpixel differences of
+// text rendering barely count, but missing or added text does.
+func compareTextDensity(s *Settings, baseImg, refImg *img) difference {
+	base := inkDensity(baseImg, s.TextBlockSize)
+	ref := inkDensity(refImg, s.TextBlockSize)
+
+	diff := newDifference()
+	cul, blocks := 0.0, 0
+	for by := range base {
+		for bx := range base[by] {
+			d := math.Abs(base[by][bx] - ref[by][bx])
+			cul += d
+			blocks++
+			if d > s.Tolerance {
+				block := image.Rect(bx*s.TextBlockSize, by*s.TextBlockSize, (bx+1)*s.TextBlockSize, (by+1)*s.TextBlockSize)
+				diff.diffBounds = diff.diffBounds.Union(block.Intersect(image.Rect(0, 0, baseImg.w, baseImg.h)))
+			}
+		}
+	}
+	if blocks > 0 {
+		diff.setScore(cul, float64(blocks))
+	}
+	return diff
+}
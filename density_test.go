@@ -0,0 +1,33 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestTextDensity(t *testing.T) {
+	s := newSettings()
+	s.TextBlockSize = 4
+	white, black := color.NRGBA{255, 255, 255, 255}, color.NRGBA{0, 0, 0, 255}
+	base := solidImage(8, 8, white)
+	shifted := solidImage(8, 8, white)
+	blank := solidImage(8, 8, white)
+	base.i.(*image.NRGBA).SetNRGBA(0, 0, black)
+	shifted.i.(*image.NRGBA).SetNRGBA(1, 0, black)
+
+	// a shift within a block retains the density
+	if diff := compareTextDensity(&s, base, shifted); diff.score != 0.0 {
+		t.Fatalf("Expected no difference for a shift within a block; got %f", diff.score)
+	}
+
+	// missing ink changes the density of 1 of 4 blocks by 1/16
+	diff := compareTextDensity(&s, base, blank)
+	if math.Abs(diff.score-1.0/16.0/4.0*1.25) > 1e-9 {
+		t.Fatalf("Expected difference %f for missing ink; got %f", 1.0/16.0/4.0*1.25, diff.score)
+	}
+	if diff.diffBounds != image.Rect(0, 0, 4, 4) {
+		t.Fatalf("Expected changed region (0,0)-(4,4); got %v", diff.diffBounds)
+	}
+}
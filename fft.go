@@ -0,0 +1,151 @@
+package main
+
+import (
+	"image"
+	"math"
+	"math/cmplx"
+)
+
+// fft transforms `a` in place by the iterative radix-2 Cooley-Tukey
+// algorithm. The length of `a` must be a power of 2.
+func fft(a []complex128) {
+	n := len(a)
+	// bit-reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := a[start+k], a[start+k+size/2]*wk
+				a[start+k], a[start+k+size/2] = u+v, u-v
+				wk *= w
+			}
+		}
+	}
+}
+
+// nextPowerOfTwo returns the smallest power of 2 of at least `n`
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// lumaPlane returns the luma of `i` zero-padded to `w`×`h` pixels
+func lumaPlane(i *img, w, h int) []complex128 {
+	data := make([]complex128, w*h)
+	for y := 0; y < i.h; y++ {
+		for x := 0; x < i.w; x++ {
+			r, g, b, _ := i.i.At(x, y).RGBA()
+			data[y*w+x] = complex(luma(float64(r), float64(g), float64(b))/maxChannel, 0)
+		}
+	}
+	return data
+}
+
+// fft2 transforms the `w`×`h` matrix `data` in place by fft of the rows,
+// then the columns. `w` and `h` must be powers of 2.
+func fft2(data []complex128, w, h int) {
+	for y := 0; y < h; y++ {
+		fft(data[y*w : (y+1)*w])
+	}
+	column := make([]complex128, h)
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			column[y] = data[y*w+x]
+		}
+		fft(column)
+		for y := 0; y < h; y++ {
+			data[y*w+x] = column[y]
+		}
+	}
+}
+
+// spectrum returns the logarithmic magnitudes of the 2D Fourier transform
+// of the luma of `i`. The image is zero-padded to powers of 2.
+func spectrum(i *img) []float64 {
+	w, h := nextPowerOfTwo(i.w), nextPowerOfTwo(i.h)
+	data := lumaPlane(i, w, h)
+	fft2(data, w, h)
+
+	magnitudes := make([]float64, len(data))
+	for n, c := range data {
+		magnitudes[n] = math.Log1p(cmplx.Abs(c))
+	}
+	return magnitudes
+}
+
+// compareSpectra compares the magnitude spectra of the luma of `baseImg`
+// and `refImg`. The score is the sum of the absolute differences of the
+// logarithmic magnitudes divided by the sum of both magnitudes. Hence
+// periodic artifacts like moiré or compression blocks are emphasized.
+func compareSpectra(baseImg, refImg *img) difference {
+	base, ref := spectrum(baseImg), spectrum(refImg)
+	var delta, total float64
+	for n := range base {
+		delta += math.Abs(base[n] - ref[n])
+		total += base[n] + ref[n]
+	}
+	diff := newDifference()
+	if total > 0.0 {
+		diff.rawScore = delta / total
+		diff.score = math.Min(diff.rawScore, 1.0)
+	}
+	return diff
+}
+
+// minShiftPeak is the minimum height of the phase correlation peak
+// for a translation to be considered as detected
+const minShiftPeak = 0.1
+
+// detectShift estimates a constant translation between `baseImg` and
+// `refImg` of the same dimensions by phase correlation of their luma,
+// i.e. base pixel (x,y) probably corresponds to reference pixel
+// (x+dx,y+dy). It returns nil if the correlation has no clear peak.
+func detectShift(baseImg, refImg *img) *image.Point {
+	w, h := nextPowerOfTwo(baseImg.w), nextPowerOfTwo(baseImg.h)
+	base, ref := lumaPlane(baseImg, w, h), lumaPlane(refImg, w, h)
+	fft2(base, w, h)
+	fft2(ref, w, h)
+
+	// normalized cross-power spectrum, inverse transform by conjugation
+	for n := range ref {
+		c := ref[n] * cmplx.Conj(base[n])
+		if abs := cmplx.Abs(c); abs > 1e-12 {
+			c /= complex(abs, 0)
+		}
+		ref[n] = cmplx.Conj(c)
+	}
+	fft2(ref, w, h)
+
+	peak, at := math.Inf(-1), 0
+	for n, c := range ref {
+		if v := real(c) / float64(w*h); v > peak {
+			peak, at = v, n
+		}
+	}
+	if peak < minShiftPeak {
+		return nil
+	}
+	// indices beyond the half wrap around to negative shifts
+	shift := image.Pt(at%w, at/w)
+	if shift.X > w/2 {
+		shift.X -= w
+	}
+	if shift.Y > h/2 {
+		shift.Y -= h
+	}
+	return &shift
+}
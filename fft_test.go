@@ -0,0 +1,77 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+func TestFFT(t *testing.T) {
+	// the transform of an impulse is constant
+	a := make([]complex128, 8)
+	a[0] = 1
+	fft(a)
+	for k, c := range a {
+		if cmplx.Abs(c-1) > 1e-12 {
+			t.Fatalf("Expected 1 at frequency %d; got %v", k, c)
+		}
+	}
+
+	// a cosine of frequency 1 yields peaks at frequencies 1 and 7
+	for n := range a {
+		a[n] = complex(math.Cos(2*math.Pi*float64(n)/8), 0)
+	}
+	fft(a)
+	for k, c := range a {
+		expected := 0.0
+		if k == 1 || k == 7 {
+			expected = 4.0
+		}
+		if math.Abs(cmplx.Abs(c)-expected) > 1e-9 {
+			t.Fatalf("Expected magnitude %f at frequency %d; got %f", expected, k, cmplx.Abs(c))
+		}
+	}
+}
+
+func TestCompareSpectra(t *testing.T) {
+	gray := solidImage(16, 16, color.NRGBA{128, 128, 128, 255})
+	if diff := compareSpectra(gray, gray); diff.score != 0.0 {
+		t.Fatalf("Identical images must have identical spectra; got %f", diff.score)
+	}
+
+	// vertical stripes introduce a periodic pattern
+	stripes := solidImage(16, 16, color.NRGBA{128, 128, 128, 255})
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x += 2 {
+			stripes.i.(*image.NRGBA).SetNRGBA(x, y, color.NRGBA{160, 160, 160, 255})
+		}
+	}
+	if diff := compareSpectra(gray, stripes); diff.score <= 0.0 || diff.score > 1.0 {
+		t.Fatalf("Expected a spectral difference between 0 and 1; got %f", diff.score)
+	}
+}
+
+func TestDetectShift(t *testing.T) {
+	noise := rand.New(rand.NewSource(1))
+	content := image.NewNRGBA(image.Rect(0, 0, 40, 36))
+	noise.Read(content.Pix)
+	// the content of the reference is shifted 2 pixels right and 3 pixels down
+	base := imgFromImage(crop(content, image.Rect(2, 3, 38, 33)))
+	ref := imgFromImage(crop(content, image.Rect(0, 0, 36, 30)))
+	for _, i := range []*img{base, ref} {
+		for n := 3; n < len(i.i.(*image.NRGBA).Pix); n += 4 {
+			i.i.(*image.NRGBA).Pix[n] = 255
+		}
+	}
+	if shift := detectShift(base, ref); shift == nil || *shift != image.Pt(2, 3) {
+		t.Fatalf("Expected shift (2,3); got %v", shift)
+	}
+
+	gray := solidImage(16, 16, color.NRGBA{128, 128, 128, 255})
+	if shift := detectShift(gray, gray); shift != nil {
+		t.Fatalf("Uniform images must not have a detectable shift; got %v", shift)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+)
+
+// hogBins is the number of orientation bins of a cell between 0° and 180°
+const hogBins = 9
+
+// hogEpsilon is the minimum gradient magnitude of a cell considered as
+// structure, such that flat cells compare as equal
+const hogEpsilon = 1e-6
+
+// orientationHistograms returns the histograms of the unsigned luma
+// gradient orientations of `i` per cell of `cellSize`×`cellSize`
+// pixels weighted by the gradient magnitudes. Incomplete cells at the
+// right and bottom border are included. Every histogram is normalized
+// to sum up to 1 unless the cell is flat, which yields only zeros.
+func orientationHistograms(i *img, cellSize int) [][hogBins]float64 {
+	lumas := lumaValues(i.i)
+	at := func(x, y int) float64 {
+		return lumas[clampInt(y, 0, i.h-1)*i.w+clampInt(x, 0, i.w-1)]
+	}
+
+	cols, rows := (i.w+cellSize-1)/cellSize, (i.h+cellSize-1)/cellSize
+	hists := make([][hogBins]float64, cols*rows)
+	for y := 0; y < i.h; y++ {
+		for x := 0; x < i.w; x++ {
+			gx, gy := at(x+1, y)-at(x-1, y), at(x, y+1)-at(x, y-1)
+			magnitude := math.Hypot(gx, gy)
+			if magnitude == 0.0 {
+				continue
+			}
+			// unsigned orientation, i.e. the direction of the edge
+			angle := math.Atan2(gy, gx)
+			if angle < 0 {
+				angle += math.Pi
+			}
+			bin := int(angle / math.Pi * hogBins)
+			if bin >= hogBins {
+				// 180° is 0°
+				bin = 0
+			}
+			hists[(y/cellSize)*cols+x/cellSize][bin] += magnitude
+		}
+	}
+
+	for n := range hists {
+		var sum float64
+		for _, v := range hists[n] {
+			sum += v
+		}
+		for b := range hists[n] {
+			if sum > hogEpsilon {
+				hists[n][b] /= sum
+			} else {
+				hists[n][b] = 0.0
+			}
+		}
+	}
+	return hists
+}
+
+// compareHOG compares the gradient orientation histograms per cell of
+// `cellSize` pixels of `baseImg` and `refImg`. The distance of two cells
+// is half the sum of the absolute differences of their normalized
+// histograms between 0 and 1, where a flat cell differs completely from
+// a structured one. The score is the average distance of the cells.
+// Hence colors and contrast are ignored, but edges and shapes are not.
+func compareHOG(baseImg, refImg *img, cellSize int) difference {
+	base, ref := orientationHistograms(baseImg, cellSize), orientationHistograms(refImg, cellSize)
+	diff := newDifference()
+	if len(base) == 0 {
+		return diff
+	}
+	var total float64
+	for n := range base {
+		var sumB, sumR, d float64
+		for b := 0; b < hogBins; b++ {
+			sumB, sumR = sumB+base[n][b], sumR+ref[n][b]
+			d += math.Abs(base[n][b] - ref[n][b])
+		}
+		if (sumB == 0.0) != (sumR == 0.0) {
+			d = 2.0
+		}
+		total += d / 2
+	}
+	diff.rawScore = total / float64(len(base))
+	diff.score = math.Min(diff.rawScore, 1.0)
+	return diff
+}
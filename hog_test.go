@@ -0,0 +1,50 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// squareImage returns a 32×32 image of color `bg` with a square
+// of color `fg` from (8,8) to (24,24)
+func squareImage(fg, bg color.NRGBA) *img {
+	i := solidImage(32, 32, bg)
+	draw.Draw(i.i.(*image.NRGBA), image.Rect(8, 8, 24, 24), image.NewUniform(fg), image.ZP, draw.Src)
+	return i
+}
+
+func TestCompareHOG(t *testing.T) {
+	black := color.NRGBA{0, 0, 0, 255}
+	white := color.NRGBA{255, 255, 255, 255}
+
+	// colors and the direction of the contrast are ignored
+	base := squareImage(black, white)
+	ref := squareImage(color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 128, 255})
+	if diff := compareHOG(base, ref, 8); diff.score > 1e-9 {
+		t.Fatalf("Expected no difference for the same shape in other colors; got %f", diff.score)
+	}
+
+	flat := solidImage(32, 32, white)
+	if diff := compareHOG(flat, solidImage(32, 32, black), 8); diff.score != 0.0 {
+		t.Fatalf("Expected no difference of flat images; got %f", diff.score)
+	}
+	if diff := compareHOG(base, flat, 8); diff.score < 0.5 {
+		t.Fatalf("Expected a missing shape to differ; got %f", diff.score)
+	}
+
+	// a vertical and a horizontal edge have orthogonal gradients
+	vertical := solidImage(16, 16, white)
+	draw.Draw(vertical.i.(*image.NRGBA), image.Rect(0, 0, 8, 16), image.Black, image.ZP, draw.Src)
+	horizontal := solidImage(16, 16, white)
+	draw.Draw(horizontal.i.(*image.NRGBA), image.Rect(0, 0, 16, 8), image.Black, image.ZP, draw.Src)
+	if diff := compareHOG(vertical, horizontal, 16); diff.score < 0.99 {
+		t.Fatalf("Expected orthogonal edges to differ completely; got %f", diff.score)
+	}
+
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--metric", "hog", "--cell-size", "0", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for cell size 0")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// inspectPixel writes the color values of pixel `p` of `baseImg` and
+// `refImg` and their distance as defined by Settings to `w`
+func inspectPixel(w io.Writer, s *Settings, baseImg, refImg *img, p image.Point) error {
+	if !p.In(image.Rect(0, 0, baseImg.w, baseImg.h)) {
+		return fmt.Errorf("pixel (%d,%d) is out of bounds of the %d×%d images", p.X, p.Y, baseImg.w, baseImg.h)
+	}
+
+	fmt.Fprintf(w, "pixel:                  (%d,%d)\n", p.X, p.Y)
+	for _, i := range []struct {
+		name string
+		i    *img
+	}{{"base", baseImg}, {"reference", refImg}} {
+		r, g, b, a := i.i.i.At(p.X, p.Y).RGBA()
+		nr, ng, nb, na := toNRGBA(r, g, b, a)
+		yPrime, u, v := toYUV(nr/maxChannel, ng/maxChannel, nb/maxChannel)
+		l, la, lb := toLab(nr, ng, nb)
+		fmt.Fprintf(w, "%-24s%d %d %d %d\n", i.name+" RGBA:", r, g, b, a)
+		fmt.Fprintf(w, "%-24s%.0f %.0f %.0f %.0f\n", i.name+" NRGBA:", nr, ng, nb, na)
+		fmt.Fprintf(w, "%-24s%.4f %.4f %.4f\n", i.name+" Y'UV:", yPrime, u, v)
+		fmt.Fprintf(w, "%-24s%.2f %.2f %.2f\n", i.name+" Lab:", l, la, lb)
+	}
+
+	prepareEdges(s, baseImg)
+	px := comparePixel(s, baseImg, refImg, p.X, p.Y, maxDistanceFor(s))
+	switch {
+	case px.skip:
+		fmt.Fprintf(w, "distance:               excluded\n")
+	case px.d == 0.0:
+		fmt.Fprintf(w, "distance:               0 (identical)\n")
+	case px.d <= s.Tolerance:
+		fmt.Fprintf(w, "distance:               %g (within tolerance %g)\n", px.d, s.Tolerance)
+	default:
+		fmt.Fprintf(w, "distance:               %g (exceeds tolerance %g)\n", px.d, s.Tolerance)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestInspectPixel(t *testing.T) {
+	s := newSettings()
+	base := solidImage(2, 2, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(2, 2, color.NRGBA{0, 0, 0, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(1, 0, color.NRGBA{255, 0, 0, 128})
+
+	var out bytes.Buffer
+	if err := inspectPixel(&out, &s, base, ref, image.Pt(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"pixel:                  (1,0)",
+		"reference RGBA:         32896 0 0 32896",
+		"reference NRGBA:        65535 0 0 32896",
+		"base Lab:               0.00 0.00 0.00",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Fatalf("Expected line '%s'; got %q", line, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "exceeds tolerance") {
+		t.Fatalf("Expected the pixel to exceed the tolerance; got %q", out.String())
+	}
+
+	if err := inspectPixel(&out, &s, base, ref, image.Pt(2, 0)); err == nil {
+		t.Fatal("Expected an error for a pixel out of bounds")
+	}
+}
+
+func TestToLab(t *testing.T) {
+	l, a, b := toLab(maxChannel, maxChannel, maxChannel)
+	if math.Abs(l-100) > 1e-3 || math.Abs(a) > 1e-3 || math.Abs(b) > 1e-3 {
+		t.Fatalf("Expected white at L*=100; got %f %f %f", l, a, b)
+	}
+	// sRGB red is about (53.24, 80.09, 67.20)
+	l, a, b = toLab(maxChannel, 0, 0)
+	if math.Abs(l-53.24) > 0.01 || math.Abs(a-80.09) > 0.01 || math.Abs(b-67.20) > 0.01 {
+		t.Fatalf("Expected red at (53.24, 80.09, 67.20); got %f %f %f", l, a, b)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// phashSize is the width and height of the luma thumbnail of the
+// perceptual hash, of which the lowest 8×8 DCT frequencies are hashed
+const phashSize = 32
+
+// phash returns the 64 bit perceptual hash of `i`. Every bit tells
+// whether one of the lowest 8×8 frequencies of the DCT of a 32×32 luma
+// thumbnail exceeds their median (without the DC term). Similar images
+// have hashes which differ in few bits.
+func phash(i *img) uint64 {
+	if i.w == 0 || i.h == 0 {
+		return 0
+	}
+	lumas := lumaValues(i.i)
+	// area average, every thumbnail pixel covers at least one pixel
+	var thumb [phashSize][phashSize]float64
+	for ty := 0; ty < phashSize; ty++ {
+		y0 := ty * i.h / phashSize
+		y1 := maxInt((ty+1)*i.h/phashSize, y0+1)
+		for tx := 0; tx < phashSize; tx++ {
+			x0 := tx * i.w / phashSize
+			x1 := maxInt((tx+1)*i.w/phashSize, x0+1)
+			var sum float64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					sum += lumas[y*i.w+x]
+				}
+			}
+			thumb[ty][tx] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+
+	var cosines [8][phashSize]float64
+	for u := range cosines {
+		for x := range cosines[u] {
+			cosines[u][x] = math.Cos(float64((2*x+1)*u) * math.Pi / (2 * phashSize))
+		}
+	}
+	// separable DCT-II of the lowest frequencies, rows first
+	var rows [phashSize][8]float64
+	for y := 0; y < phashSize; y++ {
+		for u := 0; u < 8; u++ {
+			for x := 0; x < phashSize; x++ {
+				rows[y][u] += thumb[y][x] * cosines[u][x]
+			}
+		}
+	}
+	coefficients := make([]float64, 0, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var c float64
+			for y := 0; y < phashSize; y++ {
+				c += rows[y][u] * cosines[v][y]
+			}
+			coefficients = append(coefficients, c)
+		}
+	}
+
+	sorted := append([]float64(nil), coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	var hash uint64
+	for n, c := range coefficients {
+		if c > median {
+			hash |= 1 << uint(n)
+		}
+	}
+	return hash
+}
+
+// maxInt returns the larger of `a` and `b`
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// hammingDistance returns the number of bits in which `a` and `b` differ
+func hammingDistance(a, b uint64) int {
+	count := 0
+	for x := a ^ b; x != 0; x &= x - 1 {
+		count++
+	}
+	return count
+}
+
+// similarityMatrix compares every pair of the images at `paths` given
+// in Settings and returns the difference percentages, where row n holds
+// the differences of image n as base image. Both directions of a pair
+// are compared as the difference depends on which image is the base,
+// e.g. with --alpha-as-mask or --base-alpha, and the diagonal is zero.
+// At most CacheSize decoded images are kept in memory. Pairs whose
+// perceptual hashes differ in more than PHashCutoff bits and pairs which
+// fail to compare are nil. Errors are written to `errOut`. Once the
+// comparisons are stopped, e.g. by SIGINT, the remaining pairs are nil.
+func similarityMatrix(s *Settings, paths []string, errOut io.Writer) ([][]*float64, int) {
+	cache := newDecodeCache(s.CacheSize)
+	code := 0
+	hashes := make([]*uint64, len(paths))
+	if s.PHashCutoff < 64 {
+		for n, path := range paths {
+			var i img
+			if err := cache.read(path, &i); err != nil {
+				fmt.Fprintf(errOut, "error: %s\n", err.Error())
+				code = errorCode(s, err)
+				continue
+			}
+			hash := phash(&i)
+			hashes[n] = &hash
+		}
+	}
+
+	matrix := make([][]*float64, len(paths))
+	for n := range matrix {
+		matrix[n] = make([]*float64, len(paths))
+		zero := 0.0
+		matrix[n][n] = &zero
+	}
+	for n := range paths {
+		for m := range paths {
+			if m == n {
+				continue
+			}
+			if err := s.stop.stopped(); err != nil {
+				fmt.Fprintf(errOut, "error: %s\n", err.Error())
+				return matrix, errorCode(s, err)
+			}
+			if s.PHashCutoff < 64 {
+				if hashes[n] == nil || hashes[m] == nil || hammingDistance(*hashes[n], *hashes[m]) > s.PHashCutoff {
+					continue
+				}
+			}
+			pair := *s
+			pair.BaseImg, pair.RefImg = paths[n], paths[m]
+			diff, err := compareFiles(&pair, cache)
+			if err != nil {
+				fmt.Fprintf(errOut, "error: %s %s: %s\n", paths[n], paths[m], err.Error())
+				code = errorCode(s, err)
+				continue
+			}
+			percent := diff.percentage()
+			matrix[n][m] = &percent
+		}
+	}
+	return matrix, code
+}
+
+// writeMatrixCSV writes `matrix` of the images at `paths` as CSV with the
+// filepaths as labels of the first row and the first column. Missing
+// differences are empty.
+func writeMatrixCSV(w io.Writer, paths []string, matrix [][]*float64, precision int) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(append([]string{""}, paths...)); err != nil {
+		return err
+	}
+	for n, row := range matrix {
+		record := []string{paths[n]}
+		for _, v := range row {
+			if v == nil {
+				record = append(record, "")
+			} else {
+				record = append(record, strconv.FormatFloat(*v, 'f', precision, 64))
+			}
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// jsonMatrix represents the difference matrix in JSON output
+type jsonMatrix struct {
+	Images      []string     `json:"images"`
+	Percentages [][]*float64 `json:"percentages"`
+}
+
+// runMatrix compares every pair of the images given in Settings and
+// prints the difference matrix as CSV or JSON. It returns 0 or the
+// error code if any pair fails to compare.
+func runMatrix(s *Settings) int {
+	matrix, code := similarityMatrix(s, s.MatrixImgs, os.Stderr)
+	var err error
+	if s.Format == "json" {
+		err = json.NewEncoder(os.Stdout).Encode(jsonMatrix{s.MatrixImgs, matrix})
+	} else {
+		err = writeMatrixCSV(os.Stdout, s.MatrixImgs, matrix, s.Precision)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		return 101
+	}
+	return code
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// waveImage returns a `w`×`h` gray image of smooth waves with
+// periods of about `px` and `py` pixels, brightened by `offset`
+func waveImage(w, h int, px, py float64, offset uint8) *img {
+	i := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 100 + 80*math.Sin(2*math.Pi*(float64(x)/px+float64(y*y)/(py*float64(h))))*math.Cos(2*math.Pi*float64(y)/py)
+			c := uint8(v) + offset
+			i.SetNRGBA(x, y, color.NRGBA{c, c, c, 255})
+		}
+	}
+	return imgFromImage(i)
+}
+
+func TestPHash(t *testing.T) {
+	base := waveImage(64, 64, 40, 70, 0)
+	similar := waveImage(64, 64, 40, 70, 20)
+	fillRect(similar.i.(*image.NRGBA), image.Rect(10, 10, 12, 12), color.NRGBA{255, 255, 255, 255})
+	other := waveImage(64, 64, 70, 40, 0)
+
+	if d := hammingDistance(phash(base), phash(similar)); d > 4 {
+		t.Fatalf("Expected similar hashes of similar images; got %d different bits", d)
+	}
+	if d := hammingDistance(phash(base), phash(other)); d < 16 {
+		t.Fatalf("Expected different hashes of different images; got %d different bits", d)
+	}
+	// images smaller than the thumbnail
+	phash(solidImage(3, 5, color.NRGBA{255, 255, 255, 255}))
+}
+
+func TestSimilarityMatrix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matrix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	images := map[string]*img{
+		"a.png": waveImage(32, 32, 20, 35, 0),
+		"b.png": waveImage(32, 32, 20, 35, 0),
+		"c.png": waveImage(32, 32, 35, 20, 0),
+		"d.png": waveImage(16, 16, 20, 35, 0),
+	}
+	fillRect(images["b.png"].i.(*image.NRGBA), image.Rect(0, 0, 1, 1), color.NRGBA{255, 255, 255, 255})
+	var paths []string
+	for _, name := range []string{"a.png", "b.png", "c.png", "d.png"} {
+		path := filepath.Join(dir, name)
+		if err := writePNG(path, images[name].i); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	s := newSettings()
+	var errOut bytes.Buffer
+	matrix, code := similarityMatrix(&s, paths, &errOut)
+	if code != 101 || !strings.Contains(errOut.String(), "dimensions") {
+		t.Fatalf("Expected a dimension error of d.png; got %d and '%s'", code, errOut.String())
+	}
+	if *matrix[0][0] != 0.0 || matrix[0][3] != nil || *matrix[0][1] != *matrix[1][0] || *matrix[0][1] >= *matrix[0][2] {
+		t.Fatalf("Unexpected matrix %v %v %v", *matrix[0][1], *matrix[1][0], *matrix[0][2])
+	}
+
+	// the pHash cutoff skips the dissimilar pair
+	s.PHashCutoff = 4
+	matrix, _ = similarityMatrix(&s, paths[:3], ioutil.Discard)
+	if matrix[0][1] == nil || matrix[0][2] != nil {
+		t.Fatal("Expected only the similar pair to be compared")
+	}
+
+	// the reference masks the difference, hence both directions differ
+	opaque := solidImage(10, 1, color.NRGBA{0, 0, 0, 255})
+	masked := solidImage(10, 1, color.NRGBA{0, 0, 0, 0})
+	masked.i.(*image.NRGBA).SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	masked.i.(*image.NRGBA).SetNRGBA(1, 0, color.NRGBA{0, 0, 0, 255})
+	maskPaths := []string{filepath.Join(dir, "opaque.png"), filepath.Join(dir, "masked.png")}
+	for n, i := range []*img{opaque, masked} {
+		if err := writePNG(maskPaths[n], i.i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s = newSettings()
+	s.AlphaAsMask = true
+	s.CacheSize = 1
+	matrix, code = similarityMatrix(&s, maskPaths, ioutil.Discard)
+	if code != 0 || matrix[0][1] == nil || matrix[1][0] == nil || *matrix[0][1] == *matrix[1][0] {
+		t.Fatalf("Expected different directions with --alpha-as-mask; got %v and exit code %d", matrix, code)
+	}
+
+	var out bytes.Buffer
+	if err := writeMatrixCSV(&out, []string{"a", "b"}, [][]*float64{{matrix[0][0], nil}, {nil, matrix[1][1]}}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != ",a,b\na,0.0,\nb,,0.0\n" {
+		t.Fatalf("Unexpected CSV '%s'", out.String())
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--similarity-matrix", "a.png", "b.png", "c.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.MatrixImgs) != 3 {
+		t.Fatalf("Expected 3 images; got %v", s.MatrixImgs)
+	}
+	s = newSettings()
+	if err := parseArguments(&s, []string{"a.png", "b.png", "c.png"}); err == nil {
+		t.Fatal("Expected an error for a third positional argument without --similarity-matrix")
+	}
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--phash-cutoff", "8", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for --phash-cutoff without --similarity-matrix")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// pngSignature is the magic number every PNG file starts with
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// hasICCProfile reports whether the encoded image `data` of format
+// `format` embeds an ICC color profile
+func hasICCProfile(data []byte, format string) bool {
+	switch format {
+	case "png":
+		return hasPNGChunk(data, "iCCP", "IDAT")
+	case "jpeg":
+		return hasJPEGSegment(data, 0xE2, []byte("ICC_PROFILE\x00"))
+	}
+	return false
+}
+
+// pngChunk returns the type and the payload of the chunk at `pos` of
+// the PNG file `data` and the position of the next chunk. It returns
+// false unless the whole chunk fits into `data`. The length is checked
+// before its conversion to int, which is negative for large lengths on
+// 32-bit platforms.
+func pngChunk(data []byte, pos int) (string, []byte, int, bool) {
+	// length, type, data and CRC
+	if len(data)-pos < 12 {
+		return "", nil, 0, false
+	}
+	length := binary.BigEndian.Uint32(data[pos : pos+4])
+	if uint64(length) > uint64(len(data)-pos-12) {
+		return "", nil, 0, false
+	}
+	end := pos + 8 + int(length)
+	return string(data[pos+4 : pos+8]), data[pos+8 : end], end + 4, true
+}
+
+// hasPNGChunk reports whether the PNG file `data` contains a chunk
+// of type `chunkType` before the first chunk of type `stopType`
+func hasPNGChunk(data []byte, chunkType, stopType string) bool {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return false
+	}
+	pos := len(pngSignature)
+	for {
+		typ, _, next, ok := pngChunk(data, pos)
+		if !ok {
+			return false
+		}
+		if typ == chunkType {
+			return true
+		}
+		if typ == stopType {
+			return false
+		}
+		pos = next
+	}
+}
+
+// pngText returns the keywords and texts of the tEXt chunks of the
+// encoded image `data` of format `format` or nil if it has none
+func pngText(data []byte, format string) map[string]string {
+	if format != "png" || !bytes.HasPrefix(data, pngSignature) {
+		return nil
+	}
+	var text map[string]string
+	pos := len(pngSignature)
+	for {
+		typ, payload, next, ok := pngChunk(data, pos)
+		if !ok || typ == "IEND" {
+			break
+		}
+		if typ == "tEXt" {
+			// keyword and text are separated by a null byte
+			if sep := bytes.IndexByte(payload, 0); sep > 0 {
+				if text == nil {
+					text = make(map[string]string)
+				}
+				text[string(payload[:sep])] = string(payload[sep+1:])
+			}
+		}
+		pos = next
+	}
+	return text
+}
+
+// hasJPEGSegment reports whether the JPEG file `data` contains
+// a segment with marker `marker` whose payload starts with `prefix`
+func hasJPEGSegment(data []byte, marker byte, prefix []byte) bool {
+	return jpegSegment(data, marker, prefix) != nil
+}
+
+// jpegSegment returns the payload of the first segment of the JPEG file
+// `data` with marker `marker` whose payload starts with `prefix` or nil
+func jpegSegment(data []byte, marker byte, prefix []byte) []byte {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil
+		}
+		m := data[pos+1]
+		if m == 0xDA || m == 0xD9 {
+			// start of scan or end of image; no more metadata
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if end > len(data) {
+			return nil
+		}
+		if m == marker && bytes.HasPrefix(data[pos+4:end], prefix) {
+			return data[pos+4 : end]
+		}
+		pos = end
+	}
+	return nil
+}
+
+// exifOrientation returns the EXIF orientation tag (1 to 8) of the encoded
+// image `data` of format `format`. It returns 1 if no valid tag is present.
+func exifOrientation(data []byte, format string) int {
+	if format != "jpeg" {
+		return 1
+	}
+	payload := jpegSegment(data, 0xE1, []byte("Exif\x00\x00"))
+	if payload == nil {
+		return 1
+	}
+	tiff := payload[6:]
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	// IFD0 entries: tag (2), type (2), count (4), value (4)
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for e := 0; e < entries; e++ {
+		pos := ifd + 2 + 12*e
+		if pos+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[pos:pos+2]) == 0x0112 {
+			o := int(order.Uint16(tiff[pos+8 : pos+10]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+	return 1
+}
+
+// completelyEncoded reports whether the encoded image `data` of format
+// `format` ends with its end marker. Go decodes some truncated files
+// without error; trailing data after the end marker is rejected as well.
+// Formats without a known end marker are considered complete.
+func completelyEncoded(data []byte, format string) bool {
+	switch format {
+	case "png":
+		if !bytes.HasPrefix(data, pngSignature) {
+			return false
+		}
+		pos := len(pngSignature)
+		for {
+			typ, _, next, ok := pngChunk(data, pos)
+			if !ok {
+				return false
+			}
+			if typ == "IEND" {
+				return next == len(data)
+			}
+			pos = next
+		}
+	case "jpeg":
+		return bytes.HasSuffix(data, []byte{0xFF, 0xD9})
+	case "gif":
+		return bytes.HasSuffix(data, []byte{0x3B})
+	}
+	return true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encodedPNG returns a PNG encoded 1×1 pixel image
+func encodedPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// insertPNGChunk inserts a chunk of type `typ` after the IHDR chunk of `data`.
+// The CRC is not computed, since it is irrelevant for chunk detection.
+func insertPNGChunk(data []byte, typ string, payload []byte) []byte {
+	ihdrEnd := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(data[len(pngSignature):]))
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk[0:4], uint32(len(payload)))
+	copy(chunk[4:8], typ)
+	chunk = append(chunk, payload...)
+	chunk = append(chunk, 0, 0, 0, 0)
+
+	result := append([]byte{}, data[:ihdrEnd]...)
+	result = append(result, chunk...)
+	return append(result, data[ihdrEnd:]...)
+}
+
+// withPNGText inserts a tEXt chunk with `keyword` and `text` and a valid
+// CRC after the IHDR chunk of `data`, such that it decodes
+func withPNGText(data []byte, keyword, text string) []byte {
+	data = insertPNGChunk(data, "tEXt", []byte(keyword+"\x00"+text))
+	pos := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(data[len(pngSignature):]))
+	end := pos + 8 + len(keyword) + 1 + len(text)
+	binary.BigEndian.PutUint32(data[end:end+4], crc32.ChecksumIEEE(data[pos+4:end]))
+	return data
+}
+
+func TestICCProfileDetection(t *testing.T) {
+	plain := encodedPNG(t)
+	if hasICCProfile(plain, "png") {
+		t.Fatalf("PNG without iCCP chunk must not be reported to embed an ICC profile")
+	}
+	tagged := insertPNGChunk(plain, "iCCP", []byte("profile\x00\x00"))
+	if !hasICCProfile(tagged, "png") {
+		t.Fatalf("PNG with iCCP chunk must be reported to embed an ICC profile")
+	}
+
+	// a length beyond the end of the file, negative as int on 32-bit
+	// platforms, ends the search
+	binary.BigEndian.PutUint32(tagged[len(pngSignature):], 0xFFFFFFF4)
+	if hasICCProfile(tagged, "png") {
+		t.Fatalf("PNG with a truncated chunk before the iCCP chunk must not be searched further")
+	}
+}
+
+func TestEXIFOrientation(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1)), nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+	if o := exifOrientation(plain, "jpeg"); o != 1 {
+		t.Fatalf("JPEG without EXIF data must have orientation 1; got %d", o)
+	}
+
+	// big-endian TIFF header and IFD0 with one orientation entry
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08" +
+		"\x00\x01" + "\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00" +
+		"\x00\x00\x00\x00")
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:4], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	tagged := append([]byte{}, plain[:2]...)
+	tagged = append(tagged, segment...)
+	tagged = append(tagged, plain[2:]...)
+	if o := exifOrientation(tagged, "jpeg"); o != 6 {
+		t.Fatalf("Expected EXIF orientation 6; got %d", o)
+	}
+}
+
+func TestCompletelyEncoded(t *testing.T) {
+	plain := encodedPNG(t)
+	if !completelyEncoded(plain, "png") {
+		t.Fatalf("Complete PNG must be reported as complete")
+	}
+	if completelyEncoded(plain[:len(plain)-12], "png") {
+		t.Fatalf("PNG without IEND chunk must be reported as truncated")
+	}
+	if completelyEncoded(append(append([]byte{}, plain...), 0), "png") {
+		t.Fatalf("PNG with trailing data must be reported")
+	}
+	crafted := append([]byte{}, plain...)
+	binary.BigEndian.PutUint32(crafted[len(pngSignature):], 0xFFFFFFF4)
+	if completelyEncoded(crafted, "png") {
+		t.Fatalf("PNG with a chunk length beyond the end must be reported as truncated")
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !completelyEncoded(buf.Bytes(), "jpeg") || completelyEncoded(buf.Bytes()[:buf.Len()-2], "jpeg") {
+		t.Fatalf("JPEG must be complete if and only if it ends with EOI")
+	}
+}
+
+func TestPNGText(t *testing.T) {
+	if text := pngText(encodedPNG(t), "png"); text != nil {
+		t.Fatalf("Expected no text; got %v", text)
+	}
+	data := withPNGText(withPNGText(encodedPNG(t), "region:header", "0,0,10,2"), "Software", "capture")
+	expected := map[string]string{"region:header": "0,0,10,2", "Software": "capture"}
+	if text := pngText(data, "png"); len(text) != 2 || text["region:header"] != expected["region:header"] || text["Software"] != expected["Software"] {
+		t.Fatalf("Expected %v; got %v", expected, text)
+	}
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	// a chunk length beyond the end of the file stops parsing
+	pos := len(pngSignature) + 12 + int(binary.BigEndian.Uint32(data[len(pngSignature):]))
+	binary.BigEndian.PutUint32(data[pos:pos+4], 0xFFFFFFF0)
+	if text := pngText(data, "png"); text != nil {
+		t.Fatalf("Expected no text of a truncated chunk; got %v", text)
+	}
+	if hasPNGChunk(data, "IEND", "") || completelyEncoded(data, "png") {
+		t.Fatal("Expected the chunks after a truncated chunk to be missing")
+	}
+}
+
+func TestPNGRegions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "png-regions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := solidImage(8, 8, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(8, 8, color.NRGBA{0, 0, 0, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(6, 6, color.NRGBA{255, 255, 255, 255})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, base.i); err != nil {
+		t.Fatal(err)
+	}
+	data := withPNGText(withPNGText(buf.Bytes(), "region:header", "0,0,8,2"), "region:footer", "4,4,4,4")
+	s := newSettings()
+	s.PNGRegions = true
+	s.BaseImg, s.RefImg = filepath.Join(dir, "base.png"), filepath.Join(dir, "ref.png")
+	if err := ioutil.WriteFile(s.BaseImg, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePNG(s.RefImg, ref.i); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := compareFiles(&s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sorted by name
+	if len(diff.pngRegions) != 2 || diff.pngRegions[0].Name != "footer" || diff.pngRegions[0].Percentage <= 0.0 ||
+		diff.pngRegions[1].Name != "header" || diff.pngRegions[1].Percentage != 0.0 {
+		t.Fatalf("Expected a difference in the footer only; got %v", diff.pngRegions)
+	}
+
+	// the reference image defines no regions
+	s.BaseImg, s.RefImg = s.RefImg, s.BaseImg
+	if _, err := compareFiles(&s, nil); err == nil {
+		t.Fatal("Expected an error for a base image without regions")
+	}
+}
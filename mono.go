@@ -0,0 +1,123 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+)
+
+// monoBitmap stores a black-and-white image with one bit per pixel.
+// A set bit represents a white pixel.
+type monoBitmap struct {
+	rows [][]uint64
+}
+
+// toMonoBitmap returns the bitmap of `i` if it is a black-and-white image,
+// i.e. a grayscale image with only 0 and 255 values or a paletted image
+// with opaque black and white colors only. Otherwise it returns nil.
+func toMonoBitmap(i image.Image) *monoBitmap {
+	b := i.Bounds()
+	if b.Min != image.ZP {
+		return nil
+	}
+
+	var white func(x, y int) (bool, bool)
+	switch m := i.(type) {
+	case *image.Gray:
+		white = func(x, y int) (bool, bool) {
+			v := m.Pix[y*m.Stride+x]
+			return v == 255, v == 0 || v == 255
+		}
+	case *image.Paletted:
+		isWhite := make([]bool, len(m.Palette))
+		for n, c := range m.Palette {
+			switch color.NRGBAModel.Convert(c) {
+			case color.NRGBA{0, 0, 0, 255}:
+			case color.NRGBA{255, 255, 255, 255}:
+				isWhite[n] = true
+			default:
+				return nil
+			}
+		}
+		white = func(x, y int) (bool, bool) {
+			n := int(m.Pix[y*m.Stride+x])
+			return n < len(isWhite) && isWhite[n], n < len(isWhite)
+		}
+	default:
+		return nil
+	}
+
+	words := (b.Dx() + 63) / 64
+	bitmap := &monoBitmap{rows: make([][]uint64, b.Dy())}
+	for y := 0; y < b.Dy(); y++ {
+		row := make([]uint64, words)
+		for x := 0; x < b.Dx(); x++ {
+			isWhite, ok := white(x, y)
+			if !ok {
+				return nil
+			}
+			if isWhite {
+				row[x/64] |= 1 << uint(x%64)
+			}
+		}
+		bitmap.rows[y] = row
+	}
+	return bitmap
+}
+
+// popcount returns the number of set bits in `x`
+func popcount(x uint64) int {
+	x -= (x >> 1) & 0x5555555555555555
+	x = (x & 0x3333333333333333) + ((x >> 2) & 0x3333333333333333)
+	x = (x + (x >> 4)) & 0x0f0f0f0f0f0f0f0f
+	return int((x * 0x0101010101010101) >> 56)
+}
+
+// useMonoPath reports whether `baseImg` and `refImg` can be compared
+// by counting differing pixels. In RGB, black and white have distance 1,
+// so the result is identical to the regular comparison. Any setting
+// affecting the comparison other than those listed here must have its
+// default value, hence new options disable the fast path until they
+// are known to be compatible.
+func useMonoPath(s *Settings, baseImg, refImg *img, triage *image.NRGBA) bool {
+	if baseImg.mono == nil || refImg.mono == nil || triage != nil || s.Tolerance >= 1.0 {
+		return false
+	}
+	c, defaults := comparisonSettings(*s), comparisonSettings(newSettings())
+	// black and white exceed every tolerance below 1; the others
+	// only decide which rows are compared or how the result is used
+	c.Tolerance, c.Threshold, c.Deterministic = defaults.Tolerance, defaults.Threshold, defaults.Deterministic
+	c.TwoPass, c.CoarseFactor, c.LimitMemory, c.Settle = defaults.TwoPass, defaults.CoarseFactor, defaults.LimitMemory, defaults.Settle
+	return reflect.DeepEqual(c, defaults)
+}
+
+// compareMonoRow determines the difference of row `y` of two black-and-white
+// images by counting differing bits. `d` is the difference of black and white.
+func compareMonoRow(baseImg, refImg *img, y int, d float64) rowResult {
+	res := rowResult{pixels: baseImg.w}
+	lumaWhite := luma(maxChannel, maxChannel, maxChannel) / maxChannel
+	base, ref := baseImg.mono.rows[y], refImg.mono.rows[y]
+	for n := range base {
+		changed := base[n] ^ ref[n]
+		if changed == 0 {
+			continue
+		}
+		res.cul += d * float64(popcount(changed))
+		res.differing += popcount(changed)
+		res.brighter += lumaWhite * float64(popcount(ref[n]&^base[n]))
+		res.darker += lumaWhite * float64(popcount(base[n]&^ref[n]))
+		for bit := uint(0); bit < 64; bit++ {
+			if changed&(1<<bit) != 0 {
+				x := 64*n + int(bit)
+				res.bounds = res.bounds.Union(image.Rect(x, y, x+1, y+1))
+				res.changed++
+				if res.maxDiff == 0.0 {
+					res.maxDiff, res.maxDiffAt = d, image.Pt(x, y)
+					// black and white differ in every channel
+					res.maxChannelDelta, res.maxChannelAt = maxChannel, image.Pt(x, y)
+				}
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// checkerboard returns a `w`×`h` black-and-white grayscale image
+// with squares of size `size`
+func checkerboard(w, h, size int) *img {
+	i := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x/size+y/size)%2 == 0 {
+				i.Pix[y*i.Stride+x] = 255
+			}
+		}
+	}
+	result := imgFromImage(i)
+	result.mono = toMonoBitmap(i)
+	return result
+}
+
+func TestMonoPath(t *testing.T) {
+	s := newSettings()
+	base, ref := checkerboard(150, 20, 3), checkerboard(150, 20, 5)
+	if base.mono == nil || ref.mono == nil {
+		t.Fatalf("Black-and-white grayscale images must be detected as monochrome")
+	}
+	if !useMonoPath(&s, base, ref, nil) {
+		t.Fatalf("Expected monochrome fast path for black-and-white images")
+	}
+	// only settings known not to affect black and white pixels may differ
+	cli := newSettings()
+	if err := parseArguments(&cli, []string{"--threshold", "5", "--max-workers", "2", "--format", "json", "a.png", "b.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if !useMonoPath(&cli, base, ref, nil) {
+		t.Fatalf("Expected monochrome fast path for output and runtime options")
+	}
+	cli.Weights = [3]float64{2.0, 1.0, 1.0}
+	if useMonoPath(&cli, base, ref, nil) {
+		t.Fatalf("Expected no monochrome fast path for weighted channels")
+	}
+	fast, err := compareImages(&s, base, ref, 0, base.h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base.mono, ref.mono = nil, nil
+	slow, err := compareImages(&s, base, ref, 0, base.h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(fast.score-slow.score) > 1e-9 || !fast.diffBounds.Eq(slow.diffBounds) {
+		t.Fatalf("Monochrome fast path must match regular comparison; got %f %v and %f %v",
+			fast.score, fast.diffBounds, slow.score, slow.diffBounds)
+	}
+	if math.Abs(fast.luminanceDelta-slow.luminanceDelta) > 1e-9 {
+		t.Fatalf("Monochrome fast path must match luminance delta; got %f and %f", fast.luminanceDelta, slow.luminanceDelta)
+	}
+}
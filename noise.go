@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// noiseBlock is the width and height of the blocks whose luma variance
+// estimates the noise
+const noiseBlock = 8
+
+// noisePercentile selects the block variance which represents the noise.
+// Low percentiles pick flat regions, whose variance is noise only.
+const noisePercentile = 0.1
+
+// noiseFactor scales the combined noise of both images to the tolerance,
+// such that nearly all differences caused by noise are tolerated
+const noiseFactor = 2.0
+
+// estimateNoise estimates the standard deviation of the noise of the luma
+// of `i` between 0 and 1 from the variance of its flattest blocks.
+// Images smaller than a block form one block.
+func estimateNoise(i *img) float64 {
+	lumas := lumaValues(i.i)
+	bw, bh := noiseBlock, noiseBlock
+	if i.w < bw {
+		bw = i.w
+	}
+	if i.h < bh {
+		bh = i.h
+	}
+	if bw == 0 || bh == 0 {
+		return 0.0
+	}
+
+	var variances []float64
+	for y0 := 0; y0+bh <= i.h; y0 += bh {
+		for x0 := 0; x0+bw <= i.w; x0 += bw {
+			var sum, squares float64
+			for y := y0; y < y0+bh; y++ {
+				for x := x0; x < x0+bw; x++ {
+					v := lumas[y*i.w+x]
+					sum, squares = sum+v, squares+v*v
+				}
+			}
+			n := float64(bw * bh)
+			mean := sum / n
+			variances = append(variances, math.Max(squares/n-mean*mean, 0.0))
+		}
+	}
+	sort.Float64s(variances)
+	return math.Sqrt(variances[int(noisePercentile*float64(len(variances)-1))])
+}
+
+// autoTolerance returns the tolerance between 0 and 1 which ignores
+// the estimated noise of `baseImg` and `refImg`. Differences of
+// independent noise add up quadratically.
+func autoTolerance(baseImg, refImg *img) float64 {
+	b, r := estimateNoise(baseImg), estimateNoise(refImg)
+	return math.Min(noiseFactor*math.Sqrt(b*b+r*r), 1.0)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// noisyImage returns a gray image of `w`×`h` pixels whose left half is
+// dark and right half is bright with gaussian noise of standard deviation
+// `sigma` between 0 and 1 in every channel
+func noisyImage(rng *rand.Rand, w, h int, sigma float64) *img {
+	i := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 0.25
+			if x >= w/2 {
+				v = 0.75
+			}
+			v = math.Min(math.Max(v+rng.NormFloat64()*sigma, 0.0), 1.0)
+			c := uint8(255 * v)
+			i.SetNRGBA(x, y, color.NRGBA{c, c, c, 255})
+		}
+	}
+	return imgFromImage(i)
+}
+
+func TestEstimateNoise(t *testing.T) {
+	if noise := estimateNoise(solidImage(32, 32, color.NRGBA{128, 128, 128, 255})); noise > 1e-6 {
+		t.Fatalf("Expected no noise in a flat image; got %f", noise)
+	}
+
+	// the edge between both halves does not dominate the estimate
+	rng := rand.New(rand.NewSource(1))
+	noise := estimateNoise(noisyImage(rng, 64, 64, 0.02))
+	if noise < 0.01 || noise > 0.03 {
+		t.Fatalf("Expected noise of about 0.02; got %f", noise)
+	}
+}
+
+func TestAutoTolerance(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	base, ref := noisyImage(rng, 64, 64, 0.02), noisyImage(rng, 64, 64, 0.02)
+
+	s := newSettings()
+	plain, err := comparePrepared(&s, base, ref, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.noiseLevel != nil {
+		t.Fatal("Expected no noise level without --auto-tolerance")
+	}
+
+	s.AutoTolerance = true
+	diff, err := comparePrepared(&s, base, ref, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.noiseLevel == nil || *diff.noiseLevel <= 0.0 {
+		t.Fatalf("Expected a positive noise level; got %v", diff.noiseLevel)
+	}
+	if diff.changed >= plain.changed/10 {
+		t.Fatalf("Expected the noise to be mostly tolerated; %d of %d pixels changed", diff.changed, plain.changed)
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--auto-tolerance", "--tolerance", "0.1", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for --auto-tolerance with --tolerance")
+	}
+}
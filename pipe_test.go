@@ -0,0 +1,84 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writePipe creates a named pipe at `path` and writes `data` to it
+// asynchronously
+func writePipe(t *testing.T, path string, data []byte) {
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		f.Write(data)
+		f.Close()
+	}()
+}
+
+func TestNamedPipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "named-pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := encodedPNG(t)
+
+	var i img
+	complete := filepath.Join(dir, "complete")
+	writePipe(t, complete, data)
+	if err := readImageMetadata(complete, &i); err != nil || i.w != 1 || i.h != 1 {
+		t.Fatalf("Expected a 1×1 image from the named pipe; got %d×%d and error %v", i.w, i.h, err)
+	}
+
+	s := newSettings()
+	partial := filepath.Join(dir, "partial")
+	writePipe(t, partial, data[:len(data)-12])
+	err = readImageMetadata(partial, &i)
+	if _, ok := err.(*pipeError); !ok || errorCode(&s, err) != 102 {
+		t.Fatalf("Expected return code 102 for an incomplete image from a named pipe; got %v", err)
+	}
+}
+
+func TestBatchDecodeTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "decode-timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a named pipe which is never written blocks its reader
+	stalled := filepath.Join(dir, "stalled")
+	if err := syscall.Mkfifo(stalled, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSettings()
+	s.DecodeTimeout = time.Second
+	manifest := stalled + " " + FILES["g"] + "\n" + FILES["g"] + " " + FILES["g"]
+	var out bytes.Buffer
+	code := compareBatch(&s, strings.NewReader(manifest), &out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "error: timed out within 1s (phase: decoding)") {
+		t.Fatalf("Expected the stalled pair to time out; got %q", out.String())
+	}
+	if !strings.HasSuffix(lines[1], "0.000 %") {
+		t.Fatalf("Expected the timeout not to abort the batch; got %q", out.String())
+	}
+	if code != 102 {
+		t.Fatalf("Expected return code 102 for a pair exceeding the decode timeout; got %d", code)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"image"
 	"image/color"
 	"image/png"
+	"io"
 	"math"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,6 +19,10 @@ const WIDTH = 640
 // HEIGHT defines the height of the created image
 const HEIGHT = 400
 
+// montageStride defines the distance of seeds of neighboring montage tiles.
+// Consecutive seeds yield very similar images.
+const montageStride = 104729
+
 func euclideanDistance(x1, y1, x2, y2 int) float64 {
 	return math.Sqrt(math.Pow(float64(x2-x1), 2) + math.Pow(float64(y2-y1), 2))
 }
@@ -32,7 +38,10 @@ func fivePoints(randNum int64) [5][2]int {
 	return result
 }
 
+// drawRandom draws an image based on `randNum` into the WIDTH×HEIGHT
+// rectangle starting at the top-left corner of `img`
 func drawRandom(img *image.RGBA, randNum int64) {
+	min := img.Bounds().Min
 	five := fivePoints(randNum)
 	moreWhite := func(v int64) int64 {
 		return int64((220*v)/256) + 36
@@ -49,7 +58,7 @@ func drawRandom(img *image.RGBA, randNum int64) {
 			b := moreWhite(int64(d3) % 256)
 
 			c := color.RGBA{uint8(r), uint8(g), uint8(b), 255}
-			img.Set(x, y, c)
+			img.Set(min.X+x, min.Y+y, c)
 		}
 	}
 }
@@ -69,29 +78,147 @@ func Draw(filepath string, randNum int64) error {
 	return png.Encode(fd, img)
 }
 
-func main() {
-	var num int64
-	var filepath string
+// quantize replaces every pixel of `img` by the nearest color of `palette`
+func quantize(img *image.RGBA, palette color.Palette) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			img.Set(x, y, palette.Convert(img.At(x, y)))
+		}
+	}
+}
+
+// readPalette parses comma-separated hexadecimal colors like 'FF8000,202020'
+func readPalette(s string) (color.Palette, error) {
+	var palette color.Palette
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimPrefix(strings.TrimSpace(part), "#")
+		val, err := strconv.ParseUint(part, 16, 32)
+		if err != nil || len(part) != 6 {
+			return nil, fmt.Errorf("Expected hexadecimal colors like 'FF8000,202020'; got '%s'", s)
+		}
+		palette = append(palette, color.RGBA{uint8(val >> 16), uint8(val >> 8), uint8(val), 255})
+	}
+	return palette, nil
+}
 
-	switch len(os.Args) {
+// DrawMontage draws `cols`×`rows` images tiled into one image and stores
+// the result at `filepath`. The tiles use the seeds `seed`,
+// `seed+montageStride`, `seed+2*montageStride`, … in row-major order.
+// If `palette` is non-nil, every color is replaced by its nearest color.
+func DrawMontage(filepath string, seed int64, cols, rows int, palette color.Palette) error {
+	img := image.NewRGBA(image.Rect(0, 0, cols*WIDTH, rows*HEIGHT))
+
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			tile := image.Rect(col*WIDTH, row*HEIGHT, (col+1)*WIDTH, (row+1)*HEIGHT)
+			drawRandom(img.SubImage(tile).(*image.RGBA), seed+montageStride*int64(row*cols+col))
+		}
+	}
+	if palette != nil {
+		quantize(img, palette)
+	}
+
+	fd, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return png.Encode(fd, img)
+}
+
+// runFlags runs the CLI for
+// './randimg [--montage <cols>x<rows>] [--seed <integer>] [--palette <RRGGBB,...>] [<output.png>]'
+// and prints the base seed to `w`. Without '--montage', a single image is drawn.
+func runFlags(args []string, w io.Writer) error {
+	cols, rows := 1, 1
+	seed := time.Now().Unix()
+	filepath := "randimg.png"
+	var palette color.Palette
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--montage", "--seed", "--palette":
+			if i+1 == len(args) {
+				return fmt.Errorf("Expected value for '%s'", args[i])
+			}
+			i++
+			if args[i-1] == "--palette" {
+				p, err := readPalette(args[i])
+				if err != nil {
+					return err
+				}
+				palette = p
+				continue
+			}
+			if args[i-1] == "--seed" {
+				n, err := strconv.ParseInt(args[i], 10, 64)
+				if err != nil {
+					return fmt.Errorf("Expected integer as seed; got '%s'", args[i])
+				}
+				seed = n
+				continue
+			}
+			dims := strings.Split(strings.ToLower(args[i]), "x")
+			if len(dims) != 2 {
+				return fmt.Errorf("Expected montage dimensions like '3x2'; got '%s'", args[i])
+			}
+			c, errC := strconv.Atoi(dims[0])
+			r, errR := strconv.Atoi(dims[1])
+			if errC != nil || errR != nil || c < 1 || r < 1 {
+				return fmt.Errorf("Expected positive montage dimensions like '3x2'; got '%s'", args[i])
+			}
+			cols, rows = c, r
+		default:
+			filepath = args[i]
+		}
+	}
+
+	fmt.Fprintf(w, "Using base seed: %d\n", seed)
+	return DrawMontage(filepath, seed, cols, rows, palette)
+}
+
+// single runs the CLI for './randimg [<integer>] [<output.png>]' and
+// prints the effective seed to `w`, such that the image can be drawn
+// again. Without integer, the current time is the seed.
+func single(args []string, w io.Writer) error {
+	num := time.Now().Unix()
+	filepath := "randimg.png"
+
+	switch len(args) {
+	case 0:
 	case 1:
-		num = time.Now().Unix()
-		fmt.Printf("Using current time as random seed: %d\n", num)
+		// either the seed or the output path
+		if n, err := strconv.ParseInt(args[0], 10, 64); err == nil {
+			num = n
+		} else {
+			filepath = args[0]
+		}
 	case 2:
-		filepath = "randimg.png"
-		fallthrough
-	case 3:
-		n, err := strconv.Atoi(os.Args[1])
+		n, err := strconv.ParseInt(args[0], 10, 64)
 		if err != nil {
-			panic(fmt.Errorf("Expected integer as positional argument; got '%s'", os.Args[2]))
+			return fmt.Errorf("Expected integer as positional argument; got '%s'", args[0])
 		}
-		num = int64(n)
-		filepath = os.Args[2]
+		num = n
+		filepath = args[1]
 	default:
-		panic(fmt.Errorf("Unknown arguments; ./randimg <integer> <output.png>"))
+		return fmt.Errorf("Unknown arguments; ./randimg [<integer>] [<output.png>]")
+	}
+
+	fmt.Fprintf(w, "Using random seed: %d\n", num)
+	return Draw(filepath, num)
+}
+
+func main() {
+	if len(os.Args) > 1 && strings.HasPrefix(os.Args[1], "--") {
+		if err := runFlags(os.Args[1:], os.Stdout); err != nil {
+			panic(err)
+		}
+		return
 	}
 
-	if err := Draw(filepath, num); err != nil {
+	if err := single(os.Args[1:], os.Stdout); err != nil {
 		panic(err)
 	}
 }
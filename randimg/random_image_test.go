@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrintedSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "randimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the seed is printed for an explicit seed and for the current time
+	for _, args := range [][]string{{"42", "explicit.png"}, {"implicit.png"}} {
+		out := filepath.Join(dir, args[len(args)-1])
+		args[len(args)-1] = out
+		var printed bytes.Buffer
+		if err := single(args, &printed); err != nil {
+			t.Fatal(err)
+		}
+		var seed int64
+		if _, err := fmt.Sscanf(printed.String(), "Using random seed: %d\n", &seed); err != nil {
+			t.Fatalf("Expected the seed to be printed; got '%s'", printed.String())
+		}
+		if len(args) == 2 && seed != 42 {
+			t.Fatalf("Expected seed 42; got %d", seed)
+		}
+
+		// the printed seed reproduces the image
+		again := filepath.Join(dir, "again.png")
+		if err := Draw(again, seed); err != nil {
+			t.Fatal(err)
+		}
+		a, errA := ioutil.ReadFile(out)
+		b, errB := ioutil.ReadFile(again)
+		if errA != nil || errB != nil {
+			t.Fatal(errA, errB)
+		}
+		if !bytes.Equal(a, b) {
+			t.Fatalf("Expected seed %d to reproduce %s", seed, out)
+		}
+	}
+
+	if err := single([]string{"x", "out.png"}, ioutil.Discard); err == nil {
+		t.Fatal("Expected an error for a non-integer seed")
+	}
+}
+
+func TestMontage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "randimg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "montage.png")
+	var printed bytes.Buffer
+	if err := runFlags([]string{"--montage", "2x1", "--seed", "42", out}, &printed); err != nil {
+		t.Fatal(err)
+	}
+	if printed.String() != "Using base seed: 42\n" {
+		t.Fatalf("Expected the base seed to be printed; got '%s'", printed.String())
+	}
+	fd, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	montage, err := png.Decode(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tiles are the images of the seeds in steps of montageStride
+	expected := image.NewRGBA(image.Rect(0, 0, 2*WIDTH, HEIGHT))
+	drawRandom(expected, 42)
+	drawRandom(expected.SubImage(image.Rect(WIDTH, 0, 2*WIDTH, HEIGHT)).(*image.RGBA), 42+montageStride)
+	if montage.Bounds() != expected.Bounds() {
+		t.Fatalf("Expected a %v montage; got %v", expected.Bounds(), montage.Bounds())
+	}
+	for y := 0; y < HEIGHT; y++ {
+		for x := 0; x < 2*WIDTH; x++ {
+			if r, g, b, _ := montage.At(x, y).RGBA(); expected.At(x, y) != (color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}) {
+				t.Fatalf("Expected %v at (%d, %d); got %v", expected.At(x, y), x, y, montage.At(x, y))
+			}
+		}
+	}
+
+	for _, args := range [][]string{{"--montage", "0x1"}, {"--montage", "2"}, {"--seed", "x"}, {"--seed"}} {
+		if err := runFlags(args, ioutil.Discard); err == nil {
+			t.Fatalf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestReadPalette(t *testing.T) {
+	palette, err := readPalette("FF8000, #202020")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := color.Palette{color.RGBA{255, 128, 0, 255}, color.RGBA{32, 32, 32, 255}}
+	if len(palette) != len(expected) || palette[0] != expected[0] || palette[1] != expected[1] {
+		t.Fatalf("Expected %v; got %v", expected, palette)
+	}
+	for _, s := range []string{"", "FF80", "FF8000,", "GG8000", "FF800000"} {
+		if _, err := readPalette(s); err == nil {
+			t.Fatalf("Expected an error for '%s'", s)
+		}
+	}
+}
+
+func TestQuantize(t *testing.T) {
+	palette := color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}}
+	i := image.NewRGBA(image.Rect(0, 0, WIDTH, HEIGHT))
+	drawRandom(i, 42)
+	quantize(i, palette)
+	seen := make(map[color.Color]bool)
+	for y := 0; y < HEIGHT; y++ {
+		for x := 0; x < WIDTH; x++ {
+			seen[i.At(x, y)] = true
+		}
+	}
+	if len(seen) != 2 || !seen[palette[0]] || !seen[palette[1]] {
+		t.Fatalf("Expected only and both colors of the palette; got %v", seen)
+	}
+
+	// every pixel becomes its nearest color
+	dark := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	dark.Set(0, 0, color.RGBA{40, 40, 40, 255})
+	dark.Set(1, 0, color.RGBA{200, 200, 200, 255})
+	quantize(dark, palette)
+	if dark.At(0, 0) != palette[0] || dark.At(1, 0) != palette[1] {
+		t.Fatalf("Expected black and white; got %v and %v", dark.At(0, 0), dark.At(1, 0))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// diffMask stores the weighted difference, the --center-weight, the
+// weighted luma delta and the largest channel difference of every pixel
+// for an analysis after the comparison
+type diffMask struct {
+	w            int
+	h            int
+	dist         []float64
+	weight       []float64
+	delta        []float64
+	channelDelta []float64
+	channel      []int
+}
+
+// newDiffMask returns an empty mask of `w` × `h` pixels
+func newDiffMask(w, h int) *diffMask {
+	return &diffMask{
+		w:            w,
+		h:            h,
+		dist:         make([]float64, w*h),
+		weight:       make([]float64, w*h),
+		delta:        make([]float64, w*h),
+		channelDelta: make([]float64, w*h),
+		channel:      make([]int, w*h),
+	}
+}
+
+// set stores the result `px` of pixel (x,y) and its weight `weight`
+// in the cumulative difference
+func (m *diffMask) set(x, y int, px pixelResult, weight float64) {
+	i := y*m.w + x
+	m.dist[i] = px.d
+	m.weight[i] = weight
+	m.delta[i] = px.delta
+	m.channelDelta[i], m.channel[i] = px.channelDelta, px.channel
+}
+
+// suppressSmallRegions removes all 8-connected regions of changed pixels
+// with less than MinRegionSize pixels from `sum`. The triage colors of
+// suppressed pixels are set to tolerated and they are cleared in the
+// `changedMask`. Suppressed pixels count as identical, hence their
+// --center-weight remains in the sum of weights and the maximum
+// differences and the --tolerance-sweep are determined without them.
+// It returns the number of suppressed regions.
+func suppressSmallRegions(s *Settings, m *diffMask, sum *rowResult, triage *image.NRGBA, changedMask *image.Gray) int {
+	visited := make([]bool, len(m.dist))
+	var bounds image.Rectangle
+	suppressed, changed := 0, 0
+	var region, stack []int
+
+	for start := range m.dist {
+		if visited[start] || m.dist[start] <= s.Tolerance {
+			continue
+		}
+
+		// flood fill
+		region = region[:0]
+		stack = append(stack[:0], start)
+		visited[start] = true
+		for len(stack) > 0 {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			region = append(region, i)
+			x, y := i%m.w, i/m.w
+			for ny := y - 1; ny <= y+1; ny++ {
+				for nx := x - 1; nx <= x+1; nx++ {
+					if nx < 0 || ny < 0 || nx >= m.w || ny >= m.h {
+						continue
+					}
+					n := ny*m.w + nx
+					if !visited[n] && m.dist[n] > s.Tolerance {
+						visited[n] = true
+						stack = append(stack, n)
+					}
+				}
+			}
+		}
+
+		if len(region) >= s.MinRegionSize {
+			changed += len(region)
+			for _, i := range region {
+				x, y := i%m.w, i/m.w
+				bounds = bounds.Union(image.Rect(x, y, x+1, y+1))
+			}
+			continue
+		}
+
+		suppressed++
+		for _, i := range region {
+			sum.cul -= m.weight[i] * m.dist[i]
+			if m.delta[i] > 0 {
+				sum.brighter -= m.delta[i]
+			} else {
+				sum.darker += m.delta[i]
+			}
+			if sum.sweep != nil {
+				sum.sweep[sweepBin(s.ToleranceSweep, m.dist[i])]--
+				sum.sweep[0]++
+			}
+			m.dist[i], m.channelDelta[i] = 0.0, 0.0
+			if triage != nil {
+				triage.SetNRGBA(i%m.w, i/m.w, triageTolerated)
+			}
+			if changedMask != nil {
+				changedMask.SetGray(i%m.w, i/m.w, color.Gray{0})
+			}
+		}
+	}
+
+	// avoid negative rounding errors
+	sum.cul = math.Max(sum.cul, 0.0)
+	sum.brighter = math.Max(sum.brighter, 0.0)
+	sum.darker = math.Max(sum.darker, 0.0)
+	sum.bounds = bounds
+	sum.changed = changed
+	if suppressed > 0 {
+		// the first maximum in row-major order like compareRow
+		sum.maxDiff, sum.maxDiffAt = 0.0, image.ZP
+		sum.maxChannelDelta, sum.maxChannel, sum.maxChannelAt = 0.0, 0, image.ZP
+		for i, d := range m.dist {
+			if d > sum.maxDiff {
+				sum.maxDiff, sum.maxDiffAt = d, image.Pt(i%m.w, i/m.w)
+			}
+			if m.channelDelta[i] > sum.maxChannelDelta {
+				sum.maxChannelDelta, sum.maxChannel, sum.maxChannelAt = m.channelDelta[i], m.channel[i], image.Pt(i%m.w, i/m.w)
+			}
+		}
+	}
+	return suppressed
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+)
+
+// svgThumbnailWidth is the maximum width of the thumbnails in a SVG report
+const svgThumbnailWidth = 320
+
+// jsonRegion represents an image.Rectangle in JSON output
+type jsonRegion struct {
+	MinX int `json:"min_x"`
+	MinY int `json:"min_y"`
+	MaxX int `json:"max_x"`
+	MaxY int `json:"max_y"`
+}
+
+// jsonSweepLevel represents a level of the tolerance sweep in JSON output
+type jsonSweepLevel struct {
+	Tolerance  float64 `json:"tolerance"`
+	Percentage float64 `json:"percentage"`
+}
+
+// jsonScaleLevel represents the difference at a render scale in JSON output
+type jsonScaleLevel struct {
+	Factor     int     `json:"factor"`
+	Percentage float64 `json:"percentage"`
+}
+
+// jsonQuadrantLevel represents the difference of a quadrant in JSON output
+type jsonQuadrantLevel struct {
+	Name       string  `json:"name"`
+	Percentage float64 `json:"percentage"`
+}
+
+// jsonRegionLevel represents the difference of a named region in JSON output
+type jsonRegionLevel struct {
+	Name       string  `json:"name"`
+	Percentage float64 `json:"percentage"`
+}
+
+// jsonShift represents the shift of the reference image or a position
+// in JSON output
+type jsonShift struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// jsonChannelDelta represents the largest difference of a color channel
+// in JSON output
+type jsonChannelDelta struct {
+	Value   int    `json:"value"`
+	Channel string `json:"channel"`
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+}
+
+// newJSONChannelDelta converts `d` to JSON or returns nil if `d` is nil
+func newJSONChannelDelta(d *channelDelta) *jsonChannelDelta {
+	if d == nil {
+		return nil
+	}
+	return &jsonChannelDelta{d.Value, d.Channel, d.At.X, d.At.Y}
+}
+
+// jsonArtifacts represents the estimated share of JPEG block artifacts
+// in JSON output
+type jsonArtifacts struct {
+	Percentage float64 `json:"percentage"`
+	Blockiness float64 `json:"blockiness"`
+}
+
+// newJSONArtifacts converts `a` to JSON or returns nil if `a` is nil
+func newJSONArtifacts(a *artifactEstimate) *jsonArtifacts {
+	if a == nil {
+		return nil
+	}
+	return &jsonArtifacts{a.Percentage, a.Blockiness}
+}
+
+// jsonJND represents the CIEDE2000 differences in just noticeable
+// differences in JSON output
+type jsonJND struct {
+	Mean   float64 `json:"mean_delta_e"`
+	Above1 float64 `json:"above_1_jnd"`
+	Above2 float64 `json:"above_2_jnd"`
+}
+
+// newJSONJND converts `j` to JSON or returns nil if `j` is nil
+func newJSONJND(j *jndExceedance) *jsonJND {
+	if j == nil {
+		return nil
+	}
+	return &jsonJND{j.Mean, j.Above1, j.Above2}
+}
+
+// jsonTimings represents the durations of the phases in JSON output
+type jsonTimings struct {
+	DecodingSeconds      float64 `json:"decoding_seconds"`
+	PreprocessingSeconds float64 `json:"preprocessing_seconds"`
+	ComparisonSeconds    float64 `json:"comparison_seconds"`
+}
+
+// newJSONTimings converts `t` to JSON or returns nil if `t` is nil
+func newJSONTimings(t *timings) *jsonTimings {
+	if t == nil {
+		return nil
+	}
+	return &jsonTimings{t.Decoding.Seconds(), t.Preprocessing.Seconds(), t.Comparison.Seconds()}
+}
+
+// jsonResult represents the result of a single comparison in JSON output
+type jsonResult struct {
+	Percentage        float64             `json:"percentage"`
+	Score             float64             `json:"score"`
+	Identical         bool                `json:"identical"`
+	ChangedRegion     *jsonRegion         `json:"changed_region"`
+	LuminanceDelta    float64             `json:"luminance_delta"`
+	LuminanceSummary  string              `json:"luminance_summary,omitempty"`
+	Pass              string              `json:"pass,omitempty"`
+	Intersection      int                 `json:"opaque_intersection,omitempty"`
+	SuppressedRegions int                 `json:"suppressed_regions,omitempty"`
+	ToleranceSweep    []jsonSweepLevel    `json:"tolerance_sweep,omitempty"`
+	RenderScales      []jsonScaleLevel    `json:"render_scales,omitempty"`
+	Quadrants         []jsonQuadrantLevel `json:"quadrants,omitempty"`
+	PNGRegions        []jsonRegionLevel   `json:"png_regions,omitempty"`
+	AdaptiveFactor    int                 `json:"adaptive_factor,omitempty"`
+	Shift             *jsonShift          `json:"shift,omitempty"`
+	EstimatedShift    *jsonShift          `json:"estimated_shift,omitempty"`
+	Sampled           int                 `json:"sampled_pixels,omitempty"`
+	Confidence        float64             `json:"confidence_95,omitempty"`
+	References        int                 `json:"averaged_references,omitempty"`
+	MSSSIM            *float64            `json:"ms_ssim,omitempty"`
+	JND               *jsonJND            `json:"delta_e_2000,omitempty"`
+	NoiseLevel        *float64            `json:"noise_level,omitempty"`
+	RawScore          *float64            `json:"raw_score,omitempty"`
+	MaxChannelDelta   *jsonChannelDelta   `json:"max_channel_delta,omitempty"`
+	Artifacts         *jsonArtifacts      `json:"compression_artifacts,omitempty"`
+	Timings           *jsonTimings        `json:"timings,omitempty"`
+	RuntimeSeconds    float64             `json:"runtime_seconds"`
+	SnapshotDiff      string              `json:"snapshot_diff,omitempty"`
+	Stopped           string              `json:"stopped,omitempty"`
+	PartialPixels     int                 `json:"partial_pixels,omitempty"`
+	ExitCode          int                 `json:"exit_code"`
+	Verdict           string              `json:"verdict,omitempty"`
+	ExitCodeMeaning   string              `json:"exit_code_meaning"`
+}
+
+// newJSONRegion returns nil for an empty rectangle `r`
+func newJSONRegion(r image.Rectangle) *jsonRegion {
+	if r.Empty() {
+		return nil
+	}
+	return &jsonRegion{r.Min.X, r.Min.Y, r.Max.X, r.Max.Y}
+}
+
+// newJSONShift returns nil if no shift `p` was determined
+func newJSONShift(p *image.Point) *jsonShift {
+	if p == nil {
+		return nil
+	}
+	return &jsonShift{p.X, p.Y}
+}
+
+// newJSONSweep converts the levels of a tolerance sweep
+func newJSONSweep(levels []sweepLevel) []jsonSweepLevel {
+	var result []jsonSweepLevel
+	for _, l := range levels {
+		result = append(result, jsonSweepLevel{l.Tolerance, l.Percentage})
+	}
+	return result
+}
+
+// newJSONScales converts the levels of a render scale comparison
+func newJSONScales(levels []scaleLevel) []jsonScaleLevel {
+	var result []jsonScaleLevel
+	for _, l := range levels {
+		result = append(result, jsonScaleLevel{l.Factor, l.Percentage})
+	}
+	return result
+}
+
+// newJSONRegions converts the differences of the named regions
+func newJSONRegions(levels []regionLevel) []jsonRegionLevel {
+	var result []jsonRegionLevel
+	for _, l := range levels {
+		result = append(result, jsonRegionLevel{l.Name, l.Percentage})
+	}
+	return result
+}
+
+// newJSONQuadrants converts the differences of the quadrants
+func newJSONQuadrants(levels []quadrantLevel) []jsonQuadrantLevel {
+	var result []jsonQuadrantLevel
+	for _, l := range levels {
+		result = append(result, jsonQuadrantLevel{l.Name, l.Percentage})
+	}
+	return result
+}
+
+// errorMeaning describes the failed comparison `err` for JSON consumers
+func errorMeaning(err error) string {
+	switch e := err.(type) {
+	case *stopError:
+		if e.code == 130 {
+			return "interrupted"
+		}
+		return "timeout"
+	case *loadError, *pipeError:
+		return "load-error"
+	}
+	return "invalid-args"
+}
+
+// resultMeaning describes `res` for JSON consumers. Unlike the return
+// code, it is unaffected by --warn-only and --load-error-code.
+func resultMeaning(res result) string {
+	switch {
+	case res.Stopped != nil:
+		return errorMeaning(res.Stopped)
+	case res.Verdict != "" && res.Percentage > res.Threshold:
+		return "different"
+	case res.Verdict != "":
+		return "too-similar"
+	case res.Identical:
+		return "identical"
+	case res.Percentage > res.Threshold:
+		return "difference"
+	}
+	return "within-threshold"
+}
+
+// writeJSONResult writes `res` as a single JSON object terminated by a newline to `w`
+func writeJSONResult(w io.Writer, res result, snapshotDiff string, code int) error {
+	var stopped string
+	if res.Stopped != nil {
+		stopped = res.Stopped.Error()
+	}
+	return json.NewEncoder(w).Encode(jsonResult{
+		Percentage:        res.Percentage,
+		Score:             res.Score,
+		ChangedRegion:     newJSONRegion(res.ChangedRegion),
+		LuminanceDelta:    res.LuminanceDelta,
+		LuminanceSummary:  res.LuminanceSummary,
+		Pass:              res.Pass,
+		Intersection:      res.Intersection,
+		SuppressedRegions: res.SuppressedRegions,
+		ToleranceSweep:    newJSONSweep(res.ToleranceSweep),
+		RenderScales:      newJSONScales(res.RenderScales),
+		Quadrants:         newJSONQuadrants(res.Quadrants),
+		PNGRegions:        newJSONRegions(res.PNGRegions),
+		AdaptiveFactor:    res.AdaptiveFactor,
+		Shift:             newJSONShift(res.Shift),
+		EstimatedShift:    newJSONShift(res.EstimatedShift),
+		Sampled:           res.Sampled,
+		Confidence:        res.Confidence,
+		References:        res.References,
+		MSSSIM:            res.MSSSIM,
+		JND:               newJSONJND(res.JND),
+		NoiseLevel:        res.NoiseLevel,
+		RawScore:          res.RawScore,
+		MaxChannelDelta:   newJSONChannelDelta(res.MaxChannelDelta),
+		Artifacts:         newJSONArtifacts(res.Artifacts),
+		Timings:           newJSONTimings(res.Timings),
+		RuntimeSeconds:    res.Runtime.Seconds(),
+		SnapshotDiff:      snapshotDiff,
+		Stopped:           stopped,
+		PartialPixels:     res.Partial,
+		ExitCode:          code,
+		Verdict:           res.Verdict,
+		ExitCodeMeaning:   resultMeaning(res),
+	})
+}
+
+// xmlProperty is a named value of a test case in XML output
+type xmlProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// xmlFailure marks a test case exceeding the threshold in XML output
+type xmlFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+// xmlTestCase represents a single comparison in XML output
+type xmlTestCase struct {
+	Name       string        `xml:"name,attr"`
+	ClassName  string        `xml:"classname,attr"`
+	Time       float64       `xml:"time,attr"`
+	Properties []xmlProperty `xml:"properties>property"`
+	Failure    *xmlFailure   `xml:"failure,omitempty"`
+}
+
+// xmlTestSuite is the JUnit-like root element of XML output
+type xmlTestSuite struct {
+	XMLName   xml.Name      `xml:"testsuite"`
+	Name      string        `xml:"name,attr"`
+	Tests     int           `xml:"tests,attr"`
+	Failures  int           `xml:"failures,attr"`
+	Time      float64       `xml:"time,attr"`
+	TestCases []xmlTestCase `xml:"testcase"`
+}
+
+// writeXMLResult writes `res` of the comparison called `name` as JUnit-like
+// test suite with a single test case to `w`. The test case fails if the
+// difference percentage exceeds `threshold`.
+func writeXMLResult(w io.Writer, res result, name string, threshold float64, snapshotDiff string, code int) error {
+	percent := strconv.FormatFloat(res.Percentage, 'g', -1, 64)
+	tc := xmlTestCase{
+		Name:      name,
+		ClassName: "screenshot-compare",
+		Time:      res.Runtime.Seconds(),
+		Properties: []xmlProperty{
+			{"percentage", percent},
+			{"score", strconv.FormatFloat(res.Score, 'g', -1, 64)},
+			{"identical", strconv.FormatBool(res.Identical)},
+			{"exit_code", strconv.Itoa(code)},
+			{"exit_code_meaning", resultMeaning(res)},
+		},
+	}
+	if r := res.ChangedRegion; !r.Empty() {
+		region := fmt.Sprintf("%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+		tc.Properties = append(tc.Properties, xmlProperty{"changed_region", region})
+	}
+	if snapshotDiff != "" {
+		tc.Properties = append(tc.Properties, xmlProperty{"snapshot_diff", snapshotDiff})
+	}
+	suite := xmlTestSuite{Name: "screenshot-compare", Tests: 1, Time: tc.Time}
+	if res.Partial > 0 {
+		tc.Properties = append(tc.Properties, xmlProperty{"partial_pixels", strconv.Itoa(res.Partial)})
+	}
+	if res.Stopped != nil {
+		tc.Failure = &xmlFailure{res.Stopped.Error(), errorMeaning(res.Stopped)}
+		suite.Failures = 1
+	} else if res.Verdict == "" && res.Percentage > threshold {
+		msg := fmt.Sprintf("difference percentage %s %% exceeds threshold of %g %%", percent, threshold)
+		tc.Failure = &xmlFailure{msg, "difference"}
+		suite.Failures = 1
+	} else if res.Verdict != "" && res.Percentage <= threshold {
+		msg := fmt.Sprintf("difference percentage %s %% does not exceed threshold of %g %%", percent, threshold)
+		tc.Failure = &xmlFailure{msg, "too-similar"}
+		suite.Failures = 1
+	}
+	suite.TestCases = []xmlTestCase{tc}
+
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// jsonStats represents the statistics of a comparison in a sidecar file
+type jsonStats struct {
+	Percentage    float64     `json:"percentage"`
+	ChangedPixels int         `json:"changed_pixels"`
+	ChangedRegion *jsonRegion `json:"changed_region"`
+	MaxDifference float64     `json:"max_difference"`
+	MaxDiffAt     *jsonShift  `json:"max_difference_at"`
+}
+
+// writeStats stores the statistics of `diff` as JSON object at `path`
+func writeStats(path string, diff difference) error {
+	stats := jsonStats{
+		Percentage:    diff.percentage(),
+		ChangedPixels: diff.changed,
+		ChangedRegion: newJSONRegion(diff.diffBounds),
+		MaxDifference: diff.maxDiff,
+	}
+	if diff.maxDiff > 0.0 {
+		stats.MaxDiffAt = &jsonShift{diff.maxDiffAt.X, diff.maxDiffAt.Y}
+	}
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// writeResultFile atomically stores the difference percentage `percent`
+// and the return code `code` at `path` by renaming a synced temporary file
+func writeResultFile(path string, percent float64, code int) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	line := strconv.FormatFloat(percent, 'g', -1, 64) + " " + strconv.Itoa(code) + "\n"
+	if _, err := tmp.WriteString(line); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// pngDataURI encodes `i` as PNG data URI
+func pngDataURI(i image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, i); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// writeSVGReport stores a self-contained SVG image at `path` showing
+// thumbnails of `baseImg` and `refImg` side by side captioned with
+// `names`, the changed region as overlay and the difference percentage
+func writeSVGReport(path string, baseImg, refImg *img, names [2]string, diff difference) error {
+	factor := (baseImg.w + svgThumbnailWidth - 1) / svgThumbnailWidth
+	if factor < 1 {
+		factor = 1
+	}
+	thumbs := [2]image.Image{baseImg.i, refImg.i}
+	var uris [2]string
+	for n, thumb := range thumbs {
+		if factor > 1 {
+			thumb = downscale(thumb, factor)
+		}
+		uri, err := pngDataURI(thumb)
+		if err != nil {
+			return err
+		}
+		uris[n] = uri
+	}
+
+	w, h := (baseImg.w+factor-1)/factor, (baseImg.h+factor-1)/factor
+	const gap, caption = 10, 40
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+"\n", 3*gap+2*w, 2*gap+h+caption)
+	fmt.Fprintf(&buf, `<text x="%d" y="%d" font-family="sans-serif" font-size="16">difference percentage: %.3f %%</text>`+"\n",
+		gap, gap+16, diff.percentage())
+	for n := range uris {
+		x := gap + n*(w+gap)
+		fmt.Fprintf(&buf, `<text x="%d" y="%d" font-family="sans-serif" font-size="12">%s</text>`+"\n",
+			x, gap+34, template.HTMLEscapeString(names[n]))
+		fmt.Fprintf(&buf, `<image x="%d" y="%d" width="%d" height="%d" href="%s"/>`+"\n", x, gap+caption, w, h, uris[n])
+		if r := diff.diffBounds; !r.Empty() {
+			fmt.Fprintf(&buf, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="none" stroke="red" stroke-width="2"/>`+"\n",
+				float64(x)+float64(r.Min.X)/float64(factor), float64(gap+caption)+float64(r.Min.Y)/float64(factor),
+				float64(r.Dx())/float64(factor), float64(r.Dy())/float64(factor))
+		}
+	}
+	buf.WriteString("</svg>\n")
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestJSONResult(t *testing.T) {
+	var out bytes.Buffer
+	res := result{Percentage: 12.5, Score: 0.125, ChangedRegion: image.Rect(1, 2, 3, 4)}
+	if err := writeJSONResult(&out, res, "", 12); err != nil {
+		t.Fatal(err)
+	}
+	var decoded jsonResult
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ChangedRegion == nil || *decoded.ChangedRegion != (jsonRegion{1, 2, 3, 4}) || decoded.ExitCode != 12 ||
+		decoded.ExitCodeMeaning != "difference" {
+		t.Fatalf("Unexpected JSON result '%s'", out.String())
+	}
+
+	out.Reset()
+	if err := writeJSONResult(&out, result{}, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"changed_region":null`) {
+		t.Fatalf("Expected null for an empty changed region; got '%s'", out.String())
+	}
+}
+
+func TestTimings(t *testing.T) {
+	res := result{Timings: &timings{Decoding: 2 * time.Second, Preprocessing: time.Second, Comparison: 500 * time.Millisecond}}
+	var out bytes.Buffer
+	if err := writeJSONResult(&out, res, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"timings":{"decoding_seconds":2,"preprocessing_seconds":1,"comparison_seconds":0.5}`) {
+		t.Fatalf("Expected the timings in the JSON result; got '%s'", out.String())
+	}
+
+	out.Reset()
+	tmpl := template.Must(template.New("result").Parse(TEMPLATE))
+	if err := tmpl.Execute(&out, res); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "timings:                decoding 2s, preprocessing 1s, comparison 500ms\n") {
+		t.Fatalf("Expected the timings in the text result; got '%s'", out.String())
+	}
+	out.Reset()
+	if err := tmpl.Execute(&out, result{}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "timings") {
+		t.Fatalf("Expected no timings by default; got '%s'", out.String())
+	}
+}
+
+func TestXMLResult(t *testing.T) {
+	var out bytes.Buffer
+	res := result{Percentage: 12.5, Score: 0.125, ChangedRegion: image.Rect(1, 2, 3, 4)}
+	if err := writeXMLResult(&out, res, "a.png vs b.png", 10.0, "", 12); err != nil {
+		t.Fatal(err)
+	}
+	var suite xmlTestSuite
+	if err := xml.Unmarshal(out.Bytes(), &suite); err != nil {
+		t.Fatal(err)
+	}
+	if suite.Tests != 1 || suite.Failures != 1 || len(suite.TestCases) != 1 || suite.TestCases[0].Failure == nil {
+		t.Fatalf("Expected a failed test case above the threshold; got '%s'", out.String())
+	}
+	tc := suite.TestCases[0]
+	if tc.Name != "a.png vs b.png" || tc.Properties[0] != (xmlProperty{"percentage", "12.5"}) {
+		t.Fatalf("Unexpected test case '%s'", out.String())
+	}
+
+	out.Reset()
+	if err := writeXMLResult(&out, res, "a.png vs b.png", 20.0, "", 12); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "<failure") {
+		t.Fatalf("Expected no failure within the threshold; got '%s'", out.String())
+	}
+
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--format", "xml", "--batch", "manifest.txt"}); err == nil {
+		t.Fatal("Expected an error for XML output in batch mode")
+	}
+}
+
+func TestExpectDifferentResult(t *testing.T) {
+	res := result{Percentage: 0.5, Threshold: 1.0, Verdict: "FAILED"}
+	var out bytes.Buffer
+	if err := writeJSONResult(&out, res, "", 103); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"exit_code_meaning":"too-similar"`) {
+		t.Fatalf("Expected the inverted meaning in the JSON result; got '%s'", out.String())
+	}
+
+	out.Reset()
+	if err := writeXMLResult(&out, res, "a.png vs b.png", 1.0, "", 103); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `type="too-similar"`) {
+		t.Fatalf("Expected a failure within the threshold; got '%s'", out.String())
+	}
+	out.Reset()
+	res.Percentage = 5.0
+	if err := writeXMLResult(&out, res, "a.png vs b.png", 1.0, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "<failure") {
+		t.Fatalf("Expected no failure above the threshold; got '%s'", out.String())
+	}
+}
+
+func TestResultMeaning(t *testing.T) {
+	expected := map[string]result{
+		"identical":        {Identical: true},
+		"difference":       {Percentage: 0.5},
+		"within-threshold": {Percentage: 0.5, Threshold: 1.0},
+		"different":        {Percentage: 5.0, Threshold: 1.0, Verdict: "passed"},
+		"too-similar":      {Percentage: 0.5, Threshold: 1.0, Verdict: "FAILED"},
+	}
+	for meaning, res := range expected {
+		if got := resultMeaning(res); got != meaning {
+			t.Fatalf("Expected meaning '%s' of %+v; got '%s'", meaning, res, got)
+		}
+	}
+
+	errors := map[string]error{
+		"invalid-args": fmt.Errorf("the dimensions differ"),
+		"load-error":   &loadError{"a.png", fmt.Errorf("not found")},
+		"timeout":      &stopError{102, time.Second, "decoding"},
+		"interrupted":  &stopError{130, 0, "comparing"},
+	}
+	for meaning, err := range errors {
+		if got := errorMeaning(err); got != meaning {
+			t.Fatalf("Expected meaning '%s' of error '%s'; got '%s'", meaning, err, got)
+		}
+	}
+
+	// below 1 % the return code is 0 nonetheless
+	var out bytes.Buffer
+	if err := writeJSONResult(&out, result{Percentage: 0.5}, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"exit_code":0,"exit_code_meaning":"difference"`) {
+		t.Fatalf("Expected the meaning to follow the result; got '%s'", out.String())
+	}
+	out.Reset()
+	if err := writeJSONResult(&out, result{Percentage: 0.5, Threshold: 1.0, Verdict: "FAILED"}, "", 103); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"verdict":"FAILED","exit_code_meaning":"too-similar"`) {
+		t.Fatalf("Expected the meaning of --expect-different; got '%s'", out.String())
+	}
+}
+
+func TestSVGReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svg-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := solidImage(1000, 10, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(1000, 10, color.NRGBA{255, 255, 255, 255})
+	diff := newDifference()
+	diff.diffBounds = image.Rect(0, 0, 1000, 10)
+	path := filepath.Join(dir, "report.svg")
+	if err := writeSVGReport(path, base, ref, [2]string{"base: <a>", "reference: b"}, diff); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := string(data)
+	if strings.Count(svg, "data:image/png;base64,") != 2 {
+		t.Fatalf("Expected two embedded thumbnails; got '%s'", svg)
+	}
+	if !strings.Contains(svg, `width="250" height="3"`) {
+		t.Fatalf("Expected thumbnails downscaled by 4; got '%s'", svg)
+	}
+	if !strings.Contains(svg, "base: &lt;a&gt;") || !strings.Contains(svg, "<rect") {
+		t.Fatalf("Expected escaped captions and the changed region; got '%s'", svg)
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newSettings()
+	base := solidImage(4, 4, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4, 4, color.NRGBA{0, 0, 0, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(1, 2, color.NRGBA{100, 100, 100, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(3, 3, color.NRGBA{255, 255, 255, 255})
+	diff, err := compareImages(&s, base, ref, 0, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "stats.json")
+	if err := writeStats(path, diff); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats jsonStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.ChangedPixels != 2 || stats.MaxDiffAt == nil || *stats.MaxDiffAt != (jsonShift{3, 3}) {
+		t.Fatalf("Expected 2 changed pixels and the maximum at (3,3); got '%s'", data)
+	}
+	if stats.ChangedRegion == nil || *stats.ChangedRegion != (jsonRegion{1, 2, 4, 4}) {
+		t.Fatalf("Expected changed region (1,2)-(4,4); got '%s'", data)
+	}
+}
+
+func TestResultFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "result-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "result.txt")
+	if err := ioutil.WriteFile(path, []byte("previous result which is longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeResultFile(path, 12.5, 12); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "12.5 12\n" {
+		t.Fatalf("Expected the previous result to be replaced by '12.5 12'; got '%s'", data)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("Expected no temporary files left; got %d files", len(files))
+	}
+}
+
+func TestStoppedResult(t *testing.T) {
+	res := result{Percentage: 2.5, Partial: 100, Stopped: &stopError{102, time.Second, "comparing"}}
+	var out bytes.Buffer
+	if err := writeJSONResult(&out, res, "", 102); err != nil {
+		t.Fatal(err)
+	}
+	expected := `"stopped":"timed out within 1s (phase: comparing)","partial_pixels":100,"exit_code":102,"exit_code_meaning":"timeout"`
+	if !strings.Contains(out.String(), expected) {
+		t.Fatalf("Expected the partial JSON result; got '%s'", out.String())
+	}
+
+	out.Reset()
+	if err := writeXMLResult(&out, res, "a.png vs b.png", 10.0, "", 102); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `type="timeout"`) || !strings.Contains(out.String(), `name="partial_pixels" value="100"`) {
+		t.Fatalf("Expected a timeout failure within the threshold; got '%s'", out.String())
+	}
+}
@@ -1,15 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	_ "image/jpeg"
-	_ "image/png"
+	"image/png"
+	"io"
+	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"text/template"
 	"time"
 )
 
@@ -17,7 +33,14 @@ import (
 const USAGE = `
 USAGE
 
-./compareimage [--colors <colorspace> | --timeout <S> | --wait <S>] <base> <ref>
+./compareimage [OPTIONS] <base> <ref>
+./compareimage [OPTIONS] --ref-color <RRGGBB> <base>
+./compareimage [OPTIONS] --snapshot-dir <dir> <base>
+./compareimage [OPTIONS] --batch <manifest>
+./compareimage [OPTIONS] --base-dir <dir> --ref-dir <dir>
+./compareimage [OPTIONS] --similarity-matrix <image> <image>...
+./compareimage --convert <out.png> <input>
+./compareimage --list-colorspaces
 
 DESCRIPTION
 
@@ -33,6 +56,22 @@ OPTIONS
   "Y'UV" resembles the perception of the colors by the eye better.
   Hence the differences better quantify the visual differences.
 
+--list-colorspaces
+  prints the supported color spaces with a short description
+  and exits with return code 0.
+
+--weights with default '1,1,1'
+  defines the importance of the three channels of the color space
+  as comma-separated non-negative numbers, e.g. '0.3,0.6,0.1'
+  to emphasize green in RGB. The weights are renormalized.
+
+--luma-weight with default '1' and --chroma-weight with default '1'
+  define the importance of the luma and of both chroma channels in
+  the color space "Y'UV", e.g. '--luma-weight 1 --chroma-weight 0.1'
+  to compare mostly the luminance structure while still registering
+  large hue changes. A chroma weight of 0 compares grayscale images.
+  They override --weights.
+
 --timeout with default '0s' (special meaning: infinity)
   assigns a maximum runtime for this program.
 
@@ -42,12 +81,621 @@ OPTIONS
     '600i'   600 milliseconds       '2s'    2 seconds
     '1m'     1 minute               '24h'   24 hours
 
+--decode-timeout with default '0s' (special meaning: infinity)
+  assigns a maximum runtime for reading the image files. If given,
+  the --timeout only applies to the comparison after reading.
+  In batch mode and with --similarity-matrix, it bounds reading the
+  files of every pair, while --timeout bounds the whole run. A pair
+  exceeding it fails with return code 102.
+  Image files may be named pipes (FIFOs), which are read until the
+  writer closes them. Hence a timeout prevents waiting forever for
+  a pipe which is never written.
+
 --wait with default '0s'
   defines how long the program should wait before reading
   the image files.
 
+--settle with default '0s'
+  defines the interval for re-reading the reference image until
+  two consecutive reads have identical pixels. Unlike --wait, this
+  verifies that the image stopped changing. Bounded by --decode-timeout
+  per pair and --timeout; an image which does not settle in time
+  fails with return code 102.
+
+--max-workers with default: number of CPUs
+  defines the maximum number of goroutines comparing rows in
+  parallel. Must be at least 1. 1 compares serially which gives
+  reproducible timing.
+
+--deterministic
+  sums the results of the rows in the order of their y-coordinate
+  instead of the order of completion. Hence parallel comparisons
+  yield bit-identical scores in every run, e.g. for golden values.
+  Costs memory for one intermediate result per row and little time.
+
+--adaptive-downscale
+  estimates from the image dimensions and the number of workers
+  whether the comparison finishes within half of the --timeout. If
+  not, both images are downscaled by the smallest sufficient factor.
+  The factor is reported, since the result is only approximate.
+  Hence a best-effort result replaces a timeout.
+
+--sample with default '1'
+  compares only the given fraction of randomly chosen pixels, e.g.
+  '0.01' for gigapixel captures, and estimates the difference from
+  them. The choice is seeded, so results are reproducible. The
+  95 % confidence interval of the percentage is reported based on
+  the normal approximation, which is unreliable for few samples or
+  very rare differences. '1' compares all pixels.
+
+--two-pass
+  compares images downscaled by the coarse factor first. If the
+  difference is below half or above twice the threshold, this
+  result is reported. Otherwise the images are compared in full
+  resolution. The result reports which pass decided. A triage image
+  of a coarse decision has the downscaled dimensions.
+
+--coarse-factor with default '4'
+  defines the factor by which images are downscaled in the coarse
+  pass. Must be at least 2.
+
+--metric with default 'pixel'
+  defines how the difference is measured. One of
+    'pixel'    averages the distances of corresponding pixels
+    'fft'      compares the magnitude spectra of the 2D Fourier
+               transforms of the luma of both images. Hence periodic
+               artifacts like moiré or compression blocks are
+               detected. Images are padded to powers of 2.
+    'ms-ssim'  compares the structural similarity of the luma of
+               both images at up to 5 scales, each halving the
+               dimensions, combined with the standard weights. The
+               score is 1-MS-SSIM and the MS-SSIM between 0 and 1
+               is reported. Tolerates noise and slight blurring.
+    'hog'      compares histograms of the luma gradient orientations
+               per cell (like HOG). The score is the average distance
+               of the normalized histograms between 0 and 1. Hence the
+               structure of edges and shapes is compared regardless of
+               colors and shifts within a cell, e.g. to detect layout
+               regressions.
+    'ssim-color'
+               combines the structural similarity (SSIM) of the luma
+               of both images with the mean difference of their chroma
+               in Y'UV, since SSIM alone ignores hue shifts. The score
+               is (1-w)·(1-SSIM) + w·chroma difference between 0 and 1
+               with w given by --ssim-chroma-weight.
+    'delta-e-2000-jnd'
+               compares the CIEDE2000 color differences (ΔE00) of the
+               pixels in CIELAB in just noticeable differences (JND),
+               where a ΔE00 of 1 is about the smallest perceptible
+               difference. The score is the fraction of pixels above
+               1 JND, e.g. 3 % of the pixels differ perceptibly. The
+               mean ΔE00 and the percentages of pixels above 1 and
+               2 JND are reported. Transparency is ignored.
+
+--cell-size with default '8'
+  defines the width and height of the cells of metric 'hog' in pixels.
+
+--ssim-chroma-weight with default '0.5'
+  defines the weight between 0 and 1 of the chroma difference of
+  metric 'ssim-color'. 0 compares the luma SSIM only.
+
+--compare-text-regions
+  compares the ink density (fraction of dark pixels) of blocks of
+  both images instead of the pixels. The score is the average
+  difference of the densities. Hence subpixel differences of text
+  rendering are tolerated, but missing or added text is not. The
+  tolerance applies to the density of a block. No triage image.
+
+--text-block-size with default '16'
+  defines the width and height of the blocks in pixels.
+
+--compare-mode with default 'full'
+  defines the comparison strategy. One of
+    'full'        compares every pixel
+    'fast-equal'  reports no difference immediately if both images
+                  have identical pixel data after all preprocessing
+                  (e.g. --overlay or --rotate-ref) and falls back to
+                  'full' otherwise
+
+--dimension-policy with default 'error'
+  defines the handling of images with different dimensions. One of
+    'error'       refuses to compare them (return code 101)
+    'scale-down'  scales both images down to the smaller width and
+                  the smaller height by averaging the covered pixels.
+                  Unlike upscaling, this adds no interpolated detail.
+                  Coordinates in the output refer to the scaled images.
+
+--base-alpha with default 'ignore'
+  defines the handling of transparency in the base image. One of
+    'ignore'  uses the unpremultiplied color values of the base
+              image; fully transparent pixels are black
+    'weight'  weights the distance by the alpha channels of both
+              images, so pixels transparent in either image count less
+    'error'   refuses to compare a base image with transparency
+
+--compare-alpha
+  includes the difference of the alpha channels as fourth
+  dimension in the euclidean distance instead of weighting the
+  distance by the alpha channel of the reference image. Hence
+  images with identical RGB values but different transparency
+  differ. Requires the RGB color space.
+
+--correct-alpha-blend
+  composites the reference image over the base image in linear
+  light (like browsers render transparency) and compares the base
+  image with the composite instead of weighting the distance by
+  the alpha channel of the reference image.
+
+--overlay <path.png>
+  composites the given image with alpha channel over the base image
+  in linear light like --correct-alpha-blend and compares the
+  composite as expected result against the reference image, e.g. to
+  validate compositing pipelines end to end. The overlay must have
+  the dimensions of the base image.
+
+--align-window with default '0'
+  tries every shift of the reference image by up to the given
+  number of pixels (at most 8) horizontally and vertically, e.g.
+  due to a different scroll position, and compares the overlapping
+  regions for the shift with the least difference. The shift is
+  reported. Coordinates in the output are relative to the overlap
+  unless --padding is given.
+
+--vscroll-search with default '0'
+  like --align-window, but tries only vertical shifts by up to the
+  given number of rows (at most 64), e.g. for web pages captured at
+  slightly different scroll offsets. Hence it is cheaper and covers
+  larger offsets. Mutually exclusive with --align-window.
+
+--padding <mode>
+  defines how pixels out of bounds are sampled. One of
+    'clamp'  repeats the nearest pixel at the border
+    'wrap'   continues at the opposite border
+    'zero'   uses transparent black
+  With --align-window or --vscroll-search, the whole base image is
+  compared against the shifted reference padded accordingly instead of
+  the overlap, so the divisor does not depend on the shift. The
+  neighborhoods of --subpixel-tolerant are padded as well and clamped
+  by default.
+
+--detect-shift
+  estimates a constant translation of the reference image, e.g.
+  "you probably scrolled 3 pixels", by phase correlation of the
+  luma of both images and reports it. Unlike --align-window, the
+  comparison and the score are not affected. Nothing is reported
+  if no translation stands out.
+
+--region-percent <x%,y%,w%,h%>
+  compares only the region given by its top left corner, width and
+  height in percent of the image dimensions, e.g. '0%,10%,100%,80%'
+  to ignore a header and footer. Hence the option works for any
+  resolution. Coordinates in the output are relative to the region.
+
+--ignore-right <px> and --ignore-bottom <px>
+  exclude a band of the given width at the right edge and of the
+  given height at the bottom edge of both images, e.g. '--ignore-right
+  16' where a browser shows a scrollbar in only one of the screenshots.
+  The bands are removed before --region-percent and do not count
+  towards the average.
+
+--crop-to-ref
+  crops the base image to the dimensions of the reference image
+  instead of refusing images of different dimensions, e.g. to compare
+  the top of a full page screenshot against a viewport screenshot.
+  The reference image must fit within the base image.
+
+--crop-origin <corner> with default 'top-left'
+  defines the corner of the base image kept by --crop-to-ref. One of
+  'top-left', 'top-right', 'bottom-left', 'bottom-right' or 'center'.
+
+--base-region <x,y,w,h> and --ref-region <x,y,w,h>
+  compare the region of the base image given by its top left corner,
+  width and height in pixels against the region of the reference
+  image, e.g. a logo in the top left corner against the same logo
+  centered. Both regions must have the same dimensions and lie within
+  their images, whose dimensions may differ. Coordinates in the output
+  are relative to the regions.
+
+--compare-only-opaque-intersection
+  compares only pixels which are opaque in both images, e.g. for
+  two overlays. The difference is averaged over these pixels and
+  their number is reported. Fails if no pixel is opaque in both.
+
+--alpha-as-mask
+  excludes fully transparent pixels of the reference image from the
+  comparison, i.e. they do not count towards the number of pixels the
+  difference is averaged over. Hence a reference which is transparent
+  except for a small region scores on that region only. Fails if the
+  reference is fully transparent.
+
+--compare-saturation-only
+  compares only the saturation (as in HSV between 0 and 1) of the
+  pixels, ignoring hue and brightness. Hence the score is the mean
+  saturation difference, e.g. to detect accidentally desaturated
+  colors.
+
+--key-color <RRGGBB>
+  excludes all pixels from the comparison where the reference image
+  has the given hexadecimal color (like chroma keying). Hence test
+  authors can paint regions to ignore into the reference image.
+  Excluded pixels do not count towards the average.
+
+--exclude <x,y,w,h>
+  excludes the rectangle given by its top left corner, width and
+  height in pixels from the comparison, e.g. '0,0,200,40' for
+  a clock. May be given several times. Excluded pixels do not count
+  towards the average. Coordinates are relative to --region-percent
+  and every rectangle must lie within the compared images.
+
+--key-tolerance with default '0'
+  defines the maximum difference between 0 and 255 per channel
+  up to which a color of the reference image matches the key color.
+
+--equalize
+  applies histogram equalization to the luma of both images before
+  comparison. Hence differences in exposure and contrast are ignored
+  and structural differences remain. Beware that this also hides
+  genuine contrast regressions.
+
+--center-weight <falloff>
+  multiplies the difference of every pixel by a weight falling off
+  with its distance from the center of the compared images and divides
+  by the sum of the weights instead of the number of pixels. Hence
+  differences of focal content count more than those of peripheral
+  chrome like scrollbars. The distance is relative to half of the
+  diagonal. <falloff> is one of
+    'linear'     1 - d
+    'quadratic'  1 - d², which keeps more weight away from the center
+    'gaussian'   exp(-d² / 0.32), i.e. a standard deviation of 0.4
+  Requires the pixel metric without sampling.
+
+--edge-downweight with default '1'
+  multiplies the differences of pixels along edges of the base image
+  by the given factor between 0 and 1. Edges are detected by the
+  luma gradient (Sobel operator). Hence noise of anti-aliasing and
+  subpixel-shifted text edges counts less, whereas differences of
+  filled areas keep their full weight. '1' disables the detection.
+
+--tolerance with default '0'
+  defines the per-pixel difference between 0 and 1 up to which
+  a pixel is not considered as changed. The changed region
+  encloses all changed pixels.
+
+--auto-tolerance
+  sets the tolerance to the noise floor of both images instead of
+  a fixed value, e.g. for JPEG screenshots whose capture noise varies.
+  The noise is estimated from the luma variance of the flattest
+  blocks of 8x8 pixels. The resulting noise level is reported.
+
+--channel-threshold <r=R,g=G,b=B>
+  counts a pixel as differing only if at least one of its RGB channels
+  differs by more than the threshold of the channel between 0 and 255,
+  e.g. 'r=5,g=2,b=5' if green is more sensitive. Channels which are not
+  given have threshold 0. Other pixels do not contribute to the
+  difference. By default, pixels are not gated per channel.
+
+--subpixel-tolerant
+  uses the minimum distance of a base pixel to the reference pixels
+  in its 3x3 neighborhood and vice versa as difference of the pixel.
+  Hence shifts by 1 pixel, e.g. by subpixel font rendering, are
+  tolerated. Costs up to 18 color distances per pixel instead of 1,
+  i.e. the comparison is roughly an order of magnitude slower.
+
+--tolerance-sweep <T1,T2,...>
+  reports the percentage of pixels whose difference exceeds each
+  of the given comma-separated tolerances between 0 and 1, e.g.
+  '0,0.05,0.1,0.2'. All levels are determined in a single pass and
+  show how robust the match is.
+
+--render-scale <F1,F2,...>
+  additionally compares both images downscaled by each of the given
+  comma-separated factors, e.g. '2,4,8', and reports the difference
+  per factor. Rendering differences which only appear at certain
+  zoom levels, e.g. of subpixel text, show up as outliers.
+
+--quadrants
+  additionally reports the difference of each quadrant of the
+  images (top left, top right, bottom left and bottom right), e.g.
+  to locate a change roughly. Odd dimensions give the extra row or
+  column to the bottom and right quadrants.
+
+--png-regions
+  additionally reports the difference of every region defined in the
+  tEXt chunks of the base image, a PNG file, e.g. by the screenshot
+  tool. A chunk with keyword 'region:<name>' and text 'x,y,w,h' defines
+  the rectangle <name> by its top left corner, width and height in
+  pixels. Coordinates are relative to --region-percent and every region
+  must lie within the compared images. Fails if no region is defined.
+
+--min-region-size with default '0'
+  ignores regions of changed pixels (connected horizontally,
+  vertically or diagonally) with less than the given number of
+  pixels, e.g. a blinking cursor. Their difference does not count,
+  neither in the maximum differences nor in --tolerance-sweep, and
+  they are tolerated in the triage image. The number of
+  suppressed regions is reported. 0 disables the suppression.
+
+--triage-out <path.png>
+  stores an image of the dimensions of the base image at the given
+  path. A pixel is green if it is identical, yellow if its
+  difference is within the tolerance and red otherwise.
+
+--mask-out <path.png>
+  stores a grayscale image of the dimensions of the base image at
+  the given path. A pixel is white if its difference exceeds the
+  tolerance and black otherwise, e.g. to compute the changed area
+  with other tools. Pixels of suppressed regions are black.
+  Requires the pixel metric without sampling or two passes.
+
+--save-normalized <dir>
+  stores the images compared after all preprocessing (e.g. rotation,
+  overlay, cropping, scaling and alignment) as 'base.png' and
+  'ref.png' in <dir>, which is created if missing, e.g. to verify
+  that the preprocessing did what was expected.
+
+--cycle-gif <path.gif>
+  stores an animated GIF at the given path, which cycles through
+  the base image, the reference image and the triage image. The eye
+  catches subtle changes by their flicker.
+  Requires the pixel metric without sampling.
+
+--cycle-delay <S> with default '500i'
+  defines how long every frame of the cycle GIF is shown.
+
+--annotate
+  draws the difference percentage in the top left corner and the
+  outline of the changed region in blue onto the triage image and
+  the snapshot diff, e.g. as self-explanatory artifact for reviewers.
+  Requires --triage-out or --snapshot-dir.
+
+--stats-out <path.json>
+  stores the difference percentage, the number of pixels exceeding
+  the tolerance, the changed region and the position of the pixel
+  with the maximum difference as JSON object at the given path,
+  e.g. as machine-readable companion of the triage image.
+
+--result-file <path>
+  stores the difference percentage in full precision and the return
+  code separated by a space, e.g. '12.5 12', at the given path
+  before exiting. The file is written to a temporary file, synced
+  and renamed, so it is either complete or absent. Hence scripts
+  can recover the result if the return code is lost. A timeout
+  stores the partial percentage or 'NaN' if no row was compared.
+  Other errors store no file. Not available in batch mode.
+
+--svg-report <path.svg>
+  stores a self-contained SVG image at the given path showing
+  thumbnails of both images side by side with the changed region
+  as red frame and the difference percentage, e.g. for dashboards.
+
+--raw-score
+  prints the raw score, the mean weighted distance of the pixels
+  before the rounding error correction, clamping and the mapping to
+  a percentage, in full precision, e.g. to calibrate thresholds.
+  The raw score is not bounded to [0,1] if the correction exceeds 1.
+
+--report-compression-artifacts
+  estimates the share of the difference caused by JPEG block artifacts
+  if the base or the reference image is a JPEG file, e.g. to decide
+  whether a difference against a PNG is real. The blockiness is the
+  share of the luma steps across 8×8 block boundaries of the JPEG image
+  exceeding the steps within blocks. The estimate is the share of the
+  difference on pixels at block boundaries weighted by the blockiness.
+  A rough heuristic, which assumes blocks at the top left corner.
+
+--verbose-timing
+  additionally prints how long decoding, preprocessing (e.g. rotation,
+  overlay and cropping) and the comparison took, e.g. to decide
+  whether --adaptive-downscale would help. Writing output images is
+  not included.
+
+--max-channel-difference
+  prints the largest difference of a single color channel between 0
+  and 255 anywhere in the images, its channel and its position, e.g.
+  the worst-case color error which the mean percentage hides. It is
+  weighted by alpha like the difference of the pixel.
+
+--precision with default '3'
+  defines the number of decimal places between 0 and 15 of the
+  difference percentages in text output. JSON output always
+  contains the full precision.
+
+--template <T>
+  defines the output of the result as Go text/template, e.g.
+  '{{.Percentage}} {{.Runtime}}'. Available fields are
+  Percentage, Score, ChangedRegion (image.Rectangle), LuminanceDelta,
+  LuminanceSummary, Intersection, SuppressedRegions, ToleranceSweep (list of
+  Tolerance and Percentage), RenderScales (list of Factor and
+  Percentage), Quadrants (list of Name and Percentage), PNGRegions
+  (list of Name and Percentage), AdaptiveFactor,
+  Shift (image.Point), EstimatedShift (image.Point), MSSSIM, JND (Mean,
+  Above1 and Above2; only with metric 'delta-e-2000-jnd'), Identical
+  (pixel-identical images unlike a rounded 0 %), Sampled, Confidence,
+  References (number of averaged --ref images), NoiseLevel (only with
+  --auto-tolerance), RawScore (only with --raw-score), MaxChannelDelta
+  (Value, Channel and At; only with --max-channel-difference),
+  Artifacts (Percentage and Blockiness; only with
+  --report-compression-artifacts), Timings (Decoding, Preprocessing
+  and Comparison; only with --verbose-timing), Verdict (only with
+  --expect-different), Pass,
+  Runtime and Precision.
+
+--format with default 'text'
+  defines the output format. One of
+    'text'  prints the result as defined by --template
+    'json'  prints the result as JSON object and ignores --template.
+            In batch mode, one JSON object is printed per line
+            (JSON lines) as soon as a pair is compared, followed by
+            a summary object with the key 'summary'. The return
+            code is included as 'exit_code' and described by
+            'exit_code_meaning' as one of 'identical', 'difference'
+            (exceeding --threshold), 'within-threshold',
+            'invalid-args', 'load-error', 'timeout' or 'interrupted',
+            which is independent of --warn-only and --load-error-code.
+            With --expect-different, a compared pair is described as
+            'different' or 'too-similar' instead.
+            A partial result is marked by 'stopped' and the number
+            of compared pixels 'partial_pixels'.
+    'xml'   prints the result as JUnit-like XML test suite with one
+            test case named after both images, e.g. for Jenkins. The
+            percentage, score and return code are properties. The
+            test case contains a failure element if the percentage
+            exceeds --threshold or the comparison was stopped by
+            a timeout or SIGINT. Not available in batch mode.
+
+--assume-srgb (default)
+  interprets the color values of all images as sRGB. If an image
+  embeds an ICC color profile, the profile is ignored and
+  a warning is printed.
+
+--respect-icc
+  refuses to compare images embedding an ICC color profile. Images
+  are never converted to sRGB; without this option, the embedded
+  profile is ignored and the raw color values are compared.
+
+--respect-exif-orientation
+  rotates and mirrors JPEG images according to their EXIF
+  orientation tag before comparison.
+
+--rotate-ref <degrees>
+  rotates the reference image clockwise by 90, 180 or 270 degrees
+  before comparison, e.g. a capture in landscape orientation. The
+  rotated reference must have the dimensions of the base image
+  regardless of --dimension-policy.
+
+--strict-decode
+  refuses to compare PNG, JPEG and GIF files which do not end with
+  the end marker of their format, i.e. truncated files which Go
+  decodes partially without error or files with trailing data.
+  Treated like a file which cannot be read.
+
+--load-error-code with default '101'
+  defines the return code if an image file cannot be read or
+  decoded, e.g. to distinguish it from a dimension mismatch.
+
+--print-hashes
+  prints a SHA-256 digest of the pixel data of each image and
+  exits without comparing. Images with the same pixels yield the
+  same digest regardless of their file format.
+
+--inspect <x,y>
+  prints the color values of the base and the reference image at the
+  given pixel as premultiplied RGBA and un-premultiplied NRGBA with
+  16 bits per channel, as Y'UV and as CIELAB, and the distance of both
+  colors, then exits without comparing, e.g. to explain why a pixel
+  was flagged. Coordinates are relative to the compared region.
+
+--ref-color <RRGGBB>
+  compares the base image against a reference image of the same
+  dimensions filled uniformly with the given hexadecimal color.
+  No reference image file is read.
+
+--ref <file>
+  adds a reference image. May be given several times instead of the
+  positional reference image. The per-pixel average of all reference
+  images of the same dimensions forms the effective reference, e.g.
+  several captures of a stable baseline to reduce the noise of any
+  single capture. The number of averaged references is reported.
+  Not available in batch mode.
+
+--base-b64 <data> and --ref-b64 <data>
+  compare the images encoded in the given base64 data (standard
+  alphabet with padding) instead of image files, e.g. for tiny
+  sprites embedded in a CI configuration. Both are required and
+  no positional arguments are accepted.
+
+--snapshot-dir <dir>
+  compares the base image against the reference image of the same
+  filename in <dir>. If the difference exceeds the threshold, the
+  triage image is stored as '<name>.diff.png' in <dir> and the
+  return code is at least 1. Otherwise the return code is 0.
+
+--batch <manifest>
+  compares several pairs of images. Every line of the manifest
+  file contains the filepaths of a base image and a reference image
+  separated by whitespace. If <manifest> is '-', the lines are read
+  from stdin until EOF. One result line is printed per pair as
+  soon as it is available. Malformed lines and failing comparisons
+  print an error line, but do not abort the batch.
+
+--base-dir <dir> and --ref-dir <dir>
+  compares every file in the base directory with the file of the
+  same name in the reference directory like --batch. Files without
+  counterpart in the other directory print an error line.
+
+--similarity-matrix
+  compares every pair of the positional images, e.g. to find
+  duplicates or the most representative screenshot of a set, and
+  prints the matrix of difference percentages labeled by filepath as
+  CSV (or as JSON with --format json). Row n holds the differences
+  with image n as base image. Both directions of a pair are compared,
+  since the difference is not symmetric with options weighting or
+  masking by one image, e.g. --alpha-as-mask or --base-alpha.
+  Pairs which fail to compare are empty and return code 101 is used.
+
+--phash-cutoff with default '64'
+  skips pairs of --similarity-matrix whose perceptual hashes (DCT of a
+  32×32 luma thumbnail) differ in more than the given number of the 64
+  bits. Their differences are empty. E.g. '16' compares only similar
+  pairs of a large set.
+
+--threshold with default '0'
+  defines the difference percentage between 0 and 100 above which
+  a comparison is considered as failed.
+
+--warn-only
+  always exits with return code 0 if the comparison succeeds, but
+  prints a warning with the difference percentage to stderr if it
+  exceeds --threshold, e.g. for advisory checks during a migration.
+  Invalid arguments, load errors and timeouts keep their return code.
+  Not available in batch mode.
+
+--expect-different
+  inverts the pass condition for tests proving that the images differ,
+  e.g. that a toggle changed the UI. Exits with return code 0 if the
+  difference percentage exceeds --threshold and with return code 103
+  if the images are too similar. The verdict is printed. Invalid
+  arguments, load errors and timeouts keep their return code. Not
+  available in batch mode and mutually exclusive with --warn-only.
+
+--fail-fast
+  aborts a batch as soon as a pair exceeds the threshold or fails
+  to compare. Otherwise all pairs are compared and the exit code
+  corresponds to the worst result.
+
+--cache-size with default '4'
+  defines the maximum number of decoded images kept in memory in
+  a batch or the similarity matrix, e.g. for one reference image
+  compared against many base images. A cached image is read again if the modification time of
+  its file changed. '0' disables the cache.
+
+--state-file <path.json>
+  records the result of every pair of a batch with the modification
+  times of both files at the given path.
+
+--skip-unchanged
+  reports the recorded result of a pair of a batch as 'unchanged,
+  skipped' instead of comparing it again if neither file was modified
+  since, e.g. in incremental CI runs. A fingerprint of the options
+  affecting the result and of the modification times of files given
+  by options, e.g. --overlay, is recorded with every pair, hence
+  changing them compares the pair again. Requires --state-file.
+
+--limit-memory <size>
+  rejects images whose decoded pixels would need more than the given
+  number of bytes, e.g. '512M', with suffix K, M or G. The dimensions
+  and color model are read from the image header before decoding.
+  With dimension policy 'error', images of different dimensions are
+  rejected by the same pre-check before either is decoded.
+  By default, the memory is not limited.
+
+--convert <out.png>
+  re-encodes the single positional image <input> as PNG image
+  with non-premultiplied alpha and stores it at <out.png>.
+  No comparison takes place.
+
 <base> is a required positional argument
-  is a filepath to the base image (contains no transparency)
+  is a filepath to the base image (transparency, see --base-alpha)
 
 <ref> is a required positional argument
   is a filepath to the reference image (optionally contains transparency)
@@ -59,13 +707,59 @@ So this program is subject to floating point rounding errors.
 
 RETURN CODE
 
-The return code is an integer with min. 0 and max. 102:
-  0     no differences (every pixel has same RGB value)
+The return code is an integer with min. 0 and max. 130:
+  0     no differences (every pixel has same RGB value) or, with
+        --expect-different, a difference above the threshold
+  1-99  difference percentage (rounded down)
   100   high difference
-  101   invalid arguments OR dimensions do not correspond
-  102   timeout reached
+  101   invalid arguments OR dimensions do not correspond OR
+        an image cannot be loaded (see --load-error-code)
+  102   timeout reached (the phase and the difference of the rows
+        compared so far are reported as partial result) or a named
+        pipe (FIFO) given as image was closed before delivering
+        a complete image
+  103   images too similar with --expect-different
+  130   interrupted by SIGINT, e.g. Ctrl-C (the phase and the
+        difference of the rows compared so far are reported as
+        partial result; a batch stops after the current pair and
+        reports its summary; a second SIGINT exits immediately)
+`
+
+// TEMPLATE is the default template for the result output
+const TEMPLATE = `difference percentage:  {{if .Identical}}identical{{else}}{{printf "%.*f" .Precision .Percentage}} %{{end}}
+{{with .ChangedRegion}}{{if not .Empty}}changed region:         ({{.Min.X}},{{.Min.Y}})-({{.Max.X}},{{.Max.Y}})
+{{end}}{{end}}{{with .LuminanceSummary}}luminance:              {{.}}
+{{end}}{{with .Intersection}}opaque intersection:    {{.}} pixels
+{{end}}{{with .SuppressedRegions}}suppressed regions:     {{.}}
+{{end}}{{with .ToleranceSweep}}tolerance sweep:        tolerance  changed pixels
+{{range .}}                        {{printf "%9.3f" .Tolerance}}  {{printf "%.*f" $.Precision .Percentage}} %
+{{end}}{{end}}{{with .RenderScales}}render scales:          factor     difference
+{{range .}}                        {{printf "%9d" .Factor}}  {{printf "%.*f" $.Precision .Percentage}} %
+{{end}}{{end}}{{with .Quadrants}}quadrants:              quadrant   difference
+{{range .}}                        {{printf "%9s" .Name}}  {{printf "%.*f" $.Precision .Percentage}} %
+{{end}}{{end}}{{with .PNGRegions}}png regions:            region     difference
+{{range .}}                        {{printf "%9s" .Name}}  {{printf "%.*f" $.Precision .Percentage}} %
+{{end}}{{end}}{{if .Sampled}}estimated from:         {{.Sampled}} sampled pixels (95 % confidence: ± {{printf "%.*f" .Precision .Confidence}} %)
+{{end}}{{with .References}}reference:              average of {{.}} images
+{{end}}{{with .Shift}}best alignment:         reference shifted by ({{.X}},{{.Y}})
+{{end}}{{with .EstimatedShift}}estimated shift:        reference probably shifted by ({{.X}},{{.Y}})
+{{end}}{{with .AdaptiveFactor}}approximated by:        downscaling by factor {{.}}
+{{end}}{{with .MSSSIM}}ms-ssim:                {{.}}
+{{end}}{{with .JND}}delta e 2000:           mean {{printf "%.2f" .Mean}}, {{printf "%.*f" $.Precision .Above1}} % above 1 JND, {{printf "%.*f" $.Precision .Above2}} % above 2 JND
+{{end}}{{with .NoiseLevel}}noise level:            {{.}} (used as tolerance)
+{{end}}{{with .RawScore}}raw score:              {{.}}
+{{end}}{{with .Artifacts}}jpeg artifacts:         estimated {{printf "%.*f" $.Precision .Percentage}} % of the difference (blockiness {{printf "%.2f" .Blockiness}})
+{{end}}{{with .MaxChannelDelta}}max channel delta:      {{.Value}} in {{.Channel}} at ({{.At.X}},{{.At.Y}})
+{{end}}{{with .Pass}}decided by:             {{.}}
+{{end}}{{with .Verdict}}expect different:       {{.}}
+{{end}}{{with .Timings}}timings:                decoding {{.Decoding}}, preprocessing {{.Preprocessing}}, comparison {{.Comparison}}
+{{end}}runtime:                {{.Runtime}}
 `
 
+// maxChannel is the maximum value of a color channel as returned by
+// color.Color.RGBA regardless of the bit depth of the decoded image
+const maxChannel = float64(0xFFFF)
+
 // WR as defined by standard BT.601 by CCIR
 const WR = float64(0.299)
 
@@ -75,29 +769,607 @@ const WG = float64(0.587)
 // WB as defined by standard BT.601 by CCIR
 const WB = float64(0.114)
 
+// colorSpace describes a supported color space
+type colorSpace struct {
+	name        string
+	description string
+	// maximum euclidean distance of two colors which
+	// normalizes distances to [0,1]
+	maxDistance float64
+}
+
+// colorSpaces lists the supported color spaces
+var colorSpaces = []colorSpace{
+	// black and white
+	{"RGB", "standard color model (default)", 113510.0},
+	// red and cyan
+	{"Y'UV", "resembles the perception of the colors by the eye better", 86941.26},
+}
+
+// findColorSpace returns the supported color space called `name`
+func findColorSpace(name string) (colorSpace, bool) {
+	for _, c := range colorSpaces {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return colorSpace{}, false
+}
+
+// listColorSpaces writes one line per supported color space to `w`
+func listColorSpaces(w io.Writer) {
+	for _, c := range colorSpaces {
+		fmt.Fprintf(w, "%-8s %s\n", c.name, c.description)
+	}
+}
+
+// maxDistanceRGBA defines the maximum euclidean distance of two RGBA
+// colors, namely transparent black and opaque white
+const maxDistanceRGBA = 2 * maxChannel
+
+// colors of the triage image
+var (
+	triageIdentical = color.NRGBA{0, 255, 0, 255}
+	triageTolerated = color.NRGBA{255, 255, 0, 255}
+	triageChanged   = color.NRGBA{255, 0, 0, 255}
+)
+
 // Settings defines the application settings
 type Settings struct {
-	ColorSpace string
-	Timeout    time.Duration
-	Wait       time.Duration
-	BaseImg    string
-	RefImg     string
+	ColorSpace         string
+	Timeout            time.Duration
+	Wait               time.Duration
+	BaseImg            string
+	RefImg             string
+	PrintHashes        bool
+	Inspect            *image.Point
+	RespectICC         bool
+	Tolerance          float64
+	CompareMode        string
+	Weights            [3]float64
+	ConvertOut         string
+	TriageOut          string
+	MaskOut            string
+	SaveNormalized     string
+	CycleGIF           string
+	CycleDelay         time.Duration
+	Batch              string
+	SimMatrix          bool
+	MatrixImgs         []string
+	PHashCutoff        int
+	Settle             time.Duration
+	Template           string
+	Threshold          float64
+	FailFast           bool
+	RespectEXIF        bool
+	RotateRef          int
+	Padding            string
+	CropToRef          bool
+	CropOrigin         string
+	RefColor           *color.NRGBA
+	MaxWorkers         int
+	DecodeTimeout      time.Duration
+	CompareAlpha       bool
+	SnapshotDir        string
+	CorrectBlend       bool
+	LoadErrorCode      *int
+	TwoPass            bool
+	CoarseFactor       int
+	Exclude            []image.Rectangle
+	Refs               []string
+	BaseB64            []byte
+	RefB64             []byte
+	KeyColor           *color.NRGBA
+	KeyTolerance       int
+	ChannelThreshold   *[3]int
+	WarnOnly           bool
+	ExpectDifferent    bool
+	SubpixelTolerant   bool
+	LimitMemory        int64
+	Overlay            string
+	BaseRegion         *image.Rectangle
+	RefRegion          *image.Rectangle
+	Equalize           bool
+	Format             string
+	MinRegionSize      int
+	ToleranceSweep     []float64
+	RenderScales       []int
+	Quadrants          bool
+	PNGRegions         bool
+	NamedRegions       []namedRegion
+	SVGReport          string
+	OpaqueIntersection bool
+	Precision          int
+	BaseDir            string
+	RefDir             string
+	StrictDecode       bool
+	LumaWeight         float64
+	ChromaWeight       float64
+	SSIMChromaWeight   *float64
+	Deterministic      bool
+	RegionPercent      *[4]float64
+	IgnoreRight        int
+	IgnoreBottom       int
+	TextRegions        bool
+	TextBlockSize      int
+	CellSize           int
+	BaseAlpha          string
+	DimensionPolicy    string
+	CacheSize          int
+	AdaptiveDownscale  bool
+	Metric             string
+	AlignWindow        int
+	VScrollSearch      int
+	ListColorSpaces    bool
+	AlphaAsMask        bool
+	AutoTolerance      bool
+	Annotate           bool
+	DetectShift        bool
+	SaturationOnly     bool
+	Sample             float64
+	StatsOut           string
+	ResultFile         string
+	StateFile          string
+	SkipUnchanged      bool
+	EdgeDownweight     *float64
+	CenterWeight       string
+	RawScore           bool
+	MaxChannelDiff     bool
+	ReportArtifacts    bool
+	VerboseTiming      bool
+	// stop cancels running comparisons; nil never does
+	stop *stopSignal
+}
+
+// newSettings returns the Settings of the command line without arguments
+func newSettings() Settings {
+	return Settings{
+		ColorSpace:      "RGB",
+		CompareMode:     "full",
+		Format:          "text",
+		Weights:         [3]float64{1.0, 1.0, 1.0},
+		Template:        TEMPLATE,
+		MaxWorkers:      runtime.NumCPU(),
+		CoarseFactor:    4,
+		Precision:       3,
+		LumaWeight:      1.0,
+		ChromaWeight:    1.0,
+		TextBlockSize:   16,
+		CellSize:        8,
+		CycleDelay:      500 * time.Millisecond,
+		BaseAlpha:       "ignore",
+		DimensionPolicy: "error",
+		CacheSize:       4,
+		PHashCutoff:     64,
+		Metric:          "pixel",
+		Sample:          1.0,
+	}
+}
+
+// comparisonSettings returns `s` without the settings which do not
+// affect the difference of a pair, i.e. those of the output, of batches
+// and of the runtime
+func comparisonSettings(s Settings) Settings {
+	s.BaseImg, s.RefImg = "", ""
+	s.Timeout, s.Wait, s.DecodeTimeout = 0, 0, 0
+	s.Batch, s.BaseDir, s.RefDir, s.StateFile, s.SkipUnchanged, s.FailFast = "", "", "", "", false, false
+	s.SimMatrix, s.MatrixImgs, s.PHashCutoff = false, nil, 0
+	s.Format, s.Template, s.Precision, s.WarnOnly, s.ExpectDifferent, s.LoadErrorCode = "", "", 0, false, false, nil
+	s.ConvertOut, s.TriageOut, s.MaskOut, s.SaveNormalized, s.CycleGIF, s.CycleDelay = "", "", "", "", "", 0
+	s.SVGReport, s.StatsOut, s.ResultFile, s.SnapshotDir, s.Annotate, s.RawScore = "", "", "", "", false, false
+	s.MaxWorkers, s.CacheSize, s.VerboseTiming, s.ReportArtifacts = 0, 0, false, false
+	s.stop = nil
+	return s
 }
 
 // img represents an image with explicit width and height values
 type img struct {
-	i image.Image
-	w int
-	h int
-	f string
+	i           image.Image
+	w           int
+	h           int
+	f           string
+	icc         bool
+	orientation int
+	text        map[string]string
+	mono        *monoBitmap
+	truncated   bool
+	edges       []bool
+}
+
+// result is the data available to the output template
+type result struct {
+	Percentage        float64
+	Score             float64
+	ChangedRegion     image.Rectangle
+	LuminanceDelta    float64
+	LuminanceSummary  string
+	Pass              string
+	SuppressedRegions int
+	ToleranceSweep    []sweepLevel
+	RenderScales      []scaleLevel
+	Quadrants         []quadrantLevel
+	PNGRegions        []regionLevel
+	Intersection      int
+	AdaptiveFactor    int
+	Shift             *image.Point
+	EstimatedShift    *image.Point
+	Identical         bool
+	Sampled           int
+	Confidence        float64
+	References        int
+	MSSSIM            *float64
+	JND               *jndExceedance
+	NoiseLevel        *float64
+	RawScore          *float64
+	MaxChannelDelta   *channelDelta
+	Artifacts         *artifactEstimate
+	Timings           *timings
+	Verdict           string
+	Stopped           error
+	Partial           int
+	Threshold         float64
+	Runtime           time.Duration
+	Precision         int
+}
+
+// timings are the durations of the phases of a comparison
+type timings struct {
+	Decoding      time.Duration
+	Preprocessing time.Duration
+	Comparison    time.Duration
+}
+
+// channelDelta is the largest difference of a color channel
+type channelDelta struct {
+	// between 0 and 255
+	Value   int
+	Channel string
+	At      image.Point
+}
+
+// scaleLevel is the difference of images downscaled by a factor
+type scaleLevel struct {
+	Factor     int
+	Percentage float64
+}
+
+// quadrantLevel is the difference of a quadrant of the images
+type quadrantLevel struct {
+	Name       string
+	Percentage float64
+}
+
+// regionLevel is the difference of a named region of the images
+type regionLevel struct {
+	Name       string
+	Percentage float64
+}
+
+// namedRegion is a rectangle defined in the metadata of an image
+type namedRegion struct {
+	name string
+	r    image.Rectangle
+}
+
+// sweepLevel is the percentage of pixels exceeding a tolerance
+type sweepLevel struct {
+	Tolerance  float64
+	Percentage float64
 }
 
 // difference stores a difference measure for two images
 type difference struct {
 	score               float64
+	rawScore            float64
 	minValue            float64
 	maxValue            float64
 	roundingErrorFactor float64
+	diffBounds          image.Rectangle
+	triage              *image.NRGBA
+	changedMask         *image.Gray
+	luminanceDelta      float64
+	brighter            float64
+	darker              float64
+	pass                string
+	suppressedRegions   int
+	sweep               []sweepLevel
+	scales              []scaleLevel
+	quadrants           []quadrantLevel
+	pngRegions          []regionLevel
+	intersection        int
+	adaptiveFactor      int
+	shift               *image.Point
+	estimatedShift      *image.Point
+	msssim              *float64
+	jnd                 *jndExceedance
+	noiseLevel          *float64
+	identical           bool
+	sampled             int
+	confidence          float64
+	changed             int
+	maxDiff             float64
+	maxDiffAt           image.Point
+	maxChannelDelta     float64
+	maxChannel          int
+	maxChannelAt        image.Point
+	artifacts           *artifactEstimate
+}
+
+// progress accumulates the intermediate state of a running comparison
+// in atomic counters. It is safe for concurrent use. The counters are
+// updated individually, hence a reader may see a row in some of them
+// only, which is negligible for the partial difference.
+type progress struct {
+	// the float64 bits of the cumulative difference and of the sum of
+	// weights; 64-bit atomic values come first to be aligned on 32-bit
+	// platforms
+	cul     uint64
+	weights uint64
+	pixels  int64
+}
+
+// addFloat atomically adds `delta` to the float64 bits at `bits`
+func addFloat(bits *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		sum := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(bits, old, sum) {
+			return
+		}
+	}
+}
+
+// add registers the result of a compared row
+func (p *progress) add(res rowResult) {
+	addFloat(&p.cul, res.cul)
+	addFloat(&p.weights, res.weights)
+	atomic.AddInt64(&p.pixels, int64(res.pixels))
+}
+
+// difference returns the difference over all pixels compared so far
+// and the number of those pixels
+func (p *progress) difference() (difference, int) {
+	sum := rowResult{
+		cul:     math.Float64frombits(atomic.LoadUint64(&p.cul)),
+		weights: math.Float64frombits(atomic.LoadUint64(&p.weights)),
+		pixels:  int(atomic.LoadInt64(&p.pixels)),
+	}
+	return sum.difference(), sum.pixels
+}
+
+// newDifference returns a difference with the default measure parameters
+func newDifference() difference {
+	var diff difference
+	diff.minValue = 0.0
+	diff.maxValue = 1.0
+	diff.roundingErrorFactor = 1.25
+	return diff
+}
+
+// identicalDifference returns the difference of pixel-identical images
+func identicalDifference() difference {
+	diff := newDifference()
+	diff.identical = true
+	return diff
+}
+
+// setScore determines the score from the cumulative difference `cul`
+// over `pixels` pixels or the sum of their weights
+func (d *difference) setScore(cul, pixels float64) {
+	d.rawScore = cul / pixels
+	d.score = d.rawScore * d.roundingErrorFactor
+	if d.score > 1.0 {
+		d.score = 1.0
+	}
+}
+
+// luminanceSummary describes whether the reference is brighter, darker
+// or mixed relative to the base image
+func (d difference) luminanceSummary() string {
+	switch {
+	case d.brighter == 0.0 && d.darker == 0.0:
+		return ""
+	case d.darker <= 0.1*d.brighter:
+		return fmt.Sprintf("reference is %.3f %% brighter", 100*d.luminanceDelta)
+	case d.brighter <= 0.1*d.darker:
+		return fmt.Sprintf("reference is %.3f %% darker", -100*d.luminanceDelta)
+	}
+	return fmt.Sprintf("reference is mixed: %.3f %% brighter, %.3f %% darker", 100*d.brighter, 100*d.darker)
+}
+
+// percentage maps the score to a percentage between 0 and 100
+func (d difference) percentage() float64 {
+	return float64(100*d.score-d.minValue) / (d.maxValue - d.minValue)
+}
+
+// readFloat parses `s` as floating point number between `min` and `max`
+func readFloat(s string, min, max float64) (float64, error) {
+	val, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || val < min || val > max {
+		return 0.0, fmt.Errorf("expected number between %g and %g; got '%s'", min, max, s)
+	}
+	return val, nil
+}
+
+// readWeights parses comma-separated channel weights like '0.3,0.6,0.1'
+// and renormalizes them to sum up to 3 (like the default '1,1,1')
+func readWeights(s string) ([3]float64, error) {
+	var weights [3]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return weights, fmt.Errorf("expected 3 comma-separated weights; got '%s'", s)
+	}
+	sum := 0.0
+	for i, part := range parts {
+		val, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || val < 0.0 {
+			return weights, fmt.Errorf("expected non-negative weight; got '%s'", part)
+		}
+		weights[i] = val
+		sum += val
+	}
+	if sum == 0.0 {
+		return weights, fmt.Errorf("expected at least one positive weight; got '%s'", s)
+	}
+	for i := range weights {
+		weights[i] *= 3 / sum
+	}
+	return weights, nil
+}
+
+// readChannelThreshold parses per-channel thresholds like 'r=5,g=2,b=5'.
+// Channels which are not given have threshold 0.
+func readChannelThreshold(s string) ([3]int, error) {
+	var thresholds [3]int
+	var given [3]bool
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		channel := strings.Index("rgb", strings.ToLower(strings.TrimSpace(kv[0])))
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) != 1 || channel < 0 {
+			return thresholds, fmt.Errorf("expected channel threshold like 'r=5'; got '%s'", part)
+		}
+		if given[channel] {
+			return thresholds, fmt.Errorf("channel '%s' given more than once in '%s'", kv[0], s)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || n < 0 || n > 255 {
+			return thresholds, fmt.Errorf("expected integer between 0 and 255 as channel threshold; got '%s'", kv[1])
+		}
+		thresholds[channel] = n
+		given[channel] = true
+	}
+	return thresholds, nil
+}
+
+// readToleranceSweep parses comma-separated tolerances like '0,0.05,0.1'
+// and sorts them in ascending order
+func readToleranceSweep(s string) ([]float64, error) {
+	var levels []float64
+	for _, part := range strings.Split(s, ",") {
+		val, err := readFloat(part, 0.0, 1.0)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, val)
+	}
+	sort.Float64s(levels)
+	return levels, nil
+}
+
+// readScaleFactors parses comma-separated downscaling factors like '2,4,8'
+func readScaleFactors(s string) ([]int, error) {
+	var factors []int
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 2 {
+			return nil, fmt.Errorf("expected comma-separated integers of at least 2; got '%s'", s)
+		}
+		factors = append(factors, n)
+	}
+	return factors, nil
+}
+
+// lumaChromaWeights returns the Y'UV weights for the luma weight `luma`
+// and the chroma weight `chroma` renormalized like readWeights.
+// Both chroma channels share the chroma weight.
+func lumaChromaWeights(luma, chroma float64) [3]float64 {
+	sum := luma + 2*chroma
+	if sum == 0.0 {
+		return [3]float64{}
+	}
+	return [3]float64{3 * luma / sum, 3 * chroma / sum, 3 * chroma / sum}
+}
+
+// readRegionPercent parses a region like '10%,20%,50%,50%' given
+// as x, y, width and height in percent of the image dimensions
+func readRegionPercent(s string) ([4]float64, error) {
+	var region [4]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return region, fmt.Errorf("expected region 'x%%,y%%,w%%,h%%'; got '%s'", s)
+	}
+	for n, part := range parts {
+		val, err := readFloat(strings.TrimSuffix(strings.TrimSpace(part), "%"), 0.0, 100.0)
+		if err != nil {
+			return region, err
+		}
+		region[n] = val
+	}
+	if region[0]+region[2] > 100.0 || region[1]+region[3] > 100.0 {
+		return region, fmt.Errorf("region '%s' exceeds the image", s)
+	}
+	return region, nil
+}
+
+// readRectangle parses a rectangle given as x, y, width and height
+// in pixels like '0,0,200,40'
+func readRectangle(s string) (image.Rectangle, error) {
+	var n [4]int
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("expected rectangle 'x,y,w,h'; got '%s'", s)
+	}
+	for i, part := range parts {
+		val, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || val < 0 {
+			return image.Rectangle{}, fmt.Errorf("expected non-negative integers in rectangle; got '%s'", s)
+		}
+		n[i] = val
+	}
+	r := image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3])
+	if r.Empty() {
+		return r, fmt.Errorf("rectangle '%s' is empty", s)
+	}
+	return r, nil
+}
+
+// readPoint parses a pixel position like '10,20'
+func readPoint(s string) (image.Point, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return image.Point{}, fmt.Errorf("expected position 'x,y'; got '%s'", s)
+	}
+	x, errX := strconv.Atoi(strings.TrimSpace(parts[0]))
+	y, errY := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if errX != nil || errY != nil || x < 0 || y < 0 {
+		return image.Point{}, fmt.Errorf("expected non-negative integers in position; got '%s'", s)
+	}
+	return image.Pt(x, y), nil
+}
+
+// readByteSize parses a positive number of bytes like '512M' with
+// an optional suffix K, M or G (powers of 1024)
+func readByteSize(s string) (int64, error) {
+	spec := strings.ToUpper(strings.TrimSpace(s))
+	factor := int64(1)
+	if spec != "" {
+		switch spec[len(spec)-1] {
+		case 'K':
+			factor = 1 << 10
+		case 'M':
+			factor = 1 << 20
+		case 'G':
+			factor = 1 << 30
+		}
+		if factor > 1 {
+			spec = spec[:len(spec)-1]
+		}
+	}
+	n, err := strconv.ParseInt(spec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("expected positive number of bytes like '512M'; got '%s'", s)
+	}
+	return n * factor, nil
+}
+
+// readHexColor parses a hexadecimal color specifier like 'FF8000'
+func readHexColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	val, err := strconv.ParseUint(s, 16, 32)
+	if err != nil || len(s) != 6 {
+		return color.NRGBA{}, fmt.Errorf("expected hexadecimal color like 'FF8000'; got '%s'", s)
+	}
+	return color.NRGBA{uint8(val >> 16), uint8(val >> 8), uint8(val), 255}, nil
 }
 
 // readDurationSpecifier takes a human-readable duration specifier
@@ -160,60 +1432,1300 @@ func parseArguments(s *Settings, args []string) error {
 					return err
 				}
 				s.Wait = dur
-			}
-			key = ""
-		} else if len(a) > 2 && a[0:2] == "--" {
-			key = strings.ToLower(strings.TrimSpace(a[2:]))
-			if key != "colors" && key != "wait" && key != "timeout" {
-				return fmt.Errorf("unknown argument '%s'", a)
-			}
-		} else if s.BaseImg == "" {
-			s.BaseImg = a
-		} else if s.RefImg == "" {
-			s.RefImg = a
-		} else {
-			return fmt.Errorf("unknown positional argument '%s'", a)
-		}
-	}
-
-	if s.RefImg == "" {
-		count := 0
-		if s.BaseImg != "" {
-			count++
-		}
-		return fmt.Errorf("expected 2 positional arguments; baseimage and reference image; got %d", count)
-	}
-
-	if s.ColorSpace != "Y'UV" && s.ColorSpace != "RGB" {
-		return fmt.Errorf("unknown color space '%s'", s.ColorSpace)
-	}
-
-	return nil
-}
-
-// readImageMetadata reads metadata about the image like width, height and the format
-func readImageMetadata(filepath string, i *img) error {
-	reader, err := os.Open(filepath)
-	if err != nil {
-		return err
-	}
-	defer reader.Close()
-	decoded, format, err := image.Decode(reader)
-	if err != nil {
-		return err
-	}
-
-	// width & height
-	i.w = decoded.Bounds().Max.X
-	i.h = decoded.Bounds().Max.Y
-	i.i = decoded
-	i.f = format
-
-	return nil
-}
-
-// toNRGBA converts a RGBA color to un-alpha-scaled NRGBA
-// based on https://golang.org/src/image/color/color.go?s=4600:4767
+			case "decode-timeout":
+				dur, err := readDurationSpecifier(a)
+				if err != nil {
+					return err
+				}
+				s.DecodeTimeout = dur
+			case "settle":
+				dur, err := readDurationSpecifier(a)
+				if err != nil {
+					return err
+				}
+				s.Settle = dur
+			case "compare-mode":
+				s.CompareMode = a
+			case "metric":
+				s.Metric = strings.ToLower(strings.TrimSpace(a))
+			case "base-alpha":
+				s.BaseAlpha = strings.ToLower(strings.TrimSpace(a))
+			case "dimension-policy":
+				s.DimensionPolicy = strings.ToLower(strings.TrimSpace(a))
+			case "format":
+				s.Format = strings.ToLower(strings.TrimSpace(a))
+			case "convert":
+				s.ConvertOut = a
+			case "triage-out":
+				s.TriageOut = a
+			case "mask-out":
+				s.MaskOut = a
+			case "save-normalized":
+				s.SaveNormalized = a
+			case "cycle-gif":
+				s.CycleGIF = a
+			case "cycle-delay":
+				dur, err := readDurationSpecifier(a)
+				if err != nil {
+					return err
+				}
+				s.CycleDelay = dur
+			case "base-dir":
+				s.BaseDir = a
+			case "ref-dir":
+				s.RefDir = a
+			case "batch":
+				s.Batch = a
+			case "snapshot-dir":
+				s.SnapshotDir = a
+			case "align-window":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 0 || n > maxAlignWindow {
+					return fmt.Errorf("expected integer between 0 and %d for align-window; got '%s'", maxAlignWindow, a)
+				}
+				s.AlignWindow = n
+			case "vscroll-search":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 0 || n > maxVScrollSearch {
+					return fmt.Errorf("expected integer between 0 and %d for vscroll-search; got '%s'", maxVScrollSearch, a)
+				}
+				s.VScrollSearch = n
+			case "overlay":
+				s.Overlay = a
+			case "inspect":
+				p, err := readPoint(a)
+				if err != nil {
+					return err
+				}
+				s.Inspect = &p
+			case "padding":
+				s.Padding = strings.ToLower(strings.TrimSpace(a))
+			case "crop-origin":
+				s.CropOrigin = strings.ToLower(strings.TrimSpace(a))
+			case "rotate-ref":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if _, ok := rotations[n]; err != nil || !ok {
+					return fmt.Errorf("expected 90, 180 or 270 for rotate-ref; got '%s'", a)
+				}
+				s.RotateRef = n
+			case "cell-size":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 1 {
+					return fmt.Errorf("expected positive integer for cell-size; got '%s'", a)
+				}
+				s.CellSize = n
+			case "text-block-size":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 1 {
+					return fmt.Errorf("expected positive integer for text-block-size; got '%s'", a)
+				}
+				s.TextBlockSize = n
+			case "coarse-factor":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 2 {
+					return fmt.Errorf("expected integer of at least 2 for coarse-factor; got '%s'", a)
+				}
+				s.CoarseFactor = n
+			case "load-error-code":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 0 || n > 255 {
+					return fmt.Errorf("expected integer between 0 and 255 for load-error-code; got '%s'", a)
+				}
+				s.LoadErrorCode = &n
+			case "max-workers":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 1 {
+					return fmt.Errorf("expected integer of at least 1 for max-workers; got '%s'", a)
+				}
+				s.MaxWorkers = n
+			case "ref-color":
+				c, err := readHexColor(a)
+				if err != nil {
+					return err
+				}
+				s.RefColor = &c
+			case "exclude":
+				r, err := readRectangle(a)
+				if err != nil {
+					return err
+				}
+				s.Exclude = append(s.Exclude, r)
+			case "base-region", "ref-region":
+				r, err := readRectangle(a)
+				if err != nil {
+					return err
+				}
+				if key == "base-region" {
+					s.BaseRegion = &r
+				} else {
+					s.RefRegion = &r
+				}
+			case "base-b64", "ref-b64":
+				data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(a))
+				if err != nil {
+					return fmt.Errorf("invalid base64 data for --%s: %s", key, err.Error())
+				}
+				if key == "base-b64" {
+					s.BaseB64 = data
+				} else {
+					s.RefB64 = data
+				}
+			case "key-color":
+				c, err := readHexColor(a)
+				if err != nil {
+					return err
+				}
+				s.KeyColor = &c
+			case "limit-memory":
+				n, err := readByteSize(a)
+				if err != nil {
+					return err
+				}
+				s.LimitMemory = n
+			case "phash-cutoff":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 0 || n > 64 {
+					return fmt.Errorf("expected integer between 0 and 64 for phash-cutoff; got '%s'", a)
+				}
+				s.PHashCutoff = n
+			case "cache-size":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 0 {
+					return fmt.Errorf("expected non-negative integer for cache size; got '%s'", a)
+				}
+				s.CacheSize = n
+			case "precision":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 0 || n > 15 {
+					return fmt.Errorf("expected integer between 0 and 15 for precision; got '%s'", a)
+				}
+				s.Precision = n
+			case "region-percent":
+				region, err := readRegionPercent(a)
+				if err != nil {
+					return err
+				}
+				s.RegionPercent = &region
+			case "stats-out":
+				s.StatsOut = a
+			case "result-file":
+				s.ResultFile = a
+			case "state-file":
+				s.StateFile = a
+			case "ref":
+				s.Refs = append(s.Refs, a)
+			case "svg-report":
+				s.SVGReport = a
+			case "render-scale":
+				factors, err := readScaleFactors(a)
+				if err != nil {
+					return err
+				}
+				s.RenderScales = factors
+			case "tolerance-sweep":
+				levels, err := readToleranceSweep(a)
+				if err != nil {
+					return err
+				}
+				s.ToleranceSweep = levels
+			case "ignore-right", "ignore-bottom":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 0 {
+					return fmt.Errorf("expected non-negative integer for %s; got '%s'", key, a)
+				}
+				if key == "ignore-right" {
+					s.IgnoreRight = n
+				} else {
+					s.IgnoreBottom = n
+				}
+			case "min-region-size":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 0 {
+					return fmt.Errorf("expected non-negative integer for min-region-size; got '%s'", a)
+				}
+				s.MinRegionSize = n
+			case "key-tolerance":
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil || n < 0 || n > 255 {
+					return fmt.Errorf("expected integer between 0 and 255 for key-tolerance; got '%s'", a)
+				}
+				s.KeyTolerance = n
+			case "center-weight":
+				s.CenterWeight = strings.ToLower(strings.TrimSpace(a))
+			case "edge-downweight":
+				val, err := readFloat(a, 0.0, 1.0)
+				if err != nil {
+					return err
+				}
+				s.EdgeDownweight = &val
+			case "sample":
+				val, err := readFloat(a, 0.0, 1.0)
+				if err != nil || val == 0.0 {
+					return fmt.Errorf("expected fraction between 0 (exclusive) and 1 for sample; got '%s'", a)
+				}
+				s.Sample = val
+			case "threshold":
+				val, err := readFloat(a, 0.0, 100.0)
+				if err != nil {
+					return err
+				}
+				s.Threshold = val
+			case "template":
+				if _, err := template.New("result").Parse(a); err != nil {
+					return err
+				}
+				s.Template = a
+			case "luma-weight":
+				val, err := readFloat(a, 0.0, math.MaxFloat64)
+				if err != nil {
+					return err
+				}
+				s.LumaWeight = val
+				s.Weights = lumaChromaWeights(s.LumaWeight, s.ChromaWeight)
+			case "chroma-weight":
+				val, err := readFloat(a, 0.0, math.MaxFloat64)
+				if err != nil {
+					return err
+				}
+				s.ChromaWeight = val
+				s.Weights = lumaChromaWeights(s.LumaWeight, s.ChromaWeight)
+			case "ssim-chroma-weight":
+				val, err := readFloat(a, 0.0, 1.0)
+				if err != nil {
+					return err
+				}
+				s.SSIMChromaWeight = &val
+			case "weights":
+				weights, err := readWeights(a)
+				if err != nil {
+					return err
+				}
+				s.Weights = weights
+			case "tolerance":
+				val, err := readFloat(a, 0.0, 1.0)
+				if err != nil {
+					return err
+				}
+				s.Tolerance = val
+			case "channel-threshold":
+				thresholds, err := readChannelThreshold(a)
+				if err != nil {
+					return err
+				}
+				s.ChannelThreshold = &thresholds
+			}
+			key = ""
+		} else if len(a) > 2 && a[0:2] == "--" {
+			key = strings.ToLower(strings.TrimSpace(a[2:]))
+			switch key {
+			case "colors", "wait", "settle", "timeout", "decode-timeout", "tolerance", "compare-mode", "weights",
+				"convert", "triage-out", "batch", "template", "threshold",
+				"ref-color", "max-workers", "snapshot-dir", "load-error-code",
+				"coarse-factor", "key-color", "key-tolerance", "format", "min-region-size",
+				"tolerance-sweep", "render-scale", "svg-report",
+				"precision", "base-dir", "ref-dir", "luma-weight", "chroma-weight",
+				"region-percent", "text-block-size", "base-alpha",
+				"metric", "align-window", "sample", "stats-out",
+				"edge-downweight", "dimension-policy", "cache-size",
+				"exclude", "base-b64", "ref-b64", "result-file", "state-file",
+				"ref", "vscroll-search", "channel-threshold",
+				"base-region", "ref-region", "limit-memory", "cell-size", "mask-out", "save-normalized", "rotate-ref",
+				"ignore-right", "ignore-bottom", "ssim-chroma-weight", "inspect",
+				"padding", "crop-origin", "phash-cutoff", "center-weight",
+				"cycle-gif", "cycle-delay",
+				"overlay":
+			case "print-hashes":
+				s.PrintHashes = true
+				key = ""
+			case "list-colorspaces":
+				s.ListColorSpaces = true
+				key = ""
+			case "assume-srgb":
+				s.RespectICC = false
+				key = ""
+			case "respect-icc":
+				s.RespectICC = true
+				key = ""
+			case "fail-fast":
+				s.FailFast = true
+				key = ""
+			case "skip-unchanged":
+				s.SkipUnchanged = true
+				key = ""
+			case "compare-alpha":
+				s.CompareAlpha = true
+				key = ""
+			case "compare-only-opaque-intersection":
+				s.OpaqueIntersection = true
+				key = ""
+			case "alpha-as-mask":
+				s.AlphaAsMask = true
+				key = ""
+			case "auto-tolerance":
+				s.AutoTolerance = true
+				key = ""
+			case "annotate":
+				s.Annotate = true
+				key = ""
+			case "warn-only":
+				s.WarnOnly = true
+				key = ""
+			case "expect-different":
+				s.ExpectDifferent = true
+				key = ""
+			case "subpixel-tolerant":
+				s.SubpixelTolerant = true
+				key = ""
+			case "compare-text-regions":
+				s.TextRegions = true
+				key = ""
+			case "compare-saturation-only":
+				s.SaturationOnly = true
+				key = ""
+			case "adaptive-downscale":
+				s.AdaptiveDownscale = true
+				key = ""
+			case "deterministic":
+				s.Deterministic = true
+				key = ""
+			case "png-regions":
+				s.PNGRegions = true
+				key = ""
+			case "quadrants":
+				s.Quadrants = true
+				key = ""
+			case "detect-shift":
+				s.DetectShift = true
+				key = ""
+			case "raw-score":
+				s.RawScore = true
+				key = ""
+			case "similarity-matrix":
+				s.SimMatrix = true
+				key = ""
+			case "crop-to-ref":
+				s.CropToRef = true
+				key = ""
+			case "verbose-timing":
+				s.VerboseTiming = true
+				key = ""
+			case "report-compression-artifacts":
+				s.ReportArtifacts = true
+				key = ""
+			case "max-channel-difference":
+				s.MaxChannelDiff = true
+				key = ""
+			case "strict-decode":
+				s.StrictDecode = true
+				key = ""
+			case "equalize":
+				s.Equalize = true
+				key = ""
+			case "two-pass":
+				s.TwoPass = true
+				key = ""
+			case "correct-alpha-blend":
+				s.CorrectBlend = true
+				key = ""
+			case "respect-exif-orientation":
+				s.RespectEXIF = true
+				key = ""
+			default:
+				return fmt.Errorf("unknown argument '%s'", a)
+			}
+		} else if s.BaseImg == "" {
+			s.BaseImg = a
+		} else if s.RefImg == "" {
+			s.RefImg = a
+		} else {
+			s.MatrixImgs = append(s.MatrixImgs, a)
+		}
+	}
+	if len(s.MatrixImgs) > 0 && !s.SimMatrix {
+		return fmt.Errorf("unknown positional argument '%s'", s.MatrixImgs[0])
+	}
+
+	if s.ListColorSpaces {
+		if s.BaseImg != "" {
+			return fmt.Errorf("unknown positional argument '%s'; --list-colorspaces expects none", s.BaseImg)
+		}
+		return nil
+	}
+
+	if s.StateFile != "" && s.Batch == "" && s.BaseDir == "" {
+		return fmt.Errorf("a state file is only available in batch mode")
+	}
+	if s.SkipUnchanged && s.StateFile == "" {
+		return fmt.Errorf("--skip-unchanged requires --state-file")
+	}
+	if (s.Batch != "" || s.BaseDir != "") && s.ResultFile != "" {
+		return fmt.Errorf("a result file is not available in batch mode")
+	}
+	if (s.Batch != "" || s.BaseDir != "") && s.Format == "xml" {
+		return fmt.Errorf("XML output is not available in batch mode")
+	}
+	if (s.Batch != "" || s.BaseDir != "") && s.WarnOnly {
+		return fmt.Errorf("--warn-only is not available in batch mode")
+	}
+	if (s.Batch != "" || s.BaseDir != "" || s.SimMatrix) && s.ExpectDifferent {
+		return fmt.Errorf("--expect-different is not available in batch mode")
+	}
+	if s.ExpectDifferent && s.WarnOnly {
+		return fmt.Errorf("--expect-different and --warn-only are mutually exclusive")
+	}
+	if (s.Batch != "" || s.BaseDir != "") && s.Inspect != nil {
+		return fmt.Errorf("--inspect is not available in batch mode")
+	}
+	if (s.Batch != "" || s.BaseDir != "") && s.SaveNormalized != "" {
+		return fmt.Errorf("--save-normalized is not available in batch mode")
+	}
+	if (s.Batch != "" || s.BaseDir != "") && s.Refs != nil {
+		return fmt.Errorf("averaged references are not available in batch mode")
+	}
+
+	if s.SimMatrix {
+		if s.Batch != "" || s.BaseDir != "" || s.SnapshotDir != "" || s.Refs != nil || s.BaseB64 != nil ||
+			s.RefB64 != nil || s.RefColor != nil || s.ConvertOut != "" {
+			return fmt.Errorf("--similarity-matrix compares the positional images only")
+		}
+		if s.RefImg == "" {
+			return fmt.Errorf("expected at least 2 positional arguments for --similarity-matrix")
+		}
+		if s.TriageOut != "" || s.MaskOut != "" || s.CycleGIF != "" || s.SaveNormalized != "" ||
+			s.ResultFile != "" || s.Inspect != nil || s.Format == "xml" {
+			return fmt.Errorf("outputs of a single comparison are not available with --similarity-matrix")
+		}
+		s.MatrixImgs = append([]string{s.BaseImg, s.RefImg}, s.MatrixImgs...)
+		return validateSettings(s)
+	}
+	if s.PHashCutoff != 64 {
+		return fmt.Errorf("--phash-cutoff requires --similarity-matrix")
+	}
+
+	if s.Batch != "" {
+		if s.BaseImg != "" {
+			return fmt.Errorf("unknown positional argument '%s'; batch mode reads filepaths from the manifest", s.BaseImg)
+		}
+		return validateSettings(s)
+	}
+
+	if s.BaseDir != "" || s.RefDir != "" {
+		if s.BaseDir == "" || s.RefDir == "" {
+			return fmt.Errorf("expected both --base-dir and --ref-dir")
+		}
+		if s.BaseImg != "" {
+			return fmt.Errorf("unknown positional argument '%s'; directory mode pairs the files of the directories", s.BaseImg)
+		}
+		return validateSettings(s)
+	}
+
+	if s.ConvertOut != "" {
+		if s.BaseImg == "" || s.RefImg != "" {
+			return fmt.Errorf("expected 1 positional argument for conversion; the input image")
+		}
+		return nil
+	}
+
+	if s.SnapshotDir != "" {
+		if s.BaseImg == "" || s.RefImg != "" {
+			return fmt.Errorf("expected 1 positional argument for snapshot mode; the base image")
+		}
+		s.RefImg = filepath.Join(s.SnapshotDir, filepath.Base(s.BaseImg))
+		return validateSettings(s)
+	}
+
+	if s.Refs != nil {
+		if s.BaseImg == "" || s.RefImg != "" || s.RefColor != nil || s.RefB64 != nil {
+			return fmt.Errorf("expected 1 positional argument for references given by --ref; the base image")
+		}
+		return validateSettings(s)
+	}
+
+	if s.BaseB64 != nil || s.RefB64 != nil {
+		if s.BaseB64 == nil || s.RefB64 == nil || s.BaseImg != "" {
+			return fmt.Errorf("expected both --base-b64 and --ref-b64 without positional arguments")
+		}
+		return validateSettings(s)
+	}
+
+	if s.RefColor != nil {
+		if s.BaseImg == "" || s.RefImg != "" {
+			return fmt.Errorf("expected 1 positional argument for a reference color; the base image")
+		}
+		return validateSettings(s)
+	}
+
+	if s.RefImg == "" {
+		count := 0
+		if s.BaseImg != "" {
+			count++
+		}
+		return fmt.Errorf("expected 2 positional arguments; baseimage and reference image; got %d", count)
+	}
+
+	return validateSettings(s)
+}
+
+// validateSettings checks the values of `s` which are not validated on parsing
+func validateSettings(s *Settings) error {
+	if _, ok := findColorSpace(s.ColorSpace); !ok {
+		return fmt.Errorf("unknown color space '%s'", s.ColorSpace)
+	}
+
+	if s.LumaWeight != 1.0 || s.ChromaWeight != 1.0 {
+		if s.ColorSpace != "Y'UV" {
+			return fmt.Errorf("luma and chroma weights require color space \"Y'UV\"; got '%s'", s.ColorSpace)
+		}
+		if s.LumaWeight == 0.0 && s.ChromaWeight == 0.0 {
+			return fmt.Errorf("expected a positive luma or chroma weight")
+		}
+	}
+
+	if s.CompareAlpha && s.ColorSpace != "RGB" {
+		return fmt.Errorf("comparing the alpha channel requires color space 'RGB'; got '%s'", s.ColorSpace)
+	}
+
+	if s.CompareAlpha && s.CorrectBlend {
+		return fmt.Errorf("comparing the alpha channel and alpha blending are mutually exclusive")
+	}
+
+	if s.OpaqueIntersection && s.CorrectBlend {
+		return fmt.Errorf("comparing the opaque intersection and alpha blending are mutually exclusive")
+	}
+
+	if s.Annotate && s.TriageOut == "" && s.SnapshotDir == "" {
+		return fmt.Errorf("--annotate requires --triage-out or --snapshot-dir")
+	}
+
+	if (s.BaseRegion == nil) != (s.RefRegion == nil) {
+		return fmt.Errorf("expected both --base-region and --ref-region")
+	}
+	if s.BaseRegion != nil {
+		if s.BaseRegion.Size() != s.RefRegion.Size() {
+			return fmt.Errorf("base region %v and reference region %v differ in dimensions", *s.BaseRegion, *s.RefRegion)
+		}
+		if s.RegionPercent != nil {
+			return fmt.Errorf("--region-percent and --base-region/--ref-region are mutually exclusive")
+		}
+		if s.RotateRef != 0 {
+			return fmt.Errorf("--rotate-ref and --base-region/--ref-region are mutually exclusive")
+		}
+		if s.CropToRef {
+			return fmt.Errorf("--crop-to-ref and --base-region/--ref-region are mutually exclusive")
+		}
+	}
+	if s.CropOrigin != "" && !s.CropToRef {
+		return fmt.Errorf("--crop-origin requires --crop-to-ref")
+	}
+	if s.CropToRef && s.DimensionPolicy != "error" {
+		return fmt.Errorf("--crop-to-ref and --dimension-policy are mutually exclusive")
+	}
+
+	if s.AutoTolerance && s.Tolerance != 0.0 {
+		return fmt.Errorf("--auto-tolerance and --tolerance are mutually exclusive")
+	}
+
+	if s.SubpixelTolerant && s.CorrectBlend {
+		return fmt.Errorf("subpixel tolerance and alpha blending are mutually exclusive")
+	}
+
+	if s.AlphaAsMask && s.CompareAlpha {
+		return fmt.Errorf("comparing the alpha channel and using it as mask are mutually exclusive")
+	}
+
+	if s.AlignWindow > 0 && s.VScrollSearch > 0 {
+		return fmt.Errorf("alignment and vertical scroll search are mutually exclusive")
+	}
+
+	if s.Exclude != nil && (s.AlignWindow > 0 || s.VScrollSearch > 0 || s.Metric != "pixel" || s.TextRegions) {
+		return fmt.Errorf("excluded rectangles require the pixel metric without alignment")
+	}
+
+	if s.MaskOut != "" && (s.Metric != "pixel" || s.Sample < 1.0 || s.TextRegions || s.TwoPass) {
+		return fmt.Errorf("the changed mask requires the pixel metric without sampling or two passes")
+	}
+
+	if s.CenterWeight != "" && (s.Metric != "pixel" || s.Sample < 1.0 || s.TextRegions) {
+		return fmt.Errorf("--center-weight requires the pixel metric without sampling or text regions")
+	}
+	if s.CycleGIF != "" && (s.Metric != "pixel" || s.Sample < 1.0 || s.TextRegions) {
+		return fmt.Errorf("the cycle GIF requires the pixel metric without sampling")
+	}
+
+	if s.CycleDelay <= time.Duration(0) {
+		return fmt.Errorf("the cycle delay must be positive")
+	}
+
+	if s.AdaptiveDownscale && s.Timeout <= time.Duration(0) {
+		return fmt.Errorf("adaptive downscaling requires a timeout")
+	}
+
+	if s.CompareMode != "full" && s.CompareMode != "fast-equal" {
+		return fmt.Errorf("unknown compare mode '%s'", s.CompareMode)
+	}
+
+	if s.Metric != "pixel" && s.Metric != "fft" && s.Metric != "ms-ssim" && s.Metric != "hog" && s.Metric != "ssim-color" &&
+		s.Metric != "delta-e-2000-jnd" {
+		return fmt.Errorf("unknown metric '%s'", s.Metric)
+	}
+
+	if s.Padding != "" && !isPaddingMode(s.Padding) {
+		return fmt.Errorf("unknown padding mode '%s'", s.Padding)
+	}
+	if _, ok := cropOrigins[s.CropOrigin]; s.CropOrigin != "" && !ok {
+		return fmt.Errorf("unknown crop origin '%s'", s.CropOrigin)
+	}
+	if _, ok := centerFalloffs[s.CenterWeight]; s.CenterWeight != "" && !ok {
+		return fmt.Errorf("unknown center weight falloff '%s'", s.CenterWeight)
+	}
+
+	if s.BaseAlpha != "ignore" && s.BaseAlpha != "weight" && s.BaseAlpha != "error" {
+		return fmt.Errorf("unknown base alpha handling '%s'", s.BaseAlpha)
+	}
+	if s.DimensionPolicy != "error" && s.DimensionPolicy != "scale-down" {
+		return fmt.Errorf("unknown dimension policy '%s'", s.DimensionPolicy)
+	}
+
+	if s.Format != "text" && s.Format != "json" && s.Format != "xml" {
+		return fmt.Errorf("unknown output format '%s'", s.Format)
+	}
+
+	return nil
+}
+
+// loadError is returned if an image file cannot be read or decoded
+type loadError struct {
+	filepath string
+	err      error
+}
+
+func (e *loadError) Error() string {
+	return fmt.Sprintf("cannot load '%s': %s", e.filepath, e.err.Error())
+}
+
+// pipeError reports a named pipe which did not deliver a complete image
+// before its writer closed it
+type pipeError struct {
+	filepath string
+	err      error
+}
+
+func (e *pipeError) Error() string {
+	return fmt.Sprintf("named pipe '%s' delivered no complete image: %s", e.filepath, e.err.Error())
+}
+
+// stopError reports a comparison which stopped before its completion,
+// because the budget `limit` of its `phase` passed (return code 102)
+// or the program was interrupted (return code 130)
+type stopError struct {
+	code  int
+	limit time.Duration
+	phase string
+}
+
+func (e *stopError) Error() string {
+	msg := fmt.Sprintf("timed out within %s", e.limit)
+	if e.code == 130 {
+		msg = "interrupted"
+	}
+	if e.phase != "" {
+		msg += fmt.Sprintf(" (phase: %s)", e.phase)
+	}
+	return msg
+}
+
+// errorCode determines the return code for a failed comparison
+func errorCode(s *Settings, err error) int {
+	switch e := err.(type) {
+	case *stopError:
+		return e.code
+	case *loadError:
+		if s.LoadErrorCode != nil {
+			return *s.LoadErrorCode
+		}
+	case *pipeError:
+		return 102
+	}
+	return 101
+}
+
+// isNamedPipe returns whether `f` is a named pipe (FIFO)
+func isNamedPipe(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// readImageMetadata reads metadata about the image like width, height and the format
+func readImageMetadata(filepath string, i *img) error {
+	reader, err := os.Open(filepath)
+	if err != nil {
+		return &loadError{filepath, err}
+	}
+	defer reader.Close()
+	// a named pipe is read until its writer closes it
+	pipe := isNamedPipe(reader)
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return &loadError{filepath, err}
+	}
+	err = decodeImage(data, i)
+	if err == nil && pipe && i.truncated {
+		err = fmt.Errorf("%s image ends prematurely", i.f)
+	}
+	if err != nil {
+		if pipe {
+			return &pipeError{filepath, err}
+		}
+		return &loadError{filepath, err}
+	}
+	return nil
+}
+
+// bytesPerPixel estimates the memory of a decoded pixel of color model `m`
+func bytesPerPixel(m color.Model) int64 {
+	switch m {
+	case color.GrayModel, color.AlphaModel:
+		return 1
+	case color.Gray16Model, color.Alpha16Model:
+		return 2
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	return 4
+}
+
+// imageConfig reads the dimensions and the color model of the image
+// at `filepath` or of the encoded image `data` if `data` is non-nil
+// from its header without decoding the pixels
+func imageConfig(filepath string, data []byte) (image.Config, error) {
+	if data != nil {
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		return config, err
+	}
+	reader, err := os.Open(filepath)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer reader.Close()
+	config, _, err := image.DecodeConfig(reader)
+	return config, err
+}
+
+// preflight reads the headers of the base and the reference image given
+// in Settings and rejects images exceeding the memory limit or of
+// different dimensions before any image is decoded. Named pipes and
+// unreadable headers are left to decoding.
+func preflight(s *Settings) error {
+	if s.LimitMemory == 0 && s.DimensionPolicy != "error" {
+		return nil
+	}
+	names := []string{s.BaseImg}
+	data := [][]byte{s.BaseB64}
+	if s.BaseB64 != nil {
+		names[0] = "--base-b64"
+	}
+	switch {
+	case s.RefB64 != nil:
+		names, data = append(names, "--ref-b64"), append(data, s.RefB64)
+	case s.RefColor == nil && s.Refs == nil:
+		names, data = append(names, s.RefImg), append(data, nil)
+	}
+
+	var configs []image.Config
+	for n, name := range names {
+		if data[n] == nil {
+			if info, err := os.Stat(name); err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+		}
+		config, err := imageConfig(name, data[n])
+		if err != nil {
+			// decoding reports the error
+			return nil
+		}
+		size := int64(config.Width) * int64(config.Height) * bytesPerPixel(config.ColorModel)
+		if s.LimitMemory > 0 && size > s.LimitMemory {
+			msg := "decoding %d×%d pixels needs about %d bytes which exceeds the memory limit of %d bytes"
+			return &loadError{name, fmt.Errorf(msg, config.Width, config.Height, size, s.LimitMemory)}
+		}
+		configs = append(configs, config)
+	}
+
+	// orientation and regions change the dimensions after decoding,
+	// a reference which did not settle yet might change as well
+	if len(configs) == 2 && s.DimensionPolicy == "error" && !s.RespectEXIF && s.BaseRegion == nil && !s.CropToRef &&
+		s.RotateRef%180 == 0 && s.Settle <= time.Duration(0) {
+		base, ref := configs[0], configs[1]
+		if base.Width != ref.Width || base.Height != ref.Height {
+			msg := "image dimensions do not correspond; got %d×%d (base) and %d×%d (ref)"
+			return fmt.Errorf(msg, base.Width, base.Height, ref.Width, ref.Height)
+		}
+	}
+	return nil
+}
+
+// decodeImage decodes the encoded image `data` and its metadata
+func decodeImage(data []byte, i *img) error {
+	decoded, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	*i = *imgFromImage(decoded)
+	i.f = format
+	i.mono = toMonoBitmap(decoded)
+	i.icc = hasICCProfile(data, format)
+	i.orientation = exifOrientation(data, format)
+	i.text = pngText(data, format)
+	i.truncated = !completelyEncoded(data, format)
+
+	return nil
+}
+
+// readBase reads the base image given in Settings as file or base64 data
+func readBase(s *Settings, cache *decodeCache, baseImg *img) error {
+	if s.BaseB64 != nil {
+		if err := decodeImage(s.BaseB64, baseImg); err != nil {
+			return &loadError{"--base-b64", err}
+		}
+		return nil
+	}
+	return cache.read(s.BaseImg, baseImg)
+}
+
+// imgFromImage wraps an image already in memory
+func imgFromImage(i image.Image) *img {
+	// width & height
+	return &img{i: i, w: i.Bounds().Max.X, h: i.Bounds().Max.Y}
+}
+
+// solidImage returns a `w`×`h` image filled uniformly with color `c`
+func solidImage(w, h int, c color.NRGBA) *img {
+	i := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(i, i.Bounds(), image.NewUniform(c), image.ZP, draw.Src)
+	return imgFromImage(i)
+}
+
+// readReference reads the reference image given in Settings or
+// synthesizes it from the reference color for base image `baseImg`
+func readReference(s *Settings, cache *decodeCache, baseImg, refImg *img) error {
+	if s.RefColor != nil {
+		*refImg = *solidImage(baseImg.w, baseImg.h, *s.RefColor)
+		return nil
+	}
+	if s.Refs != nil {
+		return averageReferences(s.Refs, cache, refImg)
+	}
+	if s.RefB64 != nil {
+		if err := decodeImage(s.RefB64, refImg); err != nil {
+			return &loadError{"--ref-b64", err}
+		}
+		return nil
+	}
+	if s.Settle <= time.Duration(0) {
+		return cache.read(s.RefImg, refImg)
+	}
+	return readSettledImage(s.RefImg, s.Settle, s.DecodeTimeout, s.stop, refImg)
+}
+
+// readImages reads the base and the reference image given in Settings.
+// Both are decoded concurrently unless the reference depends on the base
+// image. If both fail, the error of the base image is returned.
+func readImages(s *Settings, cache *decodeCache, baseImg, refImg *img) error {
+	if err := preflight(s); err != nil {
+		return err
+	}
+	if s.RefColor != nil {
+		if err := readBase(s, cache, baseImg); err != nil {
+			return err
+		}
+		return readReference(s, cache, baseImg, refImg)
+	}
+
+	refErr := make(chan error, 1)
+	go func() {
+		refErr <- readReference(s, cache, baseImg, refImg)
+	}()
+	baseErr := readBase(s, cache, baseImg)
+	if err := <-refErr; baseErr == nil {
+		return err
+	}
+	return baseErr
+}
+
+// readImagesWithin reads the base image and the reference image like
+// readImages, but gives up once the DecodeTimeout given in Settings passes
+// or the comparison is stopped. A read blocking beyond, e.g. of a named
+// pipe, is abandoned.
+func readImagesWithin(s *Settings, cache *decodeCache, baseImg, refImg *img) error {
+	if s.DecodeTimeout <= time.Duration(0) && s.stop == nil {
+		return readImages(s, cache, baseImg, refImg)
+	}
+	// an abandoned read must not write to the images of the caller
+	var base, ref img
+	errs := make(chan error, 1)
+	go func() {
+		errs <- readImages(s, cache, &base, &ref)
+	}()
+	var expired <-chan time.Time
+	if s.DecodeTimeout > time.Duration(0) {
+		timer := time.NewTimer(s.DecodeTimeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-errs:
+		*baseImg, *refImg = base, ref
+		return err
+	case <-expired:
+		return &stopError{102, s.DecodeTimeout, "decoding"}
+	case <-s.stop.channel():
+		return s.stop.stopped()
+	}
+}
+
+// averageReferences reads the images at `filepaths` of the same dimensions
+// and stores their per-pixel average in `refImg`
+func averageReferences(filepaths []string, cache *decodeCache, refImg *img) error {
+	var refs []img
+	for _, path := range filepaths {
+		var ref img
+		if err := cache.read(path, &ref); err != nil {
+			return err
+		}
+		if len(refs) > 0 && (ref.w != refs[0].w || ref.h != refs[0].h) {
+			msg := "reference dimensions do not correspond; got %d×%d (%s) and %d×%d (%s)"
+			return fmt.Errorf(msg, refs[0].w, refs[0].h, filepaths[0], ref.w, ref.h, path)
+		}
+		refs = append(refs, ref)
+	}
+
+	first := refs[0]
+	avg := image.NewRGBA64(image.Rect(0, 0, first.w, first.h))
+	n := uint64(len(refs))
+	for y := 0; y < first.h; y++ {
+		for x := 0; x < first.w; x++ {
+			var r, g, b, a uint64
+			for _, ref := range refs {
+				// premultiplied values average correctly
+				cr, cg, cb, ca := ref.i.At(x, y).RGBA()
+				r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+			}
+			avg.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+
+	*refImg = *imgFromImage(avg)
+	refImg.f = first.f
+	refImg.orientation = first.orientation
+	for _, ref := range refs {
+		refImg.icc = refImg.icc || ref.icc
+		refImg.truncated = refImg.truncated || ref.truncated
+	}
+	return nil
+}
+
+// readSettledImage reads the image at `filepath` like readImageMetadata.
+// If `settle` is positive, it re-reads the image in intervals of `settle`
+// until two consecutive reads have identical pixels. It fails with a
+// timeout if the image does not settle within a positive `limit` and
+// stops with `stop`.
+func readSettledImage(filepath string, settle, limit time.Duration, stop *stopSignal, i *img) error {
+	if err := readImageMetadata(filepath, i); err != nil {
+		return err
+	}
+	if settle <= time.Duration(0) {
+		return nil
+	}
+	var expired <-chan time.Time
+	if limit > time.Duration(0) {
+		timer := time.NewTimer(limit)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case <-time.After(settle):
+		case <-expired:
+			return &stopError{102, limit, "settling"}
+		case <-stop.channel():
+			return stop.stopped()
+		}
+		var next img
+		if err := readImageMetadata(filepath, &next); err != nil {
+			return err
+		}
+		if identicalPixels(i.i, next.i) {
+			return nil
+		}
+		*i = next
+	}
+}
+
+// preprocess applies the settings to the images read
+func preprocess(s *Settings, baseImg, refImg *img) error {
+	if err := checkColorProfile(s, baseImg, s.BaseImg); err != nil {
+		return err
+	}
+	if err := checkColorProfile(s, refImg, s.RefImg); err != nil {
+		return err
+	}
+	if s.BaseAlpha == "error" && !opaque(baseImg.i) {
+		return fmt.Errorf("'%s' contains transparency", s.BaseImg)
+	}
+	if s.StrictDecode {
+		if err := checkComplete(baseImg, s.BaseImg); err != nil {
+			return err
+		}
+		if err := checkComplete(refImg, s.RefImg); err != nil {
+			return err
+		}
+	}
+	if s.RespectEXIF {
+		*baseImg = *imgFromImage(orient(baseImg.i, baseImg.orientation))
+		*refImg = *imgFromImage(orient(refImg.i, refImg.orientation))
+	}
+	if s.RotateRef != 0 {
+		*refImg = *imgFromImage(orient(refImg.i, rotations[s.RotateRef]))
+		if !s.CropToRef && (refImg.w != baseImg.w || refImg.h != baseImg.h) {
+			msg := "image dimensions do not correspond after rotating the reference by %d°; got %d×%d (base) and %d×%d (ref)"
+			return fmt.Errorf(msg, s.RotateRef, baseImg.w, baseImg.h, refImg.w, refImg.h)
+		}
+	}
+	if s.Equalize {
+		*baseImg = *imgFromImage(equalize(baseImg.i))
+		*refImg = *imgFromImage(equalize(refImg.i))
+	}
+	return nil
+}
+
+// percentRegion converts the region (x, y, width, height) given in
+// percent of the dimensions `w`×`h` to pixels
+func percentRegion(region [4]float64, w, h int) (image.Rectangle, error) {
+	px := func(percent float64, size int) int {
+		return int(math.Floor(percent*float64(size)/100.0 + 0.5))
+	}
+	r := image.Rect(px(region[0], w), px(region[1], h), px(region[0]+region[2], w), px(region[1]+region[3], h))
+	if r.Empty() || !r.In(image.Rect(0, 0, w, h)) {
+		return r, fmt.Errorf("region %v of %d×%d image is empty or out of bounds", r, w, h)
+	}
+	return r, nil
+}
+
+// applyOverlay composites the overlay image given in Settings over `baseImg`
+func applyOverlay(s *Settings, cache *decodeCache, baseImg *img) error {
+	if s.Overlay == "" {
+		return nil
+	}
+	var overlay img
+	if err := cache.read(s.Overlay, &overlay); err != nil {
+		return err
+	}
+	if overlay.w != baseImg.w || overlay.h != baseImg.h {
+		msg := "overlay dimensions do not correspond; got %d×%d (base) and %d×%d (overlay)"
+		return fmt.Errorf(msg, baseImg.w, baseImg.h, overlay.w, overlay.h)
+	}
+	*baseImg = *imgFromImage(composite(baseImg.i, overlay.i))
+	return nil
+}
+
+// cropSeparateRegions crops `baseImg` and `refImg` to their own regions
+// of the same dimensions given in Settings
+func cropSeparateRegions(s *Settings, baseImg, refImg *img) error {
+	if s.BaseRegion == nil {
+		return nil
+	}
+	if !s.BaseRegion.In(image.Rect(0, 0, baseImg.w, baseImg.h)) {
+		return fmt.Errorf("base region %v exceeds the %d×%d base image", *s.BaseRegion, baseImg.w, baseImg.h)
+	}
+	if !s.RefRegion.In(image.Rect(0, 0, refImg.w, refImg.h)) {
+		return fmt.Errorf("reference region %v exceeds the %d×%d reference image", *s.RefRegion, refImg.w, refImg.h)
+	}
+	*baseImg = *imgFromImage(crop(baseImg.i, *s.BaseRegion))
+	*refImg = *imgFromImage(crop(refImg.i, *s.RefRegion))
+	return nil
+}
+
+// matchDimensions applies the dimension policy to `baseImg` and `refImg`
+// of different dimensions
+func matchDimensions(s *Settings, baseImg, refImg *img) error {
+	if baseImg.w == refImg.w && baseImg.h == refImg.h {
+		return nil
+	}
+	if s.CropToRef {
+		return cropToReference(s, baseImg, refImg)
+	}
+	if s.DimensionPolicy != "scale-down" {
+		msg := "image dimensions do not correspond; got %d×%d (base) and %d×%d (ref)"
+		return fmt.Errorf(msg, baseImg.w, baseImg.h, refImg.w, refImg.h)
+	}
+	w, h := baseImg.w, baseImg.h
+	if refImg.w < w {
+		w = refImg.w
+	}
+	if refImg.h < h {
+		h = refImg.h
+	}
+	for _, i := range []*img{baseImg, refImg} {
+		if i.w != w || i.h != h {
+			*i = *imgFromImage(resize(i.i, w, h))
+		}
+	}
+	return nil
+}
+
+// cropOrigins maps the corners of --crop-origin to the position of the
+// kept region within the base image in halves of the excess width and
+// height
+var cropOrigins = map[string][2]int{
+	"top-left":     {0, 0},
+	"top-right":    {2, 0},
+	"bottom-left":  {0, 2},
+	"bottom-right": {2, 2},
+	"center":       {1, 1},
+}
+
+// cropToReference crops `baseImg` to the dimensions of the smaller
+// `refImg` at the corner given in Settings
+func cropToReference(s *Settings, baseImg, refImg *img) error {
+	if refImg.w > baseImg.w || refImg.h > baseImg.h {
+		msg := "the %d×%d reference image does not fit within the %d×%d base image"
+		return fmt.Errorf(msg, refImg.w, refImg.h, baseImg.w, baseImg.h)
+	}
+	origin := cropOrigins["top-left"]
+	if s.CropOrigin != "" {
+		origin = cropOrigins[s.CropOrigin]
+	}
+	x, y := origin[0]*(baseImg.w-refImg.w)/2, origin[1]*(baseImg.h-refImg.h)/2
+	*baseImg = *imgFromImage(crop(baseImg.i, image.Rect(x, y, x+refImg.w, y+refImg.h)))
+	return nil
+}
+
+// cropRegion crops `baseImg` and `refImg` of the same dimensions to the
+// region given in percent in Settings after removing the ignored bands
+// at the right and bottom edge
+func cropRegion(s *Settings, baseImg, refImg *img) error {
+	if s.IgnoreRight > 0 || s.IgnoreBottom > 0 {
+		r := image.Rect(0, 0, baseImg.w-s.IgnoreRight, baseImg.h-s.IgnoreBottom)
+		if r.Empty() {
+			msg := "ignoring %d pixels at the right and %d pixels at the bottom leaves nothing of the %d×%d images"
+			return fmt.Errorf(msg, s.IgnoreRight, s.IgnoreBottom, baseImg.w, baseImg.h)
+		}
+		*baseImg = *imgFromImage(crop(baseImg.i, r))
+		*refImg = *imgFromImage(crop(refImg.i, r))
+	}
+	if s.RegionPercent == nil {
+		return nil
+	}
+	r, err := percentRegion(*s.RegionPercent, baseImg.w, baseImg.h)
+	if err != nil {
+		return err
+	}
+	*baseImg = *imgFromImage(crop(baseImg.i, r))
+	*refImg = *imgFromImage(crop(refImg.i, r))
+	return nil
+}
+
+// checkColorProfile warns about an ICC color profile embedded in `i`
+// or returns an error if the settings demand to respect it
+func checkColorProfile(s *Settings, i *img, filepath string) error {
+	if !i.icc {
+		return nil
+	}
+	if s.RespectICC {
+		return fmt.Errorf("'%s' embeds an ICC color profile; conversion to sRGB is not supported", filepath)
+	}
+	log.Printf("warning: '%s' embeds an ICC color profile which is ignored; assuming sRGB\n", filepath)
+	return nil
+}
+
+// opaque reports whether every pixel of `i` is fully opaque
+func opaque(i image.Image) bool {
+	if o, ok := i.(interface {
+		Opaque() bool
+	}); ok {
+		return o.Opaque()
+	}
+	b := i.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := i.At(x, y).RGBA(); a != 0xFFFF {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkComplete returns a load error if the file of `i` is truncated
+// or has trailing data
+func checkComplete(i *img, filepath string) error {
+	if i.truncated {
+		return &loadError{filepath, fmt.Errorf("file is truncated or has trailing data")}
+	}
+	return nil
+}
+
+// identicalPixels reports whether `a` and `b` have identical normalized pixel data
+func identicalPixels(a, b image.Image) bool {
+	na, nb := normalize(a), normalize(b)
+	return na.Rect.Eq(nb.Rect) && bytes.Equal(na.Pix, nb.Pix)
+}
+
+// normalize converts an arbitrary image to un-alpha-scaled NRGBA
+// with its top-left corner at the origin
+func normalize(i image.Image) *image.NRGBA {
+	b := i.Bounds()
+	n := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(n, n.Bounds(), i, b.Min, draw.Src)
+	return n
+}
+
+// hashImage returns the hex-encoded SHA-256 digest of the normalized
+// pixel data of `i`. The dimensions are part of the digest.
+func hashImage(i image.Image) string {
+	n := normalize(i)
+	h := sha256.New()
+	var dim [8]byte
+	binary.BigEndian.PutUint32(dim[0:4], uint32(n.Rect.Dx()))
+	binary.BigEndian.PutUint32(dim[4:8], uint32(n.Rect.Dy()))
+	h.Write(dim[:])
+	h.Write(n.Pix)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// convertImage re-encodes the image at `src` as PNG image at `dst`
+func convertImage(src, dst string) error {
+	var i img
+	if err := readImageMetadata(src, &i); err != nil {
+		return err
+	}
+	return writePNG(dst, normalize(i.i))
+}
+
+// writePNG stores `i` as PNG image at `filepath`
+func writePNG(filepath string, i image.Image) error {
+	fd, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return png.Encode(fd, i)
+}
+
+// saveNormalized stores `baseImg` and `refImg` as PNG images in `dir`
+func saveNormalized(dir string, baseImg, refImg *img) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writePNG(filepath.Join(dir, "base.png"), baseImg.i); err != nil {
+		return err
+	}
+	return writePNG(filepath.Join(dir, "ref.png"), refImg.i)
+}
+
+// toNRGBA converts a RGBA color to un-alpha-scaled NRGBA
+// based on https://golang.org/src/image/color/color.go?s=4600:4767
 func toNRGBA(r, g, b, a uint32) (float64, float64, float64, float64) {
 	d := float64(a)
 	if d == 0.0 {
@@ -223,91 +2735,1195 @@ func toNRGBA(r, g, b, a uint32) (float64, float64, float64, float64) {
 	return float64(r*0xFFFF) / d, float64(g*0xFFFF) / d, float64(b*0xFFFF) / d, d
 }
 
+// pixelAt returns the un-alpha-scaled color of pixel (x,y) of `i` like
+// toNRGBA. Opaque pixels of NRGBA, RGBA and gray images are read from
+// the pixel slice directly, which avoids the color interface in the hot
+// loop. The results are identical, because an opaque 8-bit channel v
+// converts to v·0x101 exactly.
+func pixelAt(i *img, x, y int) (float64, float64, float64, float64) {
+	switch p := i.i.(type) {
+	case *image.NRGBA:
+		if (image.Point{x, y}).In(p.Rect) {
+			n := p.PixOffset(x, y)
+			if pix := p.Pix[n : n+4]; pix[3] == 0xFF {
+				return float64(pix[0]) * 0x101, float64(pix[1]) * 0x101, float64(pix[2]) * 0x101, maxChannel
+			}
+		}
+	case *image.RGBA:
+		if (image.Point{x, y}).In(p.Rect) {
+			n := p.PixOffset(x, y)
+			if pix := p.Pix[n : n+4]; pix[3] == 0xFF {
+				return float64(pix[0]) * 0x101, float64(pix[1]) * 0x101, float64(pix[2]) * 0x101, maxChannel
+			}
+		}
+	case *image.Gray:
+		if (image.Point{x, y}).In(p.Rect) {
+			v := float64(p.Pix[p.PixOffset(x, y)]) * 0x101
+			return v, v, v, maxChannel
+		}
+	}
+	return toNRGBA(i.i.At(x, y).RGBA())
+}
+
+// linearize converts a sRGB encoded channel value between 0 and 65535
+// to linear light between 0 and 1
+func linearize(v float64) float64 {
+	v /= 65535
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// delinearize converts a linear light value between 0 and 1
+// to a sRGB encoded channel value between 0 and 65535
+func delinearize(v float64) float64 {
+	if v <= 0.0031308 {
+		return 65535 * 12.92 * v
+	}
+	return 65535 * (1.055*math.Pow(v, 1/2.4) - 0.055)
+}
+
+// blendLinear composites foreground channel `fg` with alpha `alpha`
+// between 0 and 1 over background channel `bg` in linear light
+func blendLinear(bg, fg, alpha float64) float64 {
+	return delinearize(alpha*linearize(fg) + (1-alpha)*linearize(bg))
+}
+
+// luma determines the luma Y' of a RGB color
+func luma(r, g, b float64) float64 {
+	return WR*r + WG*g + WB*b
+}
+
 // toYUV converts a RGB color to the Y'UV color space
 func toYUV(r, g, b float64) (float64, float64, float64) {
 	// https://en.wikipedia.org/wiki/YUV#SDTV_with_BT.601
-	yPrime := WR*r + WG*g + WB*b
+	yPrime := luma(r, g, b)
 	return yPrime, 0.492 * (b - yPrime), 0.877 * (r - yPrime)
 }
 
-func euclideanDistance(a, x, b, y, c, z float64) float64 {
-	return math.Sqrt(math.Pow(a-x, 2) + math.Pow(b-y, 2) + math.Pow(c-z, 2))
+// toHSV converts a RGB color to hue in degrees, saturation
+// between 0 and 1 and value between 0 and 1
+func toHSV(r, g, b float64) (float64, float64, float64) {
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	if max == 0.0 {
+		return 0.0, 0.0, 0.0
+	}
+	chroma := max - min
+	var hue float64
+	switch {
+	case chroma == 0.0:
+		hue = 0.0
+	case max == r:
+		hue = 60 * math.Mod((g-b)/chroma+6, 6)
+	case max == g:
+		hue = 60 * ((b-r)/chroma + 2)
+	default:
+		hue = 60 * ((r-g)/chroma + 4)
+	}
+	return hue, chroma / max, max / maxChannel
+}
+
+// toLab converts a sRGB color with channel values between 0 and 65535
+// to CIELAB with the D65 white point, i.e. L* between 0 and 100
+func toLab(r, g, b float64) (float64, float64, float64) {
+	lr, lg, lb := linearize(r), linearize(g), linearize(b)
+	// linear sRGB to XYZ relative to the D65 white point
+	x := (0.4124564*lr + 0.3575761*lg + 0.1804375*lb) / 0.95047
+	y := 0.2126729*lr + 0.7151522*lg + 0.0721750*lb
+	z := (0.0193339*lr + 0.1191920*lg + 0.9503041*lb) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216.0/24389.0 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27.0*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// fromYUV converts a Y'UV color to the RGB color space
+func fromYUV(yPrime, u, v float64) (float64, float64, float64) {
+	r := yPrime + v/0.877
+	b := yPrime + u/0.492
+	return r, (yPrime - WR*r - WB*b) / WG, b
+}
+
+// euclideanDistance determines the weighted euclidean distance of (a, b, c) and (x, y, z)
+func euclideanDistance(w [3]float64, a, x, b, y, c, z float64) float64 {
+	return math.Sqrt(w[0]*math.Pow(a-x, 2) + w[1]*math.Pow(b-y, 2) + w[2]*math.Pow(c-z, 2))
+}
+
+// excluded reports whether pixel (x,y) lies in any of the rectangles `rects`
+func excluded(rects []image.Rectangle, x, y int) bool {
+	p := image.Pt(x, y)
+	for _, r := range rects {
+		if p.In(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// scaleRectangles maps `rects` to an image downscaled by `factor`.
+// Blocks partially inside a rectangle are covered entirely.
+func scaleRectangles(rects []image.Rectangle, factor int) []image.Rectangle {
+	var scaled []image.Rectangle
+	for _, r := range rects {
+		scaled = append(scaled, image.Rect(r.Min.X/factor, r.Min.Y/factor,
+			(r.Max.X+factor-1)/factor, (r.Max.Y+factor-1)/factor))
+	}
+	return scaled
+}
+
+// checkExclusions verifies that the excluded rectangles lie within
+// images of `w`×`h` pixels
+func checkExclusions(s *Settings, w, h int) error {
+	for _, r := range s.Exclude {
+		if !r.In(image.Rect(0, 0, w, h)) {
+			return fmt.Errorf("excluded rectangle %v exceeds the %d×%d images", r, w, h)
+		}
+	}
+	return nil
+}
+
+// exceedsChannelThreshold reports whether any channel of the NRGBA colors
+// (r1, g1, b1) and (r2, g2, b2) differs by more than its threshold
+func exceedsChannelThreshold(s *Settings, r1, g1, b1, r2, g2, b2 float64) bool {
+	t := s.ChannelThreshold
+	return math.Abs(r1-r2)/257 > float64(t[0]) ||
+		math.Abs(g1-g2)/257 > float64(t[1]) ||
+		math.Abs(b1-b2)/257 > float64(t[2])
+}
+
+// matchesKeyColor reports whether the NRGBA color (r, g, b) matches
+// the key color within the key tolerance
+func matchesKeyColor(s *Settings, r, g, b float64) bool {
+	tolerance := float64(s.KeyTolerance)
+	k := s.KeyColor
+	return math.Abs(r/257-float64(k.R)) <= tolerance &&
+		math.Abs(g/257-float64(k.G)) <= tolerance &&
+		math.Abs(b/257-float64(k.B)) <= tolerance
+}
+
+// rowResult stores the difference of a single row of two images
+// or the accumulated differences of several rows
+type rowResult struct {
+	y      int
+	cul    float64
+	pixels int
+	// pixels with different color values regardless of weighting
+	differing int
+	// pixels exceeding the tolerance
+	changed int
+	// maximum difference of a pixel and its position
+	maxDiff   float64
+	maxDiffAt image.Point
+	bounds    image.Rectangle
+	brighter  float64
+	darker    float64
+	// histogram of pixels per tolerance sweep level; the last bin
+	// counts pixels exceeding all levels
+	sweep []int
+	// maximum difference of a color channel, its index and position
+	maxChannelDelta float64
+	maxChannel      int
+	maxChannelAt    image.Point
+	// sum of the center weights of the compared pixels if weighted
+	weights float64
+}
+
+// merge adds the result `o` of other rows to `r`
+func (r *rowResult) merge(o rowResult) {
+	r.cul += o.cul
+	r.weights += o.weights
+	r.pixels += o.pixels
+	r.differing += o.differing
+	r.changed += o.changed
+	if o.maxDiff > r.maxDiff || (o.maxDiff == r.maxDiff && o.maxDiff > 0.0 && o.maxDiffAt.Y < r.maxDiffAt.Y) {
+		r.maxDiff, r.maxDiffAt = o.maxDiff, o.maxDiffAt
+	}
+	if o.maxChannelDelta > r.maxChannelDelta || (o.maxChannelDelta == r.maxChannelDelta && o.maxChannelDelta > 0.0 && o.maxChannelAt.Y < r.maxChannelAt.Y) {
+		r.maxChannelDelta, r.maxChannel, r.maxChannelAt = o.maxChannelDelta, o.maxChannel, o.maxChannelAt
+	}
+	r.bounds = r.bounds.Union(o.bounds)
+	r.brighter += o.brighter
+	r.darker += o.darker
+	if o.sweep != nil {
+		if r.sweep == nil {
+			r.sweep = make([]int, len(o.sweep))
+		}
+		for i, n := range o.sweep {
+			r.sweep[i] += n
+		}
+	}
+}
+
+// sweepLevels determines the percentage of pixels exceeding each of `levels`
+func (r rowResult) sweepLevels(levels []float64) []sweepLevel {
+	if r.sweep == nil || r.pixels == 0 {
+		return nil
+	}
+	result := make([]sweepLevel, len(levels))
+	exceeding := r.pixels
+	for i, level := range levels {
+		exceeding -= r.sweep[i]
+		result[i] = sweepLevel{level, 100.0 * float64(exceeding) / float64(r.pixels)}
+	}
+	return result
+}
+
+// difference determines the difference of all rows merged into `r`
+func (r rowResult) difference() difference {
+	diff := newDifference()
+	if r.weights > 0.0 {
+		diff.setScore(r.cul, r.weights)
+	} else if r.pixels > 0 {
+		diff.setScore(r.cul, float64(r.pixels))
+	}
+	if r.pixels > 0 {
+		diff.luminanceDelta = (r.brighter - r.darker) / float64(r.pixels)
+		diff.brighter = r.brighter / float64(r.pixels)
+		diff.darker = r.darker / float64(r.pixels)
+	}
+	diff.diffBounds = r.bounds
+	diff.identical = r.cul == 0.0 && r.differing == 0
+	diff.changed = r.changed
+	diff.maxDiff, diff.maxDiffAt = r.maxDiff, r.maxDiffAt
+	diff.maxChannelDelta, diff.maxChannel, diff.maxChannelAt = r.maxChannelDelta, r.maxChannel, r.maxChannelAt
+	return diff
+}
+
+// pixelResult is the difference of a single pixel
+type pixelResult struct {
+	// distance weighted by alpha
+	d float64
+	// luma of the reference minus luma of the base weighted by alpha
+	delta float64
+	// color values differ regardless of weighting
+	differing bool
+	// maximum difference of a color channel weighted by alpha
+	// and the index of the channel
+	channelDelta float64
+	channel      int
+	// excluded from the comparison
+	skip bool
+}
+
+// comparePixel determines the difference of pixel (x,y) of `baseImg`
+// and `refImg`. Distances are divided by `maxDist`.
+func comparePixel(s *Settings, baseImg, refImg *img, x, y int, maxDist float64) pixelResult {
+	var d float64
+	r1, g1, b1, a1 := pixelAt(baseImg, x, y)
+	r2, g2, b2, a2 := pixelAt(refImg, x, y)
+	//log.Println(y, x, ":", "(1)", r1, g1, b1, a1, "(2)", r2, g2, b2, a2)
+	if s.KeyColor != nil && matchesKeyColor(s, r2, g2, b2) {
+		return pixelResult{skip: true}
+	}
+	if s.Exclude != nil && excluded(s.Exclude, x, y) {
+		return pixelResult{skip: true}
+	}
+	if s.OpaqueIntersection && (a1 < maxChannel || a2 < maxChannel) {
+		return pixelResult{skip: true}
+	}
+	if s.AlphaAsMask && a2 == 0 {
+		return pixelResult{skip: true}
+	}
+	if s.CorrectBlend {
+		alpha := a2 / maxChannel
+		r2, g2, b2 = blendLinear(r1, r2, alpha), blendLinear(g1, g2, alpha), blendLinear(b1, b2, alpha)
+		a2 = maxChannel
+	}
+	if s.ChannelThreshold != nil && !exceedsChannelThreshold(s, r1, g1, b1, r2, g2, b2) {
+		// gated pixels are not pixel-identical nonetheless
+		return pixelResult{differing: r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2}
+	}
+
+	if s.SubpixelTolerant {
+		d = subpixelDistance(s, baseImg, refImg, x, y, maxDist)
+	} else {
+		d = colorDistance(s, r1, g1, b1, a1, r2, g2, b2, a2, maxDist)
+	}
+
+	// NOTE only alpha channel of refImg is considered,
+	// unless the base alpha is weighted as well
+	alpha := a2 / maxChannel
+	if alpha < 0.0 || alpha > 1.0 {
+		panic(alpha) // should not occur
+	}
+	if s.BaseAlpha == "weight" {
+		alpha *= a1 / maxChannel
+	}
+	if s.CompareAlpha {
+		// alpha is part of the distance
+		alpha = 1.0
+	}
+	if s.EdgeDownweight != nil && baseImg.edges != nil && baseImg.edges[y*baseImg.w+x] {
+		d *= *s.EdgeDownweight
+	}
+	//log.Println(y, x, ":", d, alpha)
+	channelDelta, channel := maxChannelDelta(r1, g1, b1, r2, g2, b2)
+	return pixelResult{
+		d:            d * alpha,
+		delta:        alpha * (luma(r2, g2, b2) - luma(r1, g1, b1)) / maxChannel,
+		differing:    r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2,
+		channelDelta: alpha * channelDelta,
+		channel:      channel,
+	}
+}
+
+// channelNames are the names of the color channels by index
+var channelNames = [3]string{"R", "G", "B"}
+
+// maxChannelDelta returns the largest absolute difference of the
+// channels of the colors (r1, g1, b1) and (r2, g2, b2) and the index
+// of its channel
+func maxChannelDelta(r1, g1, b1, r2, g2, b2 float64) (float64, int) {
+	max, channel := 0.0, 0
+	for n, d := range [3]float64{r1 - r2, g1 - g2, b1 - b2} {
+		if math.Abs(d) > max {
+			max, channel = math.Abs(d), n
+		}
+	}
+	return max, channel
+}
+
+// colorDistance returns the distance of the NRGBA colors (r1, g1, b1, a1)
+// and (r2, g2, b2, a2) divided by `maxDist`
+func colorDistance(s *Settings, r1, g1, b1, a1, r2, g2, b2, a2, maxDist float64) float64 {
+	var d float64
+	switch {
+	case s.SaturationOnly:
+		_, saturation1, _ := toHSV(r1, g1, b1)
+		_, saturation2, _ := toHSV(r2, g2, b2)
+		d = math.Abs(saturation1 - saturation2)
+	case s.ColorSpace == "RGB":
+		d = euclideanDistance(s.Weights, r1, r2, g1, g2, b1, b2)
+		if s.CompareAlpha {
+			d = math.Sqrt(d*d + math.Pow(a1-a2, 2))
+		}
+		d /= maxDist
+	case s.ColorSpace == "Y'UV":
+		yPrime1, u1, v1 := toYUV(r1, g1, b1)
+		yPrime2, u2, v2 := toYUV(r2, g2, b2)
+		d = euclideanDistance(s.Weights, yPrime1, yPrime2, u1, u2, v1, v2) / maxDist
+	}
+	// custom weights might exceed the maximum distance
+	if d > 1.0 {
+		d = 1.0
+	}
+	return d
+}
+
+// subpixelDistance returns the distance of pixel (x,y) of `baseImg` and
+// `refImg` tolerating shifts by 1 pixel. It is the larger of the minimum
+// distance of the base pixel to the reference pixels in its 3×3
+// neighborhood and the minimum distance of the reference pixel to the
+// base pixels in its neighborhood. Distances are divided by `maxDist`.
+func subpixelDistance(s *Settings, baseImg, refImg *img, x, y int, maxDist float64) float64 {
+	nearest := func(from, to *img) float64 {
+		r1, g1, b1, a1 := pixelAt(from, x, y)
+		min := 1.0
+		for ny := y - 1; ny <= y+1; ny++ {
+			for nx := x - 1; nx <= x+1; nx++ {
+				r2, g2, b2, a2 := paddedAt(to, nx, ny, s.Padding)
+				if d := colorDistance(s, r1, g1, b1, a1, r2, g2, b2, a2, maxDist); d < min {
+					min = d
+				}
+			}
+		}
+		return min
+	}
+	return math.Max(nearest(baseImg, refImg), nearest(refImg, baseImg))
+}
+
+// compareRow determines the cumulative difference of row `y` of
+// `baseImg` and `refImg`. Distances are divided by `maxDist`.
+// If `triage` is non-nil, the triage colors of the row are set.
+// If `mask` is non-nil, the difference of every pixel is stored.
+// If `changed` is non-nil, pixels exceeding the tolerance are set to white.
+func compareRow(s *Settings, baseImg, refImg *img, y int, maxDist float64, triage *image.NRGBA, mask *diffMask, changed *image.Gray) rowResult {
+	res := rowResult{pixels: baseImg.w}
+	if s.ToleranceSweep != nil {
+		res.sweep = make([]int, len(s.ToleranceSweep)+1)
+	}
+	for x := 0; x < baseImg.w; x++ {
+		px := comparePixel(s, baseImg, refImg, x, y, maxDist)
+		if px.skip {
+			res.pixels--
+			continue
+		}
+		if px.differing {
+			res.differing++
+		}
+		weight := 1.0
+		if s.CenterWeight != "" {
+			weight = centerWeight(s.CenterWeight, x, y, baseImg.w, baseImg.h)
+			res.weights += weight
+		}
+		res.cul += weight * px.d
+		if px.delta > 0 {
+			res.brighter += px.delta
+		} else {
+			res.darker -= px.delta
+		}
+		if mask != nil {
+			mask.set(x, y, px, weight)
+		}
+		if res.sweep != nil {
+			res.sweep[sweepBin(s.ToleranceSweep, px.d)]++
+		}
+		if px.d > s.Tolerance {
+			res.bounds = res.bounds.Union(image.Rect(x, y, x+1, y+1))
+			res.changed++
+			if changed != nil {
+				changed.SetGray(x, y, color.Gray{255})
+			}
+		}
+		if px.d > res.maxDiff {
+			res.maxDiff, res.maxDiffAt = px.d, image.Pt(x, y)
+		}
+		if px.channelDelta > res.maxChannelDelta {
+			res.maxChannelDelta, res.maxChannel, res.maxChannelAt = px.channelDelta, px.channel, image.Pt(x, y)
+		}
+		if triage != nil {
+			switch {
+			case px.d == 0.0:
+				triage.SetNRGBA(x, y, triageIdentical)
+			case px.d <= s.Tolerance:
+				triage.SetNRGBA(x, y, triageTolerated)
+			default:
+				triage.SetNRGBA(x, y, triageChanged)
+			}
+		}
+	}
+	return res
+}
+
+// sweepBin returns the bin of the --tolerance-sweep histogram of
+// a pixel with difference `d`, i.e. the number of `levels` it exceeds
+func sweepBin(levels []float64, d float64) int {
+	bin := 0
+	for bin < len(levels) && d > levels[bin] {
+		bin++
+	}
+	return bin
+}
+
+// centerFalloffs map the distance between 0 and 1 of a pixel from the
+// center to its weight for --center-weight
+var centerFalloffs = map[string]func(d float64) float64{
+	"linear":    func(d float64) float64 { return 1 - d },
+	"quadratic": func(d float64) float64 { return 1 - d*d },
+	"gaussian":  func(d float64) float64 { return math.Exp(-d * d / 0.32) },
+}
+
+// centerWeight returns the weight of pixel (x,y) of a `w`×`h` image
+// by `falloff` of the distance of its center from the center of the
+// image relative to half of the diagonal
+func centerWeight(falloff string, x, y, w, h int) float64 {
+	dx, dy := float64(x)+0.5-float64(w)/2, float64(y)+0.5-float64(h)/2
+	d := math.Hypot(dx, dy) / math.Hypot(float64(w)/2, float64(h)/2)
+	return centerFalloffs[falloff](math.Min(d, 1.0))
+}
+
+// prepareEdges determines the edges of `baseImg` if differences
+// along edges are downweighted
+func prepareEdges(s *Settings, baseImg *img) {
+	if s.EdgeDownweight != nil && *s.EdgeDownweight < 1.0 && baseImg.edges == nil {
+		baseImg.edges = edgeMap(baseImg.i)
+	}
+}
+
+// maxDistanceFor returns the maximum distance of two colors for Settings
+func maxDistanceFor(s *Settings) float64 {
+	if s.CompareAlpha {
+		return maxDistanceRGBA
+	}
+	c, _ := findColorSpace(s.ColorSpace)
+	return c.maxDistance
+}
+
+// sampleSeed seeds the choice of pixels, such that sampling is reproducible
+const sampleSeed = 1
+
+// compareSampled estimates the difference of `baseImg` and `refImg`
+// from a fraction Sample of randomly chosen pixels. Pixels are chosen
+// with replacement. The 95 % confidence interval of the percentage is
+// determined by the normal approximation, i.e. ±1.96 standard errors.
+func compareSampled(s *Settings, baseImg, refImg *img) difference {
+	prepareEdges(s, baseImg)
+	maxDist := maxDistanceFor(s)
+	rng := rand.New(rand.NewSource(sampleSeed))
+	samples := int(s.Sample * float64(baseImg.w) * float64(baseImg.h))
+	if samples < 1 {
+		samples = 1
+	}
+
+	var sum rowResult
+	var squares float64
+	for n := 0; n < samples; n++ {
+		x, y := rng.Intn(baseImg.w), rng.Intn(baseImg.h)
+		px := comparePixel(s, baseImg, refImg, x, y, maxDist)
+		if px.skip {
+			continue
+		}
+		sum.pixels++
+		if px.differing {
+			sum.differing++
+		}
+		sum.cul += px.d
+		squares += px.d * px.d
+		if px.delta > 0 {
+			sum.brighter += px.delta
+		} else {
+			sum.darker -= px.delta
+		}
+		if px.d > s.Tolerance {
+			sum.bounds = sum.bounds.Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+
+	diff := sum.difference()
+	// unsampled pixels might differ
+	diff.identical = false
+	diff.sampled = sum.pixels
+	if sum.pixels > 1 {
+		mean := sum.cul / float64(sum.pixels)
+		variance := (squares/float64(sum.pixels) - mean*mean) * float64(sum.pixels) / float64(sum.pixels-1)
+		diff.confidence = 100 * diff.roundingErrorFactor * 1.96 * math.Sqrt(math.Max(variance, 0.0)/float64(sum.pixels))
+	}
+	return diff
 }
 
 // compareImages determines the difference score for two images
 // `baseImg` and `refImg` beginning at y-coordinate `yOffset`
-// for `yCount` y-coordinates.
-func compareImages(s *Settings, baseImg, refImg *img, yOffset, yCount int) (difference, error) {
-	var diff difference
-	diff.minValue = 0.0
-	diff.maxValue = 1.0
-	diff.roundingErrorFactor = 1.25
+// for `yCount` y-coordinates. If `p` is non-nil, the intermediate
+// result is registered in `p` after every row. Rows are distributed
+// among up to MaxWorkers goroutines; one worker compares serially.
+// Black-and-white images are compared by counting differing pixels.
+func compareImages(s *Settings, baseImg, refImg *img, yOffset, yCount int, p *progress) (difference, error) {
+	var triage *image.NRGBA
+	if s.TriageOut != "" || s.SnapshotDir != "" || s.CycleGIF != "" {
+		triage = image.NewNRGBA(image.Rect(0, 0, baseImg.w, baseImg.h))
+	}
+	var changed *image.Gray
+	if s.MaskOut != "" {
+		changed = image.NewGray(image.Rect(0, 0, baseImg.w, baseImg.h))
+	}
 
-	cul := 0.0
-	for y := yOffset; y < yOffset+yCount; y++ {
-		for x := 0; x < baseImg.w; x++ {
-			var d float64
-			r1, g1, b1, _ := toNRGBA(baseImg.i.At(x, y).RGBA())
-			r2, g2, b2, a2 := toNRGBA(refImg.i.At(x, y).RGBA())
-			//log.Println(y, x, ":", "(1)", r1, g1, b1, a1, "(2)", r2, g2, b2, a2)
+	var mask *diffMask
+	if s.MinRegionSize > 0 {
+		mask = newDiffMask(baseImg.w, baseImg.h)
+	}
 
-			switch s.ColorSpace {
-			case "RGB":
-				d = euclideanDistance(r1, r2, g1, g2, b1, b2) / 113510.0
-			case "Y'UV":
-				yPrime1, u1, v1 := toYUV(r1, g1, b1)
-				yPrime2, u2, v2 := toYUV(r2, g2, b2)
-				d = euclideanDistance(yPrime1, yPrime2, u1, u2, v1, v2) / 113510.0
-			}
+	prepareEdges(s, baseImg)
+	maxDist := maxDistanceFor(s)
+
+	workers := s.MaxWorkers
+	if workers > yCount {
+		workers = yCount
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	row := func(y int) rowResult {
+		res := compareRow(s, baseImg, refImg, y, maxDist, triage, mask, changed)
+		res.y = y
+		return res
+	}
+	if mask == nil && changed == nil && useMonoPath(s, baseImg, refImg, triage) {
+		d := math.Min(euclideanDistance(s.Weights, 0, maxChannel, 0, maxChannel, 0, maxChannel)/maxDist, 1.0)
+		row = func(y int) rowResult {
+			res := compareMonoRow(baseImg, refImg, y, d)
+			res.y = y
+			return res
+		}
+	}
 
-			// NOTE only alpha channel of refImg is considered
-			alpha := a2 / 65535
-			if alpha < 0.0 || alpha > 1.0 {
-				panic(alpha) // should not occur
+	// once stopped, the workers discard their rows
+	stop := s.stop.channel()
+	results := make(chan rowResult, workers)
+	send := func(y int) bool {
+		select {
+		case results <- row(y):
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	if workers == 1 {
+		go func() {
+			for y := yOffset; y < yOffset+yCount; y++ {
+				if !send(y) {
+					return
+				}
+			}
+		}()
+	} else {
+		rows := make(chan int, workers)
+		go func() {
+			defer close(rows)
+			for y := yOffset; y < yOffset+yCount; y++ {
+				select {
+				case rows <- y:
+				case <-stop:
+					return
+				}
 			}
-			//log.Println(y, x, ":", d, alpha)
-			cul += d * alpha
+		}()
+		for w := 0; w < workers; w++ {
+			go func() {
+				for y := range rows {
+					if !send(y) {
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	// floating point addition is not associative, hence the completion
+	// order of the rows affects the last digits unless rows are summed
+	// in the order of their y-coordinate
+	var sum rowResult
+	var ordered []rowResult
+	if s.Deterministic {
+		ordered = make([]rowResult, yCount)
+	}
+	for n := 0; n < yCount; n++ {
+		var res rowResult
+		select {
+		case res = <-results:
+		case <-stop:
+			// the progress holds the partial difference
+			return difference{}, s.stop.stopped()
+		}
+		if ordered != nil {
+			ordered[res.y-yOffset] = res
+		} else {
+			sum.merge(res)
 		}
+		if p != nil {
+			p.add(res)
+		}
+	}
+	for _, res := range ordered {
+		sum.merge(res)
+	}
+
+	if s.OpaqueIntersection && sum.pixels == 0 {
+		return difference{}, fmt.Errorf("the opaque intersection of both images is empty")
+	}
+	if s.AlphaAsMask && sum.pixels == 0 {
+		return difference{}, fmt.Errorf("the reference image is fully transparent")
+	}
+
+	suppressed := 0
+	if mask != nil {
+		suppressed = suppressSmallRegions(s, mask, &sum, triage, changed)
 	}
 
-	diff.score = cul / float64(yCount*baseImg.w) * diff.roundingErrorFactor
-	if diff.score > 1.0 {
-		diff.score = 1.0
+	diff := sum.difference()
+	diff.triage = triage
+	diff.changedMask = changed
+	diff.suppressedRegions = suppressed
+	diff.sweep = sum.sweepLevels(s.ToleranceSweep)
+	if s.OpaqueIntersection {
+		diff.intersection = sum.pixels
 	}
 	return diff, nil
 }
 
+// comparePrepared compares two preprocessed images of the same dimensions
+// with the strategy defined in Settings
+func comparePrepared(s *Settings, baseImg, refImg *img, p *progress) (difference, error) {
+	var diff difference
+	var err error
+	var estimated *image.Point
+	if s.DetectShift {
+		estimated = detectShift(baseImg, refImg)
+	}
+	var noise *float64
+	if s.AutoTolerance {
+		tolerance := autoTolerance(baseImg, refImg)
+		noise = &tolerance
+		tuned := *s
+		tuned.Tolerance = tolerance
+		s = &tuned
+	}
+	factor := 1
+	if s.AdaptiveDownscale {
+		factor = adaptiveFactor(s, baseImg.w, baseImg.h)
+	}
+	if factor > 1 {
+		baseImg = imgFromImage(downscale(baseImg.i, factor))
+		refImg = imgFromImage(downscale(refImg.i, factor))
+		scaled := *s
+		scaled.Exclude = scaleRectangles(s.Exclude, factor)
+		s = &scaled
+	}
+	var shift *image.Point
+	if s.AlignWindow > 0 || s.VScrollSearch > 0 {
+		window := image.Pt(s.AlignWindow, s.AlignWindow)
+		if s.VScrollSearch > 0 {
+			window = image.Pt(0, s.VScrollSearch)
+		}
+		best, err := bestAlignment(s, baseImg, refImg, window)
+		if err != nil {
+			return diff, err
+		}
+		shift = &best
+		baseImg, refImg = alignedPair(s, baseImg, refImg, best)
+	}
+
+	if s.SaveNormalized != "" {
+		if err := saveNormalized(s.SaveNormalized, baseImg, refImg); err != nil {
+			return diff, err
+		}
+	}
+
+	if s.Metric == "fft" {
+		diff = compareSpectra(baseImg, refImg)
+	} else if s.Metric == "ms-ssim" {
+		diff = compareMSSSIM(baseImg, refImg)
+	} else if s.Metric == "hog" {
+		diff = compareHOG(baseImg, refImg, s.CellSize)
+	} else if s.Metric == "ssim-color" {
+		weight := defaultSSIMChromaWeight
+		if s.SSIMChromaWeight != nil {
+			weight = *s.SSIMChromaWeight
+		}
+		diff = compareSSIMColor(baseImg, refImg, weight)
+	} else if s.Metric == "delta-e-2000-jnd" {
+		diff = compareDeltaE2000(baseImg, refImg)
+	} else if s.Sample < 1.0 {
+		diff = compareSampled(s, baseImg, refImg)
+	} else if s.TextRegions {
+		diff = compareTextDensity(s, baseImg, refImg)
+	} else if s.TwoPass {
+		diff, err = compareTwoPass(s, baseImg, refImg, p)
+	} else {
+		diff, err = compareImages(s, baseImg, refImg, 0, baseImg.h, p)
+	}
+	if factor > 1 {
+		diff.adaptiveFactor = factor
+		diff.identical = false
+	}
+	diff.shift = shift
+	diff.estimatedShift = estimated
+	diff.noiseLevel = noise
+	if err == nil && s.RenderScales != nil {
+		diff.scales, err = compareScales(s, baseImg, refImg)
+	}
+	if err == nil && s.Quadrants {
+		diff.quadrants, err = compareQuadrants(s, baseImg, refImg)
+	}
+	if err == nil && s.NamedRegions != nil {
+		diff.pngRegions, err = compareNamedRegions(s, baseImg, refImg)
+	}
+	return diff, err
+}
+
+// maxAlignWindow caps the alignment window, since every shift
+// requires a comparison
+const maxAlignWindow = 8
+
+// maxVScrollSearch caps the vertical scroll search. Unlike the alignment
+// window, the number of comparisons grows linearly.
+const maxVScrollSearch = 64
+
+// alignedOverlap returns the overlapping regions of `baseImg` and
+// `refImg` if the content of `refImg` is shifted by `shift`, i.e.
+// base pixel (x,y) corresponds to reference pixel (x+dx,y+dy)
+func alignedOverlap(baseImg, refImg *img, shift image.Point) (*img, *img) {
+	bounds := image.Rect(0, 0, baseImg.w, baseImg.h)
+	r := bounds.Intersect(bounds.Sub(shift))
+	return imgFromImage(crop(baseImg.i, r)), imgFromImage(crop(refImg.i, r.Add(shift)))
+}
+
+// alignedPair returns `baseImg` and `refImg` shifted by `shift` padded
+// according to the Padding of Settings or their overlap without padding
+func alignedPair(s *Settings, baseImg, refImg *img, shift image.Point) (*img, *img) {
+	if s.Padding == "" {
+		return alignedOverlap(baseImg, refImg, shift)
+	}
+	return baseImg, shiftedImage(refImg, shift, s.Padding)
+}
+
+// bestAlignment compares the aligned pairs of `baseImg` and `refImg`
+// for every shift within `window` pixels horizontally and vertically and
+// returns the shift with the least difference. Ties prefer smaller shifts.
+func bestAlignment(s *Settings, baseImg, refImg *img, window image.Point) (image.Point, error) {
+	plain := *s
+	plain.TriageOut, plain.SnapshotDir, plain.MaskOut, plain.CycleGIF = "", "", "", ""
+	plain.MinRegionSize, plain.ToleranceSweep = 0, nil
+
+	var best image.Point
+	bestScore := math.Inf(1)
+	for dy := -window.Y; dy <= window.Y; dy++ {
+		for dx := -window.X; dx <= window.X; dx++ {
+			shift := image.Pt(dx, dy)
+			base, ref := alignedPair(s, baseImg, refImg, shift)
+			if base.w == 0 || base.h == 0 {
+				continue
+			}
+			diff, err := compareImages(&plain, base, ref, 0, base.h, nil)
+			if err != nil {
+				return best, err
+			}
+			if diff.score < bestScore || (diff.score == bestScore && manhattan(shift) < manhattan(best)) {
+				best, bestScore = shift, diff.score
+			}
+		}
+	}
+	return best, nil
+}
+
+// manhattan returns the manhattan norm of `p`
+func manhattan(p image.Point) int {
+	x, y := p.X, p.Y
+	if x < 0 {
+		x = -x
+	}
+	if y < 0 {
+		y = -y
+	}
+	return x + y
+}
+
+// nsPerPixel is the estimated comparison time per pixel and worker
+// in nanoseconds. It is deliberately pessimistic.
+const nsPerPixel = 200.0
+
+// adaptiveFactor estimates the smallest downscaling factor for images
+// of `w`×`h` pixels such that the comparison takes at most half of
+// the timeout. It returns 1 if no timeout is defined.
+func adaptiveFactor(s *Settings, w, h int) int {
+	if s.Timeout <= time.Duration(0) {
+		return 1
+	}
+	workers := s.MaxWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	cost := float64(w) * float64(h) * nsPerPixel / float64(workers)
+	budget := 0.5 * float64(s.Timeout.Nanoseconds())
+	factor := 1
+	for cost/float64(factor*factor) > budget && factor < w && factor < h {
+		factor++
+	}
+	return factor
+}
+
+// compareScales compares both images downscaled by each of the
+// RenderScales. Regions, sweeps and triage images are omitted.
+func compareScales(s *Settings, baseImg, refImg *img) ([]scaleLevel, error) {
+	scaled := *s
+	scaled.TriageOut, scaled.SnapshotDir, scaled.MaskOut, scaled.CycleGIF = "", "", "", ""
+	scaled.MinRegionSize, scaled.ToleranceSweep = 0, nil
+
+	var levels []scaleLevel
+	for _, factor := range s.RenderScales {
+		base := imgFromImage(downscale(baseImg.i, factor))
+		ref := imgFromImage(downscale(refImg.i, factor))
+		scaled.Exclude = scaleRectangles(s.Exclude, factor)
+		diff, err := compareImages(&scaled, base, ref, 0, base.h, nil)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, scaleLevel{factor, diff.percentage()})
+	}
+	return levels, nil
+}
+
+// compareQuadrants compares the four quadrants of `baseImg` and `refImg`
+// separately in the order top left, top right, bottom left, bottom right
+func compareQuadrants(s *Settings, baseImg, refImg *img) ([]quadrantLevel, error) {
+	if baseImg.w < 2 || baseImg.h < 2 {
+		return nil, fmt.Errorf("images of %d×%d pixels have no quadrants", baseImg.w, baseImg.h)
+	}
+	mx, my := baseImg.w/2, baseImg.h/2
+	quadrants := []namedRegion{
+		{"TL", image.Rect(0, 0, mx, my)},
+		{"TR", image.Rect(mx, 0, baseImg.w, my)},
+		{"BL", image.Rect(0, my, mx, baseImg.h)},
+		{"BR", image.Rect(mx, my, baseImg.w, baseImg.h)},
+	}
+	percentages, err := compareRectangles(s, baseImg, refImg, quadrants)
+	if err != nil {
+		return nil, err
+	}
+	var levels []quadrantLevel
+	for n, q := range quadrants {
+		levels = append(levels, quadrantLevel{q.name, percentages[n]})
+	}
+	return levels, nil
+}
+
+// compareNamedRegions compares the regions of `baseImg` and `refImg`
+// given in Settings, which must lie within the images
+func compareNamedRegions(s *Settings, baseImg, refImg *img) ([]regionLevel, error) {
+	bounds := image.Rect(0, 0, baseImg.w, baseImg.h)
+	for _, region := range s.NamedRegions {
+		if !region.r.In(bounds) {
+			return nil, fmt.Errorf("region '%s' %v exceeds the %d×%d compared images", region.name, region.r, baseImg.w, baseImg.h)
+		}
+	}
+	percentages, err := compareRectangles(s, baseImg, refImg, s.NamedRegions)
+	if err != nil {
+		return nil, err
+	}
+	var levels []regionLevel
+	for n, region := range s.NamedRegions {
+		levels = append(levels, regionLevel{region.name, percentages[n]})
+	}
+	return levels, nil
+}
+
+// compareRectangles compares `baseImg` and `refImg` cropped to each of
+// `regions` and returns their difference percentages
+func compareRectangles(s *Settings, baseImg, refImg *img, regions []namedRegion) ([]float64, error) {
+	plain := *s
+	plain.TriageOut, plain.SnapshotDir, plain.MaskOut, plain.CycleGIF = "", "", "", ""
+	plain.MinRegionSize, plain.ToleranceSweep = 0, nil
+
+	var percentages []float64
+	for _, region := range regions {
+		base := imgFromImage(crop(baseImg.i, region.r))
+		ref := imgFromImage(crop(refImg.i, region.r))
+		plain.Exclude = nil
+		for _, r := range s.Exclude {
+			plain.Exclude = append(plain.Exclude, r.Sub(region.r.Min))
+		}
+		diff, err := compareImages(&plain, base, ref, 0, base.h, nil)
+		if err != nil {
+			return nil, err
+		}
+		percentages = append(percentages, diff.percentage())
+	}
+	return percentages, nil
+}
+
+// pngRegionPrefix starts the keywords of tEXt chunks defining regions
+const pngRegionPrefix = "region:"
+
+// readPNGRegions sets the named regions in Settings to the regions
+// defined in the text chunks of `baseImg` if requested. The regions are
+// sorted by name.
+func readPNGRegions(s *Settings, baseImg *img) error {
+	if !s.PNGRegions {
+		return nil
+	}
+	var names []string
+	for keyword := range baseImg.text {
+		if strings.HasPrefix(keyword, pngRegionPrefix) {
+			names = append(names, keyword)
+		}
+	}
+	if names == nil {
+		return fmt.Errorf("the base image defines no regions in PNG text chunks with keyword '%s<name>'", pngRegionPrefix)
+	}
+	sort.Strings(names)
+	s.NamedRegions = nil
+	for _, keyword := range names {
+		r, err := readRectangle(baseImg.text[keyword])
+		if err != nil {
+			return fmt.Errorf("PNG text chunk '%s': %s", keyword, err.Error())
+		}
+		s.NamedRegions = append(s.NamedRegions, namedRegion{strings.TrimPrefix(keyword, pngRegionPrefix), r})
+	}
+	return nil
+}
+
+// compareTwoPass compares downscaled images first. If the result is clearly
+// below or above the threshold, i.e. below half or above twice the threshold,
+// it is returned. Otherwise the images are compared in full resolution.
+func compareTwoPass(s *Settings, baseImg, refImg *img, p *progress) (difference, error) {
+	coarseBase := imgFromImage(downscale(baseImg.i, s.CoarseFactor))
+	coarseRef := imgFromImage(downscale(refImg.i, s.CoarseFactor))
+	coarse := *s
+	coarse.Exclude = scaleRectangles(s.Exclude, s.CoarseFactor)
+	diff, err := compareImages(&coarse, coarseBase, coarseRef, 0, coarseBase.h, nil)
+	if err != nil {
+		return diff, err
+	}
+	percent := diff.percentage()
+	if percent < s.Threshold/2 || percent > 2*s.Threshold {
+		diff.pass = fmt.Sprintf("coarse pass (factor %d)", s.CoarseFactor)
+		// identical downscaled images need not be identical
+		diff.identical = false
+		return diff, nil
+	}
+
+	diff, err = compareImages(s, baseImg, refImg, 0, baseImg.h, p)
+	diff.pass = "full pass"
+	return diff, err
+}
+
+// withDefaults returns `s` where the zero values of options which every
+// comparison depends on are replaced by the defaults of newSettings, such
+// that Settings with just the filepaths compare like the command line
+func withDefaults(s Settings) Settings {
+	d := newSettings()
+	if s.ColorSpace == "" {
+		s.ColorSpace = d.ColorSpace
+	}
+	if s.Weights == [3]float64{} {
+		s.Weights = d.Weights
+	}
+	if s.MaxWorkers == 0 {
+		s.MaxWorkers = d.MaxWorkers
+	}
+	if s.CoarseFactor == 0 {
+		s.CoarseFactor = d.CoarseFactor
+	}
+	if s.TextBlockSize == 0 {
+		s.TextBlockSize = d.TextBlockSize
+	}
+	if s.CellSize == 0 {
+		s.CellSize = d.CellSize
+	}
+	if s.Metric == "" {
+		s.Metric = d.Metric
+	}
+	if s.Sample == 0.0 {
+		s.Sample = d.Sample
+	}
+	return s
+}
+
+// compareFiles compares the images at the filepaths given in Settings.
+// Decoded images are taken from `cache` if possible, which may be nil.
+func compareFiles(s *Settings, cache *decodeCache) (difference, error) {
+	defaulted := withDefaults(*s)
+	s = &defaulted
+	var baseImg, refImg img
+	if err := readImagesWithin(s, cache, &baseImg, &refImg); err != nil {
+		return difference{}, err
+	}
+	if err := readPNGRegions(s, &baseImg); err != nil {
+		return difference{}, err
+	}
+	if err := preprocess(s, &baseImg, &refImg); err != nil {
+		return difference{}, err
+	}
+	if err := applyOverlay(s, cache, &baseImg); err != nil {
+		return difference{}, err
+	}
+	if err := cropSeparateRegions(s, &baseImg, &refImg); err != nil {
+		return difference{}, err
+	}
+	if err := matchDimensions(s, &baseImg, &refImg); err != nil {
+		return difference{}, err
+	}
+	if err := cropRegion(s, &baseImg, &refImg); err != nil {
+		return difference{}, err
+	}
+	if err := checkExclusions(s, baseImg.w, baseImg.h); err != nil {
+		return difference{}, err
+	}
+	if s.CompareMode == "fast-equal" && identicalPixels(baseImg.i, refImg.i) {
+		return identicalDifference(), nil
+	}
+	return comparePrepared(s, &baseImg, &refImg, nil)
+}
+
 // CompareImages compares the color values of the two images given in Settings
 // A similarity score between 0 and 1 is returned and nil or an error instance
 func CompareImages(s Settings) (float64, error) {
-	var baseImg, refImg img
-	if err := readImageMetadata(s.BaseImg, &baseImg); err != nil {
+	diff, err := compareFiles(&s, nil)
+	if err != nil {
 		return 1.0, err
 	}
-	if err := readImageMetadata(s.RefImg, &refImg); err != nil {
-		return 1.0, err
+	return diff.score, nil
+}
+
+// snapshotDiffPath returns the filepath of the difference image in snapshot mode
+func snapshotDiffPath(s *Settings) string {
+	name := filepath.Base(s.BaseImg)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	return filepath.Join(s.SnapshotDir, name+".diff.png")
+}
+
+// testCaseName names the comparison given in Settings by both images
+func testCaseName(s *Settings) string {
+	base, ref := s.BaseImg, s.RefImg
+	if s.BaseB64 != nil {
+		base = "--base-b64"
+	}
+	switch {
+	case s.RefB64 != nil:
+		ref = "--ref-b64"
+	case s.RefColor != nil:
+		ref = "--ref-color"
+	case s.Refs != nil:
+		ref = strings.Join(s.Refs, "+")
+	}
+	return base + " vs " + ref
+}
+
+// exitCode determines the return code for difference percentage `percent`
+func exitCode(s *Settings, percent float64) int {
+	if s.WarnOnly {
+		return 0
+	}
+	if s.ExpectDifferent {
+		if percent > s.Threshold {
+			return 0
+		}
+		return 103
+	}
+	if s.SnapshotDir != "" {
+		if percent <= s.Threshold {
+			return 0
+		}
+		if int(percent) < 1 {
+			return 1
+		}
 	}
-	if baseImg.w != refImg.w || baseImg.h != refImg.h {
-		msg := "image dimensions do not correspond; got %d×%d (base) and %d×%d (ref)\n"
-		return 1.0, fmt.Errorf(msg, baseImg.w, baseImg.h, refImg.w, refImg.h)
+	return int(percent)
+}
+
+// expectDifferentVerdict describes whether the difference percentage
+// `percent` passes --expect-different
+func expectDifferentVerdict(s *Settings, percent float64) string {
+	if percent > s.Threshold {
+		return fmt.Sprintf("passed, the images differ by more than the threshold of %.3f %%", s.Threshold)
 	}
-	diff, err := compareImages(&s, &baseImg, &refImg, 0, baseImg.h)
-	return diff.score, err
+	return fmt.Sprintf("FAILED, the images are too similar (threshold of %.3f %%)", s.Threshold)
 }
 
 func main() {
-	var s Settings
-	s.ColorSpace = "RGB"
+	s := newSettings()
 	var diff difference
+	var prog progress
+	var times timings
 
 	start := time.Now()
 
 	// CLI
 	if err := parseArguments(&s, os.Args[1:]); err != nil {
 		fmt.Printf("invalid arguments: %s\n", err.Error())
-		fmt.Println(USAGE)
+		fmt.Print(USAGE)
 		os.Exit(101)
 	}
+	tmpl := template.Must(template.New("result").Parse(s.Template))
+
+	if s.ListColorSpaces {
+		listColorSpaces(os.Stdout)
+		os.Exit(0)
+	}
+
+	// conversion mode
+	if s.ConvertOut != "" {
+		if err := convertImage(s.BaseImg, s.ConvertOut); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
 
 	// wait option
 	if s.Wait > time.Duration(0) {
@@ -315,50 +3931,294 @@ func main() {
 	}
 
 	// timeout setup
-	timeout := make(chan bool, 1)
+	batch := s.Batch != "" || s.BaseDir != "" || s.SimMatrix
+	var phase atomic.Value
+	phase.Store("decoding")
+	if batch {
+		// pairs are read and compared alternately
+		phase.Store("")
+	}
+	stop := newStopSignal()
+	s.stop = stop
+	decoded := make(chan bool)
+	completed := make(chan bool, 1)
 	go func() {
-		time.Sleep(s.Timeout)
+		// batches read per pair, hence the timeout bounds the whole run
+		if s.DecodeTimeout > time.Duration(0) && !batch {
+			<-decoded
+		}
 		if s.Timeout > time.Duration(0) {
-			timeout <- false
+			time.Sleep(s.Timeout)
+			stop.stop(&stopError{102, s.Timeout, phase.Load().(string)})
 		}
 	}()
 
+	// SIGINT stops the comparison like a timeout, a second SIGINT
+	// exits immediately
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		stop.stop(&stopError{130, 0, phase.Load().(string)})
+		<-interrupt
+		os.Exit(130)
+	}()
+
+	// batch mode
+	if s.Batch != "" || s.BaseDir != "" {
+		os.Exit(runBatch(&s))
+	}
+	if s.SimMatrix {
+		os.Exit(runMatrix(&s))
+	}
+
 	go func() {
 		// image metadata
 		var err error
-		var baseImg img
-		if err := readImageMetadata(s.BaseImg, &baseImg); err != nil {
-			log.Fatal(err)
+		var baseImg, refImg img
+		mark := time.Now()
+		if err := readImagesWithin(&s, nil, &baseImg, &refImg); err != nil {
+			if e, ok := err.(*stopError); ok {
+				// reported like a timeout
+				stop.stop(e)
+				return
+			}
+			log.Println(err)
+			os.Exit(errorCode(&s, err))
 		}
-		var refImg img
-		if err := readImageMetadata(s.RefImg, &refImg); err != nil {
-			log.Fatal(err)
+		times.Decoding, mark = time.Since(mark), time.Now()
+		jpegBase, jpegRef := baseImg.f == "jpeg", refImg.f == "jpeg"
+		if err := readPNGRegions(&s, &baseImg); err != nil {
+			log.Println(err)
+			os.Exit(101)
+		}
+		if err := preprocess(&s, &baseImg, &refImg); err != nil {
+			log.Println(err)
+			os.Exit(errorCode(&s, err))
+		}
+		if err := applyOverlay(&s, nil, &baseImg); err != nil {
+			log.Println(err)
+			os.Exit(errorCode(&s, err))
+		}
+		phase.Store("comparing")
+		close(decoded)
+		if s.PrintHashes {
+			fmt.Printf("base hash:              %s\n", hashImage(baseImg.i))
+			fmt.Printf("reference hash:         %s\n", hashImage(refImg.i))
+			os.Exit(0)
+		}
+		if err := cropSeparateRegions(&s, &baseImg, &refImg); err != nil {
+			log.Println(err)
+			os.Exit(101)
+		}
+		if err := matchDimensions(&s, &baseImg, &refImg); err != nil {
+			log.Println(err)
+			os.Exit(101)
+		}
+		if err := cropRegion(&s, &baseImg, &refImg); err != nil {
+			log.Println(err)
+			os.Exit(101)
 		}
-		if baseImg.w != refImg.w || baseImg.h != refImg.h {
-			msg := "image dimensions do not correspond; got %d×%d (base) and %d×%d (ref)\n"
-			log.Printf(msg, baseImg.w, baseImg.h, refImg.w, refImg.h)
+		if err := checkExclusions(&s, baseImg.w, baseImg.h); err != nil {
+			log.Println(err)
 			os.Exit(101)
 		}
+		if s.Inspect != nil {
+			if err := inspectPixel(os.Stdout, &s, &baseImg, &refImg, *s.Inspect); err != nil {
+				log.Println(err)
+				os.Exit(101)
+			}
+			os.Exit(0)
+		}
+		if s.CompareMode == "fast-equal" && identicalPixels(baseImg.i, refImg.i) {
+			diff = identicalDifference()
+			completed <- true
+			return
+		}
 
 		// processing
-		diff, err = compareImages(&s, &baseImg, &refImg, 0, baseImg.h)
+		times.Preprocessing, mark = time.Since(mark), time.Now()
+		diff, err = comparePrepared(&s, &baseImg, &refImg, &prog)
+		if _, ok := err.(*stopError); ok {
+			return
+		}
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
 			os.Exit(101)
 		}
+		times.Comparison = time.Since(mark)
+		if s.ReportArtifacts && (jpegBase || jpegRef) {
+			jpeg := &baseImg
+			if !jpegBase {
+				jpeg = &refImg
+			}
+			estimate := estimateArtifacts(&s, jpeg, &baseImg, &refImg)
+			diff.artifacts = &estimate
+		}
+		if diff.triage != nil && s.Annotate {
+			annotate(diff.triage, fmt.Sprintf("%.*f %%", s.Precision, diff.percentage()), diff.diffBounds)
+		}
+		if diff.triage != nil && s.TriageOut != "" {
+			if err := writePNG(s.TriageOut, diff.triage); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if diff.changedMask != nil {
+			if err := writePNG(s.MaskOut, diff.changedMask); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if diff.triage != nil && s.CycleGIF != "" {
+			frames := []image.Image{baseImg.i, refImg.i, diff.triage}
+			if err := writeCycleGIF(s.CycleGIF, frames, s.CycleDelay); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if s.StatsOut != "" {
+			if err := writeStats(s.StatsOut, diff); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if s.SVGReport != "" {
+			names := [2]string{"base: " + s.BaseImg, "reference: " + s.RefImg}
+			if s.RefColor != nil {
+				names[1] = fmt.Sprintf("reference: #%02X%02X%02X", s.RefColor.R, s.RefColor.G, s.RefColor.B)
+			}
+			if s.Refs != nil {
+				names[1] = fmt.Sprintf("reference: average of %d images", len(s.Refs))
+			}
+			if err := writeSVGReport(s.SVGReport, &baseImg, &refImg, names, diff); err != nil {
+				log.Fatal(err)
+			}
+		}
 
-		timeout <- true
+		completed <- true
 	}()
 
+	done := false
+	select {
+	case done = <-completed:
+	case <-stop.channel():
+	}
+
 	// print result
-	if <-timeout {
-		percent := float64(100*diff.score-diff.minValue) / (diff.maxValue - diff.minValue)
-		fmt.Printf("difference percentage:  %.3f %%\n", percent)
-		fmt.Printf("runtime:                %s\n", time.Now().Sub(start))
+	if done {
+		percent := diff.percentage()
+		res := result{
+			Percentage:        percent,
+			Score:             diff.score,
+			ChangedRegion:     diff.diffBounds,
+			LuminanceDelta:    diff.luminanceDelta,
+			LuminanceSummary:  diff.luminanceSummary(),
+			Pass:              diff.pass,
+			SuppressedRegions: diff.suppressedRegions,
+			ToleranceSweep:    diff.sweep,
+			RenderScales:      diff.scales,
+			Quadrants:         diff.quadrants,
+			PNGRegions:        diff.pngRegions,
+			Intersection:      diff.intersection,
+			AdaptiveFactor:    diff.adaptiveFactor,
+			Shift:             diff.shift,
+			EstimatedShift:    diff.estimatedShift,
+			MSSSIM:            diff.msssim,
+			JND:               diff.jnd,
+			NoiseLevel:        diff.noiseLevel,
+			Identical:         diff.identical,
+			Sampled:           diff.sampled,
+			Confidence:        diff.confidence,
+			References:        len(s.Refs),
+			Threshold:         s.Threshold,
+			Runtime:           time.Now().Sub(start),
+			Precision:         s.Precision,
+		}
+		if s.RawScore {
+			res.RawScore = &diff.rawScore
+		}
+		if diff.artifacts != nil {
+			res.Artifacts = diff.artifacts
+		}
+		if s.VerboseTiming {
+			res.Timings = &times
+		}
+		if s.ExpectDifferent {
+			res.Verdict = expectDifferentVerdict(&s, percent)
+		}
+		if s.MaxChannelDiff {
+			res.MaxChannelDelta = &channelDelta{
+				Value:   int(math.Floor(diff.maxChannelDelta/0x101 + 0.5)),
+				Channel: channelNames[diff.maxChannel],
+				At:      diff.maxChannelAt,
+			}
+		}
+		var snapshotDiff string
+		if s.SnapshotDir != "" && percent > s.Threshold && diff.triage != nil {
+			snapshotDiff = snapshotDiffPath(&s)
+			if err := writePNG(snapshotDiff, diff.triage); err != nil {
+				log.Fatal(err)
+			}
+		}
+		code := exitCode(&s, percent)
+		if s.WarnOnly && percent > s.Threshold {
+			fmt.Fprintf(os.Stderr, "WARNING: difference percentage %.*f %% exceeds threshold of %.3f %%\n", s.Precision, percent, s.Threshold)
+		}
+		if s.ResultFile != "" {
+			if err := writeResultFile(s.ResultFile, percent, code); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if s.Format == "json" {
+			if err := writeJSONResult(os.Stdout, res, snapshotDiff, code); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(code)
+		}
+		if s.Format == "xml" {
+			if err := writeXMLResult(os.Stdout, res, testCaseName(&s), s.Threshold, snapshotDiff, code); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(code)
+		}
+		if err := tmpl.Execute(os.Stdout, res); err != nil {
+			log.Fatal(err)
+		}
+		if snapshotDiff != "" {
+			fmt.Printf("snapshot mismatch:      %s\n", snapshotDiff)
+		}
 
-		os.Exit(int(percent))
+		os.Exit(code)
 	} else {
-		fmt.Printf("program timed out within %s\n", s.Timeout)
-		os.Exit(102)
+		reason := stop.err
+		code := reason.code
+		res := result{Stopped: reason, Runtime: time.Now().Sub(start), Threshold: s.Threshold, Precision: s.Precision}
+		percent := math.NaN()
+		partial, pixels := prog.difference()
+		if pixels > 0 {
+			percent = partial.percentage()
+			res.Percentage, res.Score, res.Partial = percent, partial.score, pixels
+		}
+		if s.ResultFile != "" {
+			if err := writeResultFile(s.ResultFile, percent, code); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if s.Format == "json" {
+			if err := writeJSONResult(os.Stdout, res, "", code); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(code)
+		}
+		if s.Format == "xml" {
+			if err := writeXMLResult(os.Stdout, res, testCaseName(&s), s.Threshold, "", code); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(code)
+		}
+		fmt.Printf("program %s\n", reason.Error())
+		if pixels > 0 {
+			fmt.Printf("difference percentage:  %.*f %% (partial, %d pixels compared)\n", s.Precision, percent, pixels)
+		}
+		os.Exit(code)
 	}
 }
@@ -1,8 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"text/template"
 	"time"
 )
 
@@ -60,6 +71,18 @@ func TestDurationSpecifier(t *testing.T) {
 	test("5", time.Second*5)
 }
 
+func TestMalformedDurationSpecifier(t *testing.T) {
+	for _, malformed := range []string{"10x", "x", ""} {
+		if _, err := readDurationSpecifier(malformed); err == nil {
+			t.Fatalf("Expected an error for duration specifier '%s'", malformed)
+		}
+		s := newSettings()
+		if err := parseArguments(&s, []string{"--timeout", malformed, "a.png", "b.png"}); err == nil {
+			t.Fatalf("Expected invalid arguments for --timeout '%s'", malformed)
+		}
+	}
+}
+
 func TestEqualImages(t *testing.T) {
 	s := defaultSettings()
 	s.BaseImg = FILES["g"]
@@ -133,3 +156,1717 @@ func TestTransparency(t *testing.T) {
 		t.Fatalf("Base image must match given transparent reference image; got difference of %f", diff)
 	}
 }
+
+func TestHashImage(t *testing.T) {
+	var black, white img
+	if err := readImageMetadata(FILES["black"], &black); err != nil {
+		t.Fatal(err)
+	}
+	if err := readImageMetadata(FILES["white"], &white); err != nil {
+		t.Fatal(err)
+	}
+	if hashImage(black.i) != hashImage(black.i) {
+		t.Fatalf("Hashing the same image twice must return the same digest")
+	}
+	if hashImage(black.i) == hashImage(white.i) {
+		t.Fatalf("Different images must return different digests; got %s", hashImage(black.i))
+	}
+}
+
+func TestChangedRegion(t *testing.T) {
+	s := newSettings()
+	var baseImg, refImg img
+	if err := readImageMetadata(FILES["grml_kB"], &baseImg); err != nil {
+		t.Fatal(err)
+	}
+	if err := readImageMetadata(FILES["grml_MB"], &refImg); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := compareImages(&s, &baseImg, &refImg, 0, baseImg.h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.diffBounds.Empty() || diff.diffBounds.Dx() >= baseImg.w || diff.diffBounds.Dy() >= baseImg.h {
+		t.Fatalf("Expected a small changed region; got %v", diff.diffBounds)
+	}
+
+	diff, err = compareImages(&s, &baseImg, &baseImg, 0, baseImg.h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.diffBounds.Empty() {
+		t.Fatalf("Same image must not have a changed region; got %v", diff.diffBounds)
+	}
+}
+
+func TestFastEqual(t *testing.T) {
+	s := newSettings()
+	s.CompareMode = "fast-equal"
+	s.BaseImg = FILES["g"]
+	s.RefImg = FILES["g"]
+	diff, err := CompareImages(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != 0.0 {
+		t.Fatalf("Identical files must return difference %f; got %f", 0.0, diff)
+	}
+
+	s.RefImg = FILES["grmlforensic_website"]
+	diff, err = CompareImages(s)
+	if err != nil {
+		t.Log(err)
+	}
+	if diff <= 0.1 {
+		t.Fatalf("Different images must fall back to full comparison; got %f", diff)
+	}
+
+	// identical files differ once the reference is rotated
+	s.RefImg = FILES["g"]
+	s.RotateRef = 180
+	diff, err = CompareImages(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff == 0.0 {
+		t.Fatal("Identical files must be compared after preprocessing")
+	}
+}
+
+func TestWeights(t *testing.T) {
+	weights, err := readWeights("0.3,0.6,0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(weights[0]+weights[1]+weights[2]-3.0) > 1e-9 {
+		t.Fatalf("Weights must be renormalized to sum 3; got %v", weights)
+	}
+	for _, invalid := range []string{"1,1", "-1,1,1", "0,0,0", "a,b,c"} {
+		if _, err := readWeights(invalid); err == nil {
+			t.Fatalf("Weights '%s' must be rejected", invalid)
+		}
+	}
+
+	s := newSettings()
+	s.BaseImg = FILES["g"]
+	s.RefImg = FILES["grmlforensic_website"]
+	diffEqual, err := CompareImages(s)
+	if err != nil {
+		t.Log(err)
+	}
+	s.Weights = weights
+	diffWeighted, err := CompareImages(s)
+	if err != nil {
+		t.Log(err)
+	}
+	if diffEqual == diffWeighted {
+		t.Fatalf("Expecting a difference between equal and custom weights; got %f and %f", diffEqual, diffWeighted)
+	}
+}
+
+func TestChannelThreshold(t *testing.T) {
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--channel-threshold", "r=5, g=2", "a.png", "b.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if *s.ChannelThreshold != [3]int{5, 2, 0} {
+		t.Fatalf("Expected thresholds [5 2 0]; got %v", *s.ChannelThreshold)
+	}
+	for _, invalid := range []string{"r=256", "x=1", "r=1,r=2", "r", "rg=1", "g=-1"} {
+		if _, err := readChannelThreshold(invalid); err == nil {
+			t.Fatalf("Expected an error for channel threshold '%s'", invalid)
+		}
+	}
+
+	base := solidImage(2, 1, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(2, 1, color.NRGBA{0, 0, 0, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(0, 0, color.NRGBA{4, 0, 0, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(1, 0, color.NRGBA{0, 3, 0, 255})
+	// only the green pixel exceeds its threshold
+	expected := solidImage(2, 1, color.NRGBA{0, 0, 0, 255})
+	expected.i.(*image.NRGBA).SetNRGBA(1, 0, color.NRGBA{0, 3, 0, 255})
+
+	plain := newSettings()
+	want, err := compareImages(&plain, base, expected, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(diff.score-want.score) > 1e-12 || diff.score == 0.0 {
+		t.Fatalf("Expected difference %f of the green pixel only; got %f", want.score, diff.score)
+	}
+
+	*s.ChannelThreshold = [3]int{5, 5, 5}
+	diff, err = compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.score != 0.0 || diff.identical {
+		t.Fatalf("Expected no difference, but not identical images; got %f (identical: %v)", diff.score, diff.identical)
+	}
+}
+
+func TestColorSpaceNormalization(t *testing.T) {
+	for _, c := range colorSpaces {
+		colorSpace := c.name
+		s := newSettings()
+		s.ColorSpace = colorSpace
+		s.BaseImg = FILES["black"]
+		s.RefImg = FILES["white"]
+		diff, err := CompareImages(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff <= 0.9 || diff > 1.0 {
+			t.Fatalf("Black and white must return a difference in (0.9, 1] in %s; got %f", colorSpace, diff)
+		}
+
+		s.RefImg = FILES["black"]
+		diff, err = CompareImages(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff != 0.0 {
+			t.Fatalf("Same image must return difference %f in %s; got %f", 0.0, colorSpace, diff)
+		}
+	}
+}
+
+func TestListColorSpaces(t *testing.T) {
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--list-colorspaces"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseArguments(&s, []string{"--list-colorspaces", "a.png"}); err == nil {
+		t.Fatal("--list-colorspaces must reject positional arguments")
+	}
+
+	var buf bytes.Buffer
+	listColorSpaces(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(colorSpaces) {
+		t.Fatalf("expected %d lines; got %q", len(colorSpaces), buf.String())
+	}
+	for n, line := range lines {
+		name := strings.Fields(line)[0]
+		s := newSettings()
+		s.ColorSpace = name
+		if err := validateSettings(&s); err != nil {
+			t.Fatalf("listed color space on line %d must be valid; got %s", n+1, err)
+		}
+	}
+}
+
+func TestSyntheticImages(t *testing.T) {
+	black := color.NRGBA{0, 0, 0, 255}
+	white := color.NRGBA{255, 255, 255, 255}
+	test := func(colorSpace string, base, ref *img, expected float64) {
+		s := newSettings()
+		s.ColorSpace = colorSpace
+		diff, err := compareImages(&s, base, ref, 0, base.h, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(diff.score-expected) > 1e-4 {
+			t.Fatalf("Expected difference %f in %s; got %f", expected, colorSpace, diff.score)
+		}
+	}
+
+	// 1×1 images with extreme colors
+	test("RGB", solidImage(1, 1, black), solidImage(1, 1, white), 1.0)
+	test("Y'UV", solidImage(1, 1, color.NRGBA{255, 0, 0, 255}), solidImage(1, 1, color.NRGBA{0, 255, 255, 255}), 1.0)
+
+	// single transparent pixel
+	test("RGB", solidImage(1, 1, black), solidImage(1, 1, color.NRGBA{255, 255, 255, 0}), 0.0)
+
+	// one of two pixels differs
+	half := solidImage(2, 1, black)
+	half.i.(*image.NRGBA).SetNRGBA(1, 0, white)
+	test("RGB", solidImage(2, 1, black), half, 0.5*1.25)
+}
+
+func TestRefColor(t *testing.T) {
+	s := newSettings()
+	s.BaseImg = FILES["white"]
+	white := color.NRGBA{255, 255, 255, 255}
+	s.RefColor = &white
+	diff, err := CompareImages(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != 0.0 {
+		t.Fatalf("White image must match reference color white; got difference %f", diff)
+	}
+
+	s.BaseImg = FILES["black"]
+	diff, err = CompareImages(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff <= 0.9 {
+		t.Fatalf("Black image must differ from reference color white; got difference %f", diff)
+	}
+}
+
+func TestMaxWorkers(t *testing.T) {
+	s := newSettings()
+	s.BaseImg = FILES["g"]
+	s.RefImg = FILES["grmlforensic_website"]
+	s.MaxWorkers = 1
+	serial, err := CompareImages(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxWorkers = 4
+	parallel, err := CompareImages(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(serial-parallel) > 1e-9 {
+		t.Fatalf("Serial and parallel comparison must agree; got %f and %f", serial, parallel)
+	}
+}
+
+func TestLuminanceDelta(t *testing.T) {
+	s := newSettings()
+	gray := solidImage(2, 2, color.NRGBA{128, 128, 128, 255})
+	white := solidImage(2, 2, color.NRGBA{255, 255, 255, 255})
+	diff, err := compareImages(&s, gray, white, 0, gray.h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.luminanceDelta <= 0.0 || !strings.HasSuffix(diff.luminanceSummary(), "brighter") {
+		t.Fatalf("White reference must be brighter than gray base; got '%s'", diff.luminanceSummary())
+	}
+	diff, err = compareImages(&s, white, gray, 0, gray.h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.luminanceDelta >= 0.0 || !strings.HasSuffix(diff.luminanceSummary(), "darker") {
+		t.Fatalf("Gray reference must be darker than white base; got '%s'", diff.luminanceSummary())
+	}
+}
+
+func TestCompareAlpha(t *testing.T) {
+	s := newSettings()
+	opaque := solidImage(2, 2, color.NRGBA{255, 255, 255, 255})
+	transparent := solidImage(2, 2, color.NRGBA{255, 255, 255, 0})
+	diff, err := compareImages(&s, opaque, transparent, 0, opaque.h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.score != 0.0 {
+		t.Fatalf("Transparent reference must be ignored by default; got %f", diff.score)
+	}
+
+	s.CompareAlpha = true
+	diff, err = compareImages(&s, opaque, transparent, 0, opaque.h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.score <= 0.5 {
+		t.Fatalf("Different transparency must differ when comparing alpha; got %f", diff.score)
+	}
+}
+
+func TestSnapshotExitCode(t *testing.T) {
+	s := newSettings()
+	if code := exitCode(&s, 0.5); code != 0 {
+		t.Fatalf("Expected exit code 0 for 0.5 %%; got %d", code)
+	}
+	s.SnapshotDir = "tests"
+	s.Threshold = 0.1
+	if code := exitCode(&s, 0.5); code != 1 {
+		t.Fatalf("Snapshot mismatch over threshold must return non-zero exit code; got %d", code)
+	}
+	if code := exitCode(&s, 0.05); code != 0 {
+		t.Fatalf("Snapshot difference within threshold must return exit code 0; got %d", code)
+	}
+}
+
+func TestWarnOnly(t *testing.T) {
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--warn-only", "--threshold", "1", "a.png", "b.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if code := exitCode(&s, 50.0); code != 0 {
+		t.Fatalf("Expected exit code 0 for 50 %% with --warn-only; got %d", code)
+	}
+	s.SnapshotDir = "tests"
+	if code := exitCode(&s, 50.0); code != 0 {
+		t.Fatalf("Expected exit code 0 for a snapshot mismatch with --warn-only; got %d", code)
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--warn-only", "--batch", "manifest.txt"}); err == nil {
+		t.Fatal("Expected an error for --warn-only in batch mode")
+	}
+}
+
+func TestExpectDifferent(t *testing.T) {
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--expect-different", "--threshold", "1", "a.png", "b.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if code := exitCode(&s, 50.0); code != 0 {
+		t.Fatalf("Expected exit code 0 for 50 %% with --expect-different; got %d", code)
+	}
+	if code := exitCode(&s, 1.0); code != 103 {
+		t.Fatalf("Expected exit code 103 for 1 %% with --expect-different; got %d", code)
+	}
+	if code := exitCode(&s, 0.0); code != 103 {
+		t.Fatalf("Expected exit code 103 for identical images with --expect-different; got %d", code)
+	}
+	if v := expectDifferentVerdict(&s, 0.5); !strings.HasPrefix(v, "FAILED") {
+		t.Fatalf("Expected a failed verdict for 0.5 %%; got '%s'", v)
+	}
+
+	for _, args := range [][]string{
+		{"--expect-different", "--warn-only", "a.png", "b.png"},
+		{"--expect-different", "--batch", "manifest.txt"},
+	} {
+		s = newSettings()
+		if err := parseArguments(&s, args); err == nil {
+			t.Fatalf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestCorrectAlphaBlend(t *testing.T) {
+	s := newSettings()
+	s.CorrectBlend = true
+
+	// reference: white with alpha gradient from transparent to opaque
+	gradient := image.NewNRGBA(image.Rect(0, 0, 256, 1))
+	for x := 0; x < 256; x++ {
+		gradient.SetNRGBA(x, 0, color.NRGBA{255, 255, 255, uint8(x)})
+	}
+	base := solidImage(256, 1, color.NRGBA{0, 0, 0, 255})
+	ref := imgFromImage(gradient)
+
+	// half-transparent white over black is lighter than 50 % gray in sRGB
+	if v := blendLinear(0, 65535, 0.5) / 65535; math.Abs(v-0.7354) > 1e-3 {
+		t.Fatalf("Expected sRGB value 0.7354 for linear light 0.5; got %f", v)
+	}
+
+	diff, err := compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CorrectBlend = false
+	naive, err := compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.score <= naive.score {
+		t.Fatalf("Linear blending must yield a higher difference than weighting in sRGB; got %f and %f", diff.score, naive.score)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	s := newSettings()
+	code := 42
+	s.LoadErrorCode = &code
+
+	s.BaseImg = filepath.Join("tests", "does_not_exist.png")
+	s.RefImg = FILES["g"]
+	_, err := CompareImages(s)
+	if err == nil || errorCode(&s, err) != 42 {
+		t.Fatalf("Missing file must result in load error code 42; got %v", err)
+	}
+
+	corrupt, err := ioutil.TempFile("", "corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(corrupt.Name())
+	corrupt.WriteString("\x89PNG\r\n\x1a\nthis is no image")
+	corrupt.Close()
+	s.BaseImg = corrupt.Name()
+	_, err = CompareImages(s)
+	if err == nil || errorCode(&s, err) != 42 {
+		t.Fatalf("Corrupt file must result in load error code 42; got %v", err)
+	}
+
+	// both images are decoded concurrently; the error of either is reported
+	s.BaseImg = FILES["g"]
+	s.RefImg = corrupt.Name()
+	_, err = CompareImages(s)
+	if err == nil || errorCode(&s, err) != 42 || !strings.Contains(err.Error(), corrupt.Name()) {
+		t.Fatalf("Corrupt reference must result in load error code 42; got %v", err)
+	}
+	s.BaseImg = filepath.Join("tests", "does_not_exist.png")
+	_, err = CompareImages(s)
+	if err == nil || !strings.Contains(err.Error(), s.BaseImg) {
+		t.Fatalf("If both images fail to load, the base image must be reported; got %v", err)
+	}
+
+	s.BaseImg = FILES["g"]
+	s.RefImg = FILES["black"]
+	_, err = CompareImages(s)
+	if err == nil || errorCode(&s, err) != 101 {
+		t.Fatalf("Dimension mismatch must result in error code 101; got %v", err)
+	}
+}
+
+func TestLimitMemory(t *testing.T) {
+	expected := map[string]int64{"100": 100, "4k": 4096, "512M": 512 << 20, " 2G ": 2 << 30}
+	for spec, n := range expected {
+		if got, err := readByteSize(spec); err != nil || got != n {
+			t.Fatalf("Expected %d bytes for '%s'; got %d (%v)", n, spec, got, err)
+		}
+	}
+	for _, invalid := range []string{"", "0", "-1K", "1T", "M"} {
+		if _, err := readByteSize(invalid); err == nil {
+			t.Fatalf("Expected an error for size '%s'", invalid)
+		}
+	}
+
+	s := newSettings()
+	code := 42
+	s.LoadErrorCode = &code
+	s.BaseImg = FILES["g"]
+	s.RefImg = FILES["g"]
+	if err := preflight(&s); err != nil {
+		t.Fatal(err)
+	}
+	s.LimitMemory = 1024
+	if _, err := CompareImages(s); err == nil || errorCode(&s, err) != 42 {
+		t.Fatalf("Exceeding the memory limit must result in load error code 42; got %v", err)
+	}
+
+	// the dimensions are checked before decoding
+	s.LimitMemory = 0
+	s.RefImg = FILES["black"]
+	if err := preflight(&s); err == nil || errorCode(&s, err) != 101 {
+		t.Fatalf("Dimension mismatch must be detected by the pre-check; got %v", err)
+	}
+	s.DimensionPolicy = "scale-down"
+	if err := preflight(&s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTwoPass(t *testing.T) {
+	s := newSettings()
+	s.TwoPass = true
+	s.Threshold = 10.0
+
+	var baseImg, refImg img
+	if err := readImageMetadata(FILES["black"], &baseImg); err != nil {
+		t.Fatal(err)
+	}
+	if err := readImageMetadata(FILES["white"], &refImg); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := comparePrepared(&s, &baseImg, &refImg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(diff.pass, "coarse") {
+		t.Fatalf("Clearly different images must be decided by the coarse pass; got '%s'", diff.pass)
+	}
+
+	s.Threshold = 100.0
+	diff, err = comparePrepared(&s, &baseImg, &refImg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.pass != "full pass" {
+		t.Fatalf("Borderline images must be decided by the full pass; got '%s'", diff.pass)
+	}
+}
+
+func TestKeyColor(t *testing.T) {
+	s := newSettings()
+	magenta := color.NRGBA{255, 0, 255, 255}
+	s.KeyColor = &magenta
+	s.KeyTolerance = 2
+
+	base := solidImage(4, 1, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4, 1, color.NRGBA{0, 0, 0, 255})
+	refPix := ref.i.(*image.NRGBA)
+	refPix.SetNRGBA(0, 0, color.NRGBA{254, 1, 255, 255})
+	refPix.SetNRGBA(1, 0, magenta)
+	refPix.SetNRGBA(2, 0, color.NRGBA{255, 255, 255, 255})
+
+	// 2 keyed pixels are excluded; 1 of 2 remaining pixels differs
+	diff, err := compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(diff.score-0.5*1.25) > 1e-4 {
+		t.Fatalf("Expected difference %f excluding keyed pixels; got %f", 0.5*1.25, diff.score)
+	}
+}
+
+func TestMinRegionSize(t *testing.T) {
+	s := newSettings()
+	s.MinRegionSize = 2
+
+	base := solidImage(8, 8, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(8, 8, color.NRGBA{0, 0, 0, 255})
+	refPix := ref.i.(*image.NRGBA)
+	white := color.NRGBA{255, 255, 255, 255}
+	refPix.SetNRGBA(1, 1, white)
+	refPix.SetNRGBA(5, 5, white)
+	refPix.SetNRGBA(6, 6, white)
+
+	// the isolated pixel is suppressed; the diagonal pair remains
+	diff, err := compareImages(&s, base, ref, 0, 8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.suppressedRegions != 1 {
+		t.Fatalf("Expected 1 suppressed region; got %d", diff.suppressedRegions)
+	}
+	if math.Abs(diff.score-2.0/64.0*1.25) > 1e-6 {
+		t.Fatalf("Expected difference %f of the remaining region; got %f", 2.0/64.0*1.25, diff.score)
+	}
+	if diff.diffBounds != image.Rect(5, 5, 7, 7) {
+		t.Fatalf("Expected changed region (5,5)-(7,7); got %v", diff.diffBounds)
+	}
+
+	// a suppressed pixel does not change the center weighted difference
+	s.CenterWeight = "linear"
+	refPix.SetNRGBA(1, 1, color.NRGBA{0, 0, 0, 255})
+	region, err := compareImages(&s, base, ref, 0, 8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refPix.SetNRGBA(0, 7, white)
+	diff, err = compareImages(&s, base, ref, 0, 8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.suppressedRegions != 1 || math.Abs(diff.score-region.score) > 1e-9 {
+		t.Fatalf("Expected the weighted difference %f of the region; got %f", region.score, diff.score)
+	}
+	// the maxima and the sweep ignore the suppressed pixel
+	s = newSettings()
+	s.MinRegionSize, s.MaxChannelDiff, s.ToleranceSweep = 2, true, []float64{0.1}
+	gray := color.NRGBA{128, 128, 128, 255}
+	ref = solidImage(8, 8, color.NRGBA{0, 0, 0, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(1, 1, white)
+	ref.i.(*image.NRGBA).SetNRGBA(5, 5, gray)
+	ref.i.(*image.NRGBA).SetNRGBA(6, 6, gray)
+	diff, err = compareImages(&s, base, ref, 0, 8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.maxDiffAt != image.Pt(5, 5) || diff.maxChannelAt != image.Pt(5, 5) || diff.maxChannelDelta != 128*257 {
+		t.Fatalf("Expected the maxima in the remaining region; got %f at %v and %f at %v",
+			diff.maxDiff, diff.maxDiffAt, diff.maxChannelDelta, diff.maxChannelAt)
+	}
+	if len(diff.sweep) != 1 || math.Abs(diff.sweep[0].Percentage-2.0/64.0*100.0) > 1e-9 {
+		t.Fatalf("Expected 2 pixels exceeding the sweep level; got %v", diff.sweep)
+	}
+}
+
+func TestMaskOut(t *testing.T) {
+	s := newSettings()
+	s.MaskOut = "mask.png"
+	s.MinRegionSize = 2
+
+	base := solidImage(8, 8, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(8, 8, color.NRGBA{0, 0, 0, 255})
+	refPix := ref.i.(*image.NRGBA)
+	white := color.NRGBA{255, 255, 255, 255}
+	refPix.SetNRGBA(1, 1, white)
+	refPix.SetNRGBA(5, 5, white)
+	refPix.SetNRGBA(6, 6, white)
+
+	diff, err := compareImages(&s, base, ref, 0, 8, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.changedMask == nil {
+		t.Fatal("Expected a changed mask")
+	}
+	// the isolated pixel is suppressed
+	expected := map[image.Point]uint8{
+		image.Pt(0, 0): 0,
+		image.Pt(1, 1): 0,
+		image.Pt(5, 5): 255,
+		image.Pt(6, 6): 255,
+	}
+	for p, v := range expected {
+		if got := diff.changedMask.GrayAt(p.X, p.Y).Y; got != v {
+			t.Fatalf("Expected %d at %v; got %d", v, p, got)
+		}
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--mask-out", "mask.png", "--sample", "0.5", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for --mask-out with sampling")
+	}
+}
+
+func TestSaveNormalized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "normalized")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	white := color.NRGBA{255, 255, 255, 255}
+	base := solidImage(8, 8, color.NRGBA{0, 0, 0, 255})
+	base.i.(*image.NRGBA).SetNRGBA(2, 2, white)
+	ref := solidImage(8, 8, color.NRGBA{0, 0, 0, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(3, 2, white)
+
+	// the aligned overlap is compared
+	s := newSettings()
+	s.AlignWindow = 1
+	s.SaveNormalized = filepath.Join(dir, "sub")
+	if _, err := comparePrepared(&s, base, ref, nil); err != nil {
+		t.Fatal(err)
+	}
+	var savedBase, savedRef img
+	if err := readImageMetadata(filepath.Join(s.SaveNormalized, "base.png"), &savedBase); err != nil {
+		t.Fatal(err)
+	}
+	if err := readImageMetadata(filepath.Join(s.SaveNormalized, "ref.png"), &savedRef); err != nil {
+		t.Fatal(err)
+	}
+	if savedBase.w != 7 || savedBase.h != 8 || !identicalPixels(savedBase.i, savedRef.i) {
+		t.Fatalf("Expected identical 7×8 overlaps; got %d×%d", savedBase.w, savedBase.h)
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--save-normalized", dir, "--batch", "pairs.txt"}); err == nil {
+		t.Fatal("Expected an error for --save-normalized in batch mode")
+	}
+}
+
+// opaqueImage hides the concrete type of an image, such that its pixels
+// are read through the color interface
+type opaqueImage struct {
+	image.Image
+}
+
+func TestPixelAt(t *testing.T) {
+	s := newSettings()
+	var previous *img
+	for _, name := range []string{"black", "g", "g_transparent", "grmlf_bs_23", "grmlf_bs_30", "grmlf_bs_transparent"} {
+		var i img
+		if err := readImageMetadata(FILES[name], &i); err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < i.h; y++ {
+			for x := 0; x < i.w; x++ {
+				r1, g1, b1, a1 := pixelAt(&i, x, y)
+				r2, g2, b2, a2 := toNRGBA(i.i.At(x, y).RGBA())
+				if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+					t.Fatalf("%s: expected %v at (%d,%d); got %v", name, []float64{r2, g2, b2, a2}, x, y, []float64{r1, g1, b1, a1})
+				}
+			}
+		}
+
+		// the optimized comparison matches the comparison by the color interface
+		if previous != nil && previous.w == i.w && previous.h == i.h {
+			fast, err := compareImages(&s, previous, &i, 0, i.h, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plainBase, plainRef := imgFromImage(opaqueImage{previous.i}), imgFromImage(opaqueImage{i.i})
+			slow, err := compareImages(&s, plainBase, plainRef, 0, i.h, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fast.score != slow.score || fast.changed != slow.changed || fast.diffBounds != slow.diffBounds {
+				t.Fatalf("%s: expected score %f of %d pixels in %v; got %f of %d pixels in %v", name, slow.score, slow.changed, slow.diffBounds, fast.score, fast.changed, fast.diffBounds)
+			}
+		}
+		previous = &i
+	}
+}
+
+func BenchmarkCompareImages(b *testing.B) {
+	var base, ref img
+	if err := readImageMetadata(FILES["grmlf_bs_23"], &base); err != nil {
+		b.Fatal(err)
+	}
+	if err := readImageMetadata(FILES["grmlf_bs_30"], &ref); err != nil {
+		b.Fatal(err)
+	}
+	s := newSettings()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := compareImages(&s, &base, &ref, 0, base.h, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMaxChannelDelta(t *testing.T) {
+	s := newSettings()
+	base := solidImage(4, 4, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4, 4, color.NRGBA{0, 0, 0, 255})
+	refPix := ref.i.(*image.NRGBA)
+	refPix.SetNRGBA(0, 3, color.NRGBA{0, 0, 100, 255})
+	refPix.SetNRGBA(2, 1, color.NRGBA{10, 200, 30, 255})
+
+	diff, err := compareImages(&s, base, ref, 0, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.maxChannelDelta != 200*0x101 || channelNames[diff.maxChannel] != "G" || diff.maxChannelAt != image.Pt(2, 1) {
+		t.Fatalf("Expected a delta of 200 in G at (2,1); got %f in %s at %v", diff.maxChannelDelta/0x101, channelNames[diff.maxChannel], diff.maxChannelAt)
+	}
+}
+
+func TestToleranceSweep(t *testing.T) {
+	var err error
+	s := newSettings()
+	s.ToleranceSweep, err = readToleranceSweep("0.5, 0, 0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 of 4 pixels differ slightly, 1 pixel differs totally
+	base := solidImage(4, 1, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4, 1, color.NRGBA{0, 0, 0, 255})
+	refPix := ref.i.(*image.NRGBA)
+	refPix.SetNRGBA(0, 0, color.NRGBA{20, 20, 20, 255})
+	refPix.SetNRGBA(1, 0, color.NRGBA{20, 20, 20, 255})
+	refPix.SetNRGBA(2, 0, color.NRGBA{255, 255, 255, 255})
+
+	diff, err := compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []sweepLevel{{0, 75.0}, {0.1, 25.0}, {0.5, 25.0}}
+	if !reflect.DeepEqual(diff.sweep, expected) {
+		t.Fatalf("Expected sweep %v; got %v", expected, diff.sweep)
+	}
+}
+
+func TestRenderScales(t *testing.T) {
+	s := newSettings()
+	s.RenderScales = []int{2, 4}
+
+	// checkerboards with fields of 1 and 2 pixels look identical from afar
+	base := checkerboard(8, 8, 1)
+	ref := checkerboard(8, 8, 2)
+	diff, err := comparePrepared(&s, base, ref, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.scales) != 2 || diff.scales[0].Factor != 2 || diff.scales[1].Factor != 4 {
+		t.Fatalf("Expected one result per render scale; got %v", diff.scales)
+	}
+	if diff.scales[0].Percentage == 0.0 {
+		t.Fatalf("Expected a difference at factor 2; got %v", diff.scales)
+	}
+	if diff.scales[1].Percentage != 0.0 {
+		t.Fatalf("Expected no difference at factor 4; got %v", diff.scales)
+	}
+}
+
+func TestOpaqueIntersection(t *testing.T) {
+	s := newSettings()
+	s.OpaqueIntersection = true
+
+	base := solidImage(4, 1, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4, 1, color.NRGBA{0, 0, 0, 255})
+	basePix, refPix := base.i.(*image.NRGBA), ref.i.(*image.NRGBA)
+	basePix.SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 128})
+	refPix.SetNRGBA(1, 0, color.NRGBA{255, 255, 255, 0})
+	refPix.SetNRGBA(2, 0, color.NRGBA{255, 255, 255, 255})
+
+	// 2 pixels are opaque in both images; 1 of them differs
+	diff, err := compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.intersection != 2 {
+		t.Fatalf("Expected opaque intersection of 2 pixels; got %d", diff.intersection)
+	}
+	if math.Abs(diff.score-0.5*1.25) > 1e-4 {
+		t.Fatalf("Expected difference %f within the intersection; got %f", 0.5*1.25, diff.score)
+	}
+
+	transparent := solidImage(4, 1, color.NRGBA{0, 0, 0, 0})
+	if _, err := compareImages(&s, base, transparent, 0, 1, nil); err == nil {
+		t.Fatal("Expected an error for an empty opaque intersection")
+	}
+}
+
+func TestAlphaAsMask(t *testing.T) {
+	s := newSettings()
+
+	base := solidImage(10, 1, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(10, 1, color.NRGBA{0, 0, 0, 0})
+	refPix := ref.i.(*image.NRGBA)
+	refPix.SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	refPix.SetNRGBA(1, 0, color.NRGBA{0, 0, 0, 255})
+
+	// transparent pixels count in the divisor by default
+	diff, err := compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(diff.score-0.1*1.25) > 1e-4 {
+		t.Fatalf("Expected difference %f; got %f", 0.1*1.25, diff.score)
+	}
+
+	// 2 pixels are not transparent; 1 of them differs
+	s.AlphaAsMask = true
+	diff, err = compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(diff.score-0.5*1.25) > 1e-4 {
+		t.Fatalf("Expected difference %f within the mask; got %f", 0.5*1.25, diff.score)
+	}
+
+	transparent := solidImage(10, 1, color.NRGBA{0, 0, 0, 0})
+	if _, err := compareImages(&s, base, transparent, 0, 1, nil); err == nil {
+		t.Fatal("Expected an error for a fully transparent reference")
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--alpha-as-mask", "--compare-alpha", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for --alpha-as-mask with --compare-alpha")
+	}
+}
+
+func TestPrecision(t *testing.T) {
+	tmpl := template.Must(template.New("result").Parse(TEMPLATE))
+	res := result{Percentage: 1.23456, Precision: 5, ToleranceSweep: []sweepLevel{{0.1, 0.5}}}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, res); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "difference percentage:  1.23456 %") ||
+		!strings.Contains(out.String(), "0.100  0.50000 %") {
+		t.Fatalf("Expected 5 decimal places; got '%s'", out.String())
+	}
+
+	out.Reset()
+	res.Precision = 0
+	if err := tmpl.Execute(&out, res); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "difference percentage:  1 %") {
+		t.Fatalf("Expected a whole number; got '%s'", out.String())
+	}
+}
+
+func TestLumaChromaWeights(t *testing.T) {
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--chroma-weight", "0", "a.png", "b.png"}); err == nil {
+		t.Fatal("Luma and chroma weights must require color space Y'UV")
+	}
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--colors", "Y'UV", "--chroma-weight", "0", "a.png", "b.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Weights != [3]float64{3, 0, 0} {
+		t.Fatalf("Expected weights (3,0,0) for chroma weight 0; got %v", s.Weights)
+	}
+
+	// red and a gray of the same luma (0.299 × 255) differ only in chroma
+	gray := uint8(76)
+	base := solidImage(2, 2, color.NRGBA{255, 0, 0, 255})
+	ref := solidImage(2, 2, color.NRGBA{gray, gray, gray, 255})
+	diffLuma, err := compareImages(&s, base, ref, 0, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Weights = [3]float64{1, 1, 1}
+	diffFull, err := compareImages(&s, base, ref, 0, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffLuma.percentage() > 1.0 || diffFull.percentage() < 10.0 {
+		t.Fatalf("Expected chroma differences to be ignored; got %f and %f", diffLuma.percentage(), diffFull.percentage())
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	s := newSettings()
+	s.BaseImg = FILES["g"]
+	s.RefImg = FILES["grmlforensic_website"]
+	s.Deterministic = true
+	s.MaxWorkers = 1
+	serial, err := CompareImages(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxWorkers = 8
+	for run := 0; run < 5; run++ {
+		parallel, err := CompareImages(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parallel != serial {
+			t.Fatalf("Run %d must yield the bit-identical score %v; got %v", run, serial, parallel)
+		}
+	}
+}
+
+func TestRegionPercent(t *testing.T) {
+	for _, invalid := range []string{"10%,10%,50%", "10%,10%,95%,50%", "a,b,c,d"} {
+		if _, err := readRegionPercent(invalid); err == nil {
+			t.Fatalf("Region '%s' must be rejected", invalid)
+		}
+	}
+	region, err := readRegionPercent("50%, 0%, 50%, 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := percentRegion(region, 200, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != image.Rect(100, 0, 200, 10) {
+		t.Fatalf("Expected region (100,0)-(200,10); got %v", r)
+	}
+	if _, err := percentRegion(region, 200, 4); err == nil {
+		t.Fatal("An empty region must be rejected")
+	}
+
+	// the difference in the left half is ignored
+	s := newSettings()
+	s.RegionPercent = &[4]float64{50, 0, 50, 100}
+	base := solidImage(4, 2, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4, 2, color.NRGBA{0, 0, 0, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	if err := cropRegion(&s, base, ref); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := compareImages(&s, base, ref, 0, base.h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base.w != 2 || diff.score != 0.0 {
+		t.Fatalf("Expected no difference within the right half; got width %d and %f", base.w, diff.score)
+	}
+}
+
+func TestIgnoreEdges(t *testing.T) {
+	// a scrollbar in the right column and a status bar in the bottom row
+	s := newSettings()
+	s.IgnoreRight, s.IgnoreBottom = 1, 1
+	base := solidImage(4, 4, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4, 4, color.NRGBA{0, 0, 0, 255})
+	refPix := ref.i.(*image.NRGBA)
+	for n := 0; n < 4; n++ {
+		refPix.SetNRGBA(3, n, color.NRGBA{255, 255, 255, 255})
+		refPix.SetNRGBA(n, 3, color.NRGBA{255, 255, 255, 255})
+	}
+	refPix.SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	if err := cropRegion(&s, base, ref); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := compareImages(&s, base, ref, 0, base.h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 of the remaining 9 pixels differs
+	if base.w != 3 || base.h != 3 || math.Abs(diff.score-1.25/9) > 1e-6 {
+		t.Fatalf("Expected 1 of 3×3 pixels to differ; got %d×%d pixels and %.9f", base.w, base.h, diff.score)
+	}
+
+	s.IgnoreRight = 4
+	if err := cropRegion(&s, solidImage(4, 4, color.NRGBA{}), solidImage(4, 4, color.NRGBA{})); err == nil {
+		t.Fatal("Expected an error for ignoring the whole width")
+	}
+}
+
+func TestTransparentBase(t *testing.T) {
+	s := newSettings()
+	base := solidImage(2, 1, color.NRGBA{0, 0, 0, 255})
+	base.i.(*image.NRGBA).SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 0})
+	ref := solidImage(2, 1, color.NRGBA{255, 255, 255, 255})
+
+	// by default, the transparent base pixel is black
+	diff, err := compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.score != 1.0 {
+		t.Fatalf("Expected the transparent base pixel to differ as black; got %f", diff.score)
+	}
+
+	s.BaseAlpha = "weight"
+	diff, err = compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(diff.score-0.5*1.25) > 1e-4 {
+		t.Fatalf("Expected the transparent base pixel not to count; got %f", diff.score)
+	}
+
+	s.BaseAlpha = "error"
+	if err := preprocess(&s, base, ref); err == nil {
+		t.Fatal("Expected an error for a base image with transparency")
+	}
+}
+
+func TestAdaptiveDownscale(t *testing.T) {
+	s := newSettings()
+	s.MaxWorkers = 1
+	s.Timeout = 10 * time.Second
+	if factor := adaptiveFactor(&s, 100, 100); factor != 1 {
+		t.Fatalf("Small images must not be downscaled; got factor %d", factor)
+	}
+
+	// 20 megapixels at 200 ns take 4 s; at most 1 ms is available
+	s.Timeout = 2 * time.Millisecond
+	if factor := adaptiveFactor(&s, 5000, 4000); factor != 64 {
+		t.Fatalf("Expected factor 64; got %d", factor)
+	}
+
+	s.AdaptiveDownscale = true
+	base := solidImage(4000, 2, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4000, 2, color.NRGBA{255, 255, 255, 255})
+	diff, err := comparePrepared(&s, base, ref, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.adaptiveFactor != 2 || diff.score != 1.0 {
+		t.Fatalf("Expected approximate result of factor 2; got factor %d and %f", diff.adaptiveFactor, diff.score)
+	}
+}
+
+func TestAlignWindow(t *testing.T) {
+	s := newSettings()
+	s.AlignWindow = 3
+
+	// a white square shifted by (2,-1) in the reference
+	base := solidImage(12, 12, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(12, 12, color.NRGBA{0, 0, 0, 255})
+	white := color.NRGBA{255, 255, 255, 255}
+	for y := 4; y < 8; y++ {
+		for x := 4; x < 8; x++ {
+			base.i.(*image.NRGBA).SetNRGBA(x, y, white)
+			ref.i.(*image.NRGBA).SetNRGBA(x+2, y-1, white)
+		}
+	}
+
+	diff, err := comparePrepared(&s, base, ref, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.shift == nil || *diff.shift != image.Pt(2, -1) {
+		t.Fatalf("Expected shift (2,-1); got %v", diff.shift)
+	}
+	if diff.score != 0.0 {
+		t.Fatalf("Expected no difference for the best alignment; got %f", diff.score)
+	}
+}
+
+func TestVScrollSearch(t *testing.T) {
+	s := newSettings()
+	s.VScrollSearch = 12
+
+	// content with periodic stripes and a marker, scrolled up by 10 rows
+	// in the reference
+	white := color.NRGBA{255, 255, 255, 255}
+	content := func(y int) bool {
+		return y%7 == 0 || y == 25
+	}
+	base := solidImage(4, 40, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4, 40, color.NRGBA{0, 0, 0, 255})
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 4; x++ {
+			if content(y) {
+				base.i.(*image.NRGBA).SetNRGBA(x, y, white)
+			}
+			if content(y + 10) {
+				ref.i.(*image.NRGBA).SetNRGBA(x, y, white)
+			}
+		}
+	}
+
+	diff, err := comparePrepared(&s, base, ref, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.shift == nil || *diff.shift != image.Pt(0, -10) {
+		t.Fatalf("Expected vertical offset -10; got %v", diff.shift)
+	}
+	if diff.score != 0.0 {
+		t.Fatalf("Expected no difference for the best offset; got %f", diff.score)
+	}
+
+	if err := parseArguments(&s, []string{"--vscroll-search", "2", "--align-window", "2", "a.png", "b.png"}); err == nil {
+		t.Fatal("Alignment and vertical scroll search must be mutually exclusive")
+	}
+}
+
+func TestIdentical(t *testing.T) {
+	s := newSettings()
+	base := solidImage(2, 1, color.NRGBA{0, 0, 0, 255})
+	same := solidImage(2, 1, color.NRGBA{0, 0, 0, 255})
+	diff, err := compareImages(&s, base, same, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.identical {
+		t.Fatal("Expected identical images to be reported as identical")
+	}
+
+	// a transparent difference does not count, but is not identical
+	transparent := solidImage(2, 1, color.NRGBA{0, 0, 0, 255})
+	transparent.i.(*image.NRGBA).SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 0})
+	diff, err = compareImages(&s, base, transparent, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.score != 0.0 || diff.identical {
+		t.Fatalf("Expected score 0 of non-identical images; got %f and identical %v", diff.score, diff.identical)
+	}
+
+	tmpl := template.Must(template.New("result").Parse(TEMPLATE))
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, result{Identical: true, Precision: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "difference percentage:  identical\n") {
+		t.Fatalf("Expected identical images to be named so; got '%s'", out.String())
+	}
+}
+
+func TestAlphaScale(t *testing.T) {
+	s := newSettings()
+	base := solidImage(1, 1, color.NRGBA{200, 200, 200, 255})
+	opaque := solidImage(1, 1, color.NRGBA{255, 255, 255, 255})
+	full, err := compareImages(&s, base, opaque, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 16-bit reference with alpha 0x8000; white survives premultiplication
+	half := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+	half.SetNRGBA64(0, 0, color.NRGBA64{0xFFFF, 0xFFFF, 0xFFFF, 0x8000})
+	diff, err := compareImages(&s, base, imgFromImage(half), 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := full.score * float64(0x8000) / maxChannel
+	if math.Abs(diff.score-expected) > 1e-12 {
+		t.Fatalf("Expected the alpha to scale the contribution to %v; got %v", expected, diff.score)
+	}
+}
+
+func TestSaturationOnly(t *testing.T) {
+	if _, saturation, _ := toHSV(65535, 32767.5, 32767.5); math.Abs(saturation-0.5) > 1e-9 {
+		t.Fatalf("Expected saturation 0.5; got %f", saturation)
+	}
+
+	s := newSettings()
+	s.SaturationOnly = true
+	// same saturation, different hue and brightness
+	base := solidImage(2, 1, color.NRGBA{255, 0, 0, 255})
+	ref := solidImage(2, 1, color.NRGBA{0, 0, 128, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(1, 0, color.NRGBA{128, 128, 128, 255})
+
+	// 1 of 2 pixels lost all saturation
+	diff, err := compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(diff.score-0.5*1.25) > 1e-9 {
+		t.Fatalf("Expected mean saturation difference 0.5; got %f", diff.score/1.25)
+	}
+}
+
+func TestSample(t *testing.T) {
+	s := newSettings()
+	s.Sample = 0.25
+
+	// 1 of 4 columns differs totally
+	base := solidImage(100, 100, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(100, 100, color.NRGBA{0, 0, 0, 255})
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x += 4 {
+			ref.i.(*image.NRGBA).SetNRGBA(x, y, color.NRGBA{255, 255, 255, 255})
+		}
+	}
+	diff := compareSampled(&s, base, ref)
+	if diff.sampled != 2500 {
+		t.Fatalf("Expected 2500 sampled pixels; got %d", diff.sampled)
+	}
+	exact := 25.0 * 1.25
+	if math.Abs(diff.percentage()-exact) > diff.confidence || diff.confidence <= 0.0 {
+		t.Fatalf("Expected %f within the confidence interval; got %f ± %f", exact, diff.percentage(), diff.confidence)
+	}
+	if again := compareSampled(&s, base, ref); again.score != diff.score {
+		t.Fatalf("Sampling must be reproducible; got %f and %f", diff.score, again.score)
+	}
+}
+
+func TestCenterWeight(t *testing.T) {
+	white := color.NRGBA{255, 255, 255, 255}
+	base := solidImage(16, 16, color.NRGBA{0, 0, 0, 255})
+	center := solidImage(16, 16, color.NRGBA{0, 0, 0, 255})
+	fillRect(center.i.(*image.NRGBA), image.Rect(6, 6, 10, 10), white)
+	corner := solidImage(16, 16, color.NRGBA{0, 0, 0, 255})
+	fillRect(corner.i.(*image.NRGBA), image.Rect(0, 0, 4, 4), white)
+
+	s := newSettings()
+	plainCenter, _ := compareImages(&s, base, center, 0, 16, nil)
+	plainCorner, _ := compareImages(&s, base, corner, 0, 16, nil)
+	if plainCenter.score != plainCorner.score {
+		t.Fatalf("Expected the same score without weighting; got %f and %f", plainCenter.score, plainCorner.score)
+	}
+	for falloff := range centerFalloffs {
+		s.CenterWeight = falloff
+		weightedCenter, _ := compareImages(&s, base, center, 0, 16, nil)
+		weightedCorner, _ := compareImages(&s, base, corner, 0, 16, nil)
+		if weightedCenter.score <= plainCenter.score || weightedCorner.score >= plainCorner.score {
+			t.Fatalf("Expected %s weighting to emphasize the center; got %f and %f", falloff, weightedCenter.score, weightedCorner.score)
+		}
+		// a uniform difference keeps its score
+		uniform, _ := compareImages(&s, base, solidImage(16, 16, white), 0, 16, nil)
+		if math.Abs(uniform.rawScore-1.0) > 1e-6 {
+			t.Fatalf("Expected raw score 1 of a uniform difference; got %g", uniform.rawScore)
+		}
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--center-weight", "cubic", "a.png", "b.png"}); err == nil {
+		t.Fatal("Unknown falloffs must be rejected")
+	}
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--center-weight", "linear", "--metric", "hog", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for --center-weight with another metric")
+	}
+}
+
+func TestEdgeDownweight(t *testing.T) {
+	edges := edgeMap(checkerboard(8, 1, 4).i)
+	for x, want := range []bool{false, false, false, true, true, false, false, false} {
+		if edges[x] != want {
+			t.Fatalf("Expected edge %t at x=%d; got %t", want, x, edges[x])
+		}
+	}
+
+	s := newSettings()
+	zero := 0.0
+	s.EdgeDownweight = &zero
+	// the edge between both halves moved by one pixel, the last pixel changed
+	base := checkerboard(8, 1, 4)
+	ref := checkerboard(8, 1, 4)
+	base.mono, ref.mono = nil, nil
+	ref.i.(*image.Gray).Pix[4] = 255
+	ref.i.(*image.Gray).Pix[7] = 255
+	diff, err := compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(diff.score-1.25/8.0) > 1e-4 {
+		t.Fatalf("Expected only the change off the edge to count; got score %f", diff.score)
+	}
+
+	s.EdgeDownweight = nil
+	diff, err = compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(diff.score-2*1.25/8.0) > 1e-4 {
+		t.Fatalf("Expected both changes to count without downweighting; got score %f", diff.score)
+	}
+}
+
+func TestRawScore(t *testing.T) {
+	s := newSettings()
+	base := solidImage(4, 4, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4, 4, color.NRGBA{255, 255, 255, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(0, 0, color.NRGBA{0, 0, 0, 255})
+	diff, err := compareImages(&s, base, ref, 0, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the corrected score is clamped, the raw score is not corrected
+	if diff.score != 1.0 || math.Abs(diff.rawScore-15.0/16.0) > 1e-4 {
+		t.Fatalf("Expected score 1 and raw score 0.9375; got %f and %f", diff.score, diff.rawScore)
+	}
+
+	tmpl := template.Must(template.New("result").Parse(TEMPLATE))
+	var out bytes.Buffer
+	raw := 0.9375
+	if err := tmpl.Execute(&out, result{RawScore: &raw}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "raw score:              0.9375\n") {
+		t.Fatalf("Expected the raw score in full precision; got '%s'", out.String())
+	}
+}
+
+func TestQuadrants(t *testing.T) {
+	s := newSettings()
+	s.Quadrants = true
+
+	// the top right quadrant is white in the reference
+	base := solidImage(5, 4, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(5, 4, color.NRGBA{0, 0, 0, 255})
+	for y := 0; y < 2; y++ {
+		for x := 2; x < 5; x++ {
+			ref.i.(*image.NRGBA).SetNRGBA(x, y, color.NRGBA{255, 255, 255, 255})
+		}
+	}
+	diff, err := comparePrepared(&s, base, ref, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []quadrantLevel{{"TL", 0.0}, {"TR", 100.0}, {"BL", 0.0}, {"BR", 0.0}}
+	if !reflect.DeepEqual(diff.quadrants, expected) {
+		t.Fatalf("Expected a difference in the top right quadrant only; got %v", diff.quadrants)
+	}
+
+	if _, err := comparePrepared(&s, solidImage(1, 4, color.NRGBA{}), solidImage(1, 4, color.NRGBA{}), nil); err == nil {
+		t.Fatal("Images narrower than 2 pixels must be rejected")
+	}
+}
+
+func TestDimensionPolicy(t *testing.T) {
+	s := newSettings()
+	base := solidImage(8, 4, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4, 6, color.NRGBA{0, 0, 0, 255})
+	if err := matchDimensions(&s, base, ref); err == nil {
+		t.Fatal("Different dimensions must be rejected by default")
+	}
+
+	s.DimensionPolicy = "scale-down"
+	if err := matchDimensions(&s, base, ref); err != nil {
+		t.Fatal(err)
+	}
+	if base.w != 4 || base.h != 4 || ref.w != 4 || ref.h != 4 {
+		t.Fatalf("Expected both images scaled down to 4×4; got %d×%d and %d×%d", base.w, base.h, ref.w, ref.h)
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--dimension-policy", "scale-up", "a.png", "b.png"}); err == nil {
+		t.Fatal("Unknown dimension policies must be rejected")
+	}
+}
+
+func TestCropToRef(t *testing.T) {
+	s := newSettings()
+	s.CropToRef = true
+	base := imgFromImage(image.NewNRGBA(image.Rect(0, 0, 8, 6)))
+	base.i.(*image.NRGBA).SetNRGBA(7, 5, color.NRGBA{255, 0, 0, 255})
+	ref := solidImage(4, 4, color.NRGBA{})
+	if err := matchDimensions(&s, base, ref); err != nil {
+		t.Fatal(err)
+	}
+	if base.w != 4 || base.h != 4 || !identicalPixels(base.i, ref.i) {
+		t.Fatalf("Expected the top left 4×4 pixels of the base image; got %d×%d", base.w, base.h)
+	}
+
+	s.CropOrigin = "bottom-right"
+	base = imgFromImage(image.NewNRGBA(image.Rect(0, 0, 8, 6)))
+	base.i.(*image.NRGBA).SetNRGBA(7, 5, color.NRGBA{255, 0, 0, 255})
+	if err := matchDimensions(&s, base, ref); err != nil {
+		t.Fatal(err)
+	}
+	if c := base.i.(*image.NRGBA).NRGBAAt(3, 3); c != (color.NRGBA{255, 0, 0, 255}) {
+		t.Fatalf("Expected the bottom right corner of the base image; got %v at (3,3)", c)
+	}
+
+	if err := matchDimensions(&s, solidImage(4, 4, color.NRGBA{}), solidImage(8, 2, color.NRGBA{})); err == nil {
+		t.Fatal("A reference wider than the base image must be rejected")
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--crop-origin", "center", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for --crop-origin without --crop-to-ref")
+	}
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--crop-to-ref", "--crop-origin", "middle", "a.png", "b.png"}); err == nil {
+		t.Fatal("Unknown crop origins must be rejected")
+	}
+}
+
+func TestExclude(t *testing.T) {
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--exclude", "0,0,1,1", "--exclude", "3,0,1,1", "a.png", "b.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Exclude, []image.Rectangle{image.Rect(0, 0, 1, 1), image.Rect(3, 0, 4, 1)}) {
+		t.Fatalf("Expected both rectangles to accumulate; got %v", s.Exclude)
+	}
+	for _, invalid := range []string{"0,0,0,1", "-1,0,1,1", "1,2,3"} {
+		if err := parseArguments(&s, []string{"--exclude", invalid, "a.png", "b.png"}); err == nil {
+			t.Fatalf("Rectangle '%s' must be rejected", invalid)
+		}
+	}
+
+	// pixels 0 and 1 differ, only pixel 1 counts over 2 remaining pixels
+	base := solidImage(4, 1, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(4, 1, color.NRGBA{0, 0, 0, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(1, 0, color.NRGBA{255, 255, 255, 255})
+	diff, err := compareImages(&s, base, ref, 0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(diff.score-0.5*1.25) > 1e-4 || diff.diffBounds != image.Rect(1, 0, 2, 1) {
+		t.Fatalf("Expected mean difference 0.5 in (1,0)-(2,1); got %f in %v", diff.score/1.25, diff.diffBounds)
+	}
+
+	if err := checkExclusions(&s, 3, 1); err == nil {
+		t.Fatal("Rectangles exceeding the images must be rejected")
+	}
+}
+
+func TestSeparateRegions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the same logo in the top left corner and in the center
+	base := solidImage(8, 8, color.NRGBA{0, 0, 0, 255})
+	draw.Draw(base.i.(*image.NRGBA), image.Rect(0, 0, 2, 2), image.White, image.ZP, draw.Src)
+	ref := solidImage(12, 12, color.NRGBA{0, 0, 0, 255})
+	draw.Draw(ref.i.(*image.NRGBA), image.Rect(5, 5, 7, 7), image.White, image.ZP, draw.Src)
+	basePath, refPath := filepath.Join(dir, "base.png"), filepath.Join(dir, "ref.png")
+	if err := writePNG(basePath, base.i); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePNG(refPath, ref.i); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--base-region", "0,0,3,3", "--ref-region", "5,5,3,3", basePath, refPath}); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := compareFiles(&s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.identical {
+		t.Fatalf("Expected identical regions; got %f", diff.score)
+	}
+
+	s.RefRegion = &image.Rectangle{image.Pt(10, 10), image.Pt(13, 13)}
+	if _, err := compareFiles(&s, nil); err == nil {
+		t.Fatal("Expected an error for a region exceeding its image")
+	}
+
+	for _, args := range [][]string{
+		{"--base-region", "0,0,3,3", "--ref-region", "5,5,3,4", basePath, refPath},
+		{"--base-region", "0,0,3,3", basePath, refPath},
+	} {
+		s := newSettings()
+		if err := parseArguments(&s, args); err == nil {
+			t.Fatalf("Expected an error for %v", args)
+		}
+	}
+}
+
+func TestSubpixelTolerant(t *testing.T) {
+	line := func(x int) *img {
+		i := solidImage(7, 3, color.NRGBA{0, 0, 0, 255})
+		draw.Draw(i.i.(*image.NRGBA), image.Rect(x, 0, x+1, 3), image.White, image.ZP, draw.Src)
+		return i
+	}
+
+	s := newSettings()
+	s.SubpixelTolerant = true
+	diff, err := compareImages(&s, line(2), line(3), 0, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.score != 0.0 || diff.identical {
+		t.Fatalf("Expected a line shifted by 1 pixel to be tolerated; got %f", diff.score)
+	}
+
+	diff, err = compareImages(&s, line(2), line(4), 0, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.score == 0.0 {
+		t.Fatal("Expected a line shifted by 2 pixels to differ")
+	}
+
+	// a pixel only present in the reference differs, although its
+	// black base pixel has a black neighbor in the reference
+	ref := solidImage(7, 3, color.NRGBA{0, 0, 0, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(3, 1, color.NRGBA{255, 255, 255, 255})
+	diff, err = compareImages(&s, solidImage(7, 3, color.NRGBA{0, 0, 0, 255}), ref, 0, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.diffBounds != image.Rect(3, 1, 4, 2) {
+		t.Fatalf("Expected the added pixel to differ; got changed region %v", diff.diffBounds)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	overlay := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	overlay.SetNRGBA(1, 0, color.NRGBA{255, 255, 255, 255})
+	ref := solidImage(4, 1, color.NRGBA{0, 0, 0, 255})
+	ref.i.(*image.NRGBA).SetNRGBA(1, 0, color.NRGBA{255, 255, 255, 255})
+	paths := map[string]image.Image{
+		"base.png":    solidImage(4, 1, color.NRGBA{0, 0, 0, 255}).i,
+		"overlay.png": overlay,
+		"ref.png":     ref.i,
+		"small.png":   solidImage(3, 1, color.NRGBA{0, 0, 0, 0}).i,
+	}
+	for name, i := range paths {
+		if err := writePNG(filepath.Join(dir, name), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newSettings()
+	s.BaseImg = filepath.Join(dir, "base.png")
+	s.RefImg = filepath.Join(dir, "ref.png")
+	diff, err := compareFiles(&s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.score == 0.0 {
+		t.Fatal("Expected the base without overlay to differ")
+	}
+
+	s.Overlay = filepath.Join(dir, "overlay.png")
+	diff, err = compareFiles(&s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.identical {
+		t.Fatalf("Expected the composite to match the reference; got %f", diff.score)
+	}
+
+	s.Overlay = filepath.Join(dir, "small.png")
+	if _, err := compareFiles(&s, nil); err == nil {
+		t.Fatal("Expected an error for an overlay of other dimensions")
+	}
+}
+
+func TestBase64Input(t *testing.T) {
+	data := base64.StdEncoding.EncodeToString(encodedPNG(t))
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--base-b64", data, "--ref-b64", data}); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := CompareImages(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != 0.0 {
+		t.Fatalf("Identical base64 images must return difference 0; got %f", diff)
+	}
+
+	for _, args := range [][]string{
+		{"--base-b64", "not base64!", "--ref-b64", data},
+		{"--base-b64", data, "b.png"},
+		{"--base-b64", data, "--ref-b64", data, "a.png"},
+	} {
+		s := newSettings()
+		if err := parseArguments(&s, args); err == nil {
+			t.Fatalf("Arguments %v must be rejected", args)
+		}
+	}
+}
+
+func TestAveragedReferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "averaged-references")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := []string{filepath.Join(dir, "black.png"), filepath.Join(dir, "white.png"), filepath.Join(dir, "small.png")}
+	images := []*img{
+		solidImage(2, 2, color.NRGBA{0, 0, 0, 255}),
+		solidImage(2, 2, color.NRGBA{255, 255, 255, 255}),
+		solidImage(1, 1, color.NRGBA{0, 0, 0, 255}),
+	}
+	for n, path := range paths {
+		if err := writePNG(path, images[n].i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newSettings()
+	if err := parseArguments(&s, []string{"--ref", paths[0], "--ref", paths[1], "base.png"}); err != nil {
+		t.Fatal(err)
+	}
+	var ref img
+	if err := readReference(&s, nil, nil, &ref); err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, a := ref.i.At(1, 1).RGBA(); r != 0xFFFF/2 || a != 0xFFFF {
+		t.Fatalf("Expected the average of black and white; got %d with alpha %d", r, a)
+	}
+
+	if err := averageReferences([]string{paths[0], paths[2]}, nil, &ref); err == nil {
+		t.Fatal("References of different dimensions must be rejected")
+	}
+	if err := parseArguments(&s, []string{"--ref", paths[0], "a.png", "b.png"}); err == nil {
+		t.Fatal("A positional reference image must be rejected with --ref")
+	}
+}
+
+func TestSettle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ref.png")
+	write := func(c color.NRGBA) {
+		// renaming replaces the file atomically for its readers
+		tmp := path + ".tmp"
+		if err := writePNG(tmp, solidImage(2, 2, c).i); err != nil {
+			t.Error(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Error(err)
+		}
+	}
+	write(color.NRGBA{0, 0, 0, 255})
+
+	var i img
+	if err := readSettledImage(path, 10*time.Millisecond, time.Second, nil, &i); err != nil {
+		t.Fatalf("Expected an unchanged image to settle; got %s", err)
+	}
+
+	// an image changing faster than the interval never settles
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for n := 0; ; n++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(2 * time.Millisecond):
+				write(color.NRGBA{uint8(n), 0, 0, 255})
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		<-finished
+	}()
+	s := newSettings()
+	if err := readSettledImage(path, 50*time.Millisecond, 200*time.Millisecond, nil, &i); errorCode(&s, err) != 102 {
+		t.Fatalf("Expected an image which does not settle to time out; got %v", err)
+	}
+	stop := newStopSignal()
+	stop.stop(&stopError{130, 0, ""})
+	if err := readSettledImage(path, 50*time.Millisecond, 0, stop, &i); errorCode(&s, err) != 130 {
+		t.Fatalf("Expected settling to stop with the signal; got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// ssimWindow is the width and height of the windows of SSIM.
+// Windows overlap by half.
+const ssimWindow = 8
+
+// msssimWeights are the standard exponents of the scales of MS-SSIM
+// from the finest to the coarsest scale (Wang, Simoncelli, Bovik 2003)
+var msssimWeights = []float64{0.0448, 0.2856, 0.3001, 0.2363, 0.1333}
+
+// stabilization constants of SSIM for values between 0 and 1
+const (
+	ssimC1 = 0.01 * 0.01
+	ssimC2 = 0.03 * 0.03
+)
+
+// lumaValues returns the luma of every pixel of `i` between 0 and 1
+func lumaValues(i image.Image) []float64 {
+	b := i.Bounds()
+	lumas := make([]float64, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := i.At(x, y).RGBA()
+			lumas = append(lumas, luma(float64(r), float64(g), float64(bl))/maxChannel)
+		}
+	}
+	return lumas
+}
+
+// ssimComponents returns the luminance term and the contrast-structure
+// term of SSIM of the lumas `base` and `ref` of `w`×`h` pixels, each
+// averaged over all windows. Images smaller than a window form one window.
+func ssimComponents(base, ref []float64, w, h int) (float64, float64) {
+	ww, wh := ssimWindow, ssimWindow
+	if w < ww {
+		ww = w
+	}
+	if h < wh {
+		wh = h
+	}
+	stride := func(size int) int {
+		if size < 2 {
+			return 1
+		}
+		return size / 2
+	}
+
+	var l, cs float64
+	var windows int
+	for y0 := 0; y0+wh <= h; y0 += stride(wh) {
+		for x0 := 0; x0+ww <= w; x0 += stride(ww) {
+			var sumB, sumR, sumBB, sumRR, sumBR float64
+			for y := y0; y < y0+wh; y++ {
+				for x := x0; x < x0+ww; x++ {
+					vb, vr := base[y*w+x], ref[y*w+x]
+					sumB, sumR = sumB+vb, sumR+vr
+					sumBB, sumRR, sumBR = sumBB+vb*vb, sumRR+vr*vr, sumBR+vb*vr
+				}
+			}
+			n := float64(ww * wh)
+			meanB, meanR := sumB/n, sumR/n
+			varB := math.Max(sumBB/n-meanB*meanB, 0.0)
+			varR := math.Max(sumRR/n-meanR*meanR, 0.0)
+			covar := sumBR/n - meanB*meanR
+
+			l += (2*meanB*meanR + ssimC1) / (meanB*meanB + meanR*meanR + ssimC1)
+			cs += (2*covar + ssimC2) / (varB + varR + ssimC2)
+			windows++
+		}
+	}
+	return l / float64(windows), cs / float64(windows)
+}
+
+// msssim returns the multi-scale structural similarity of the luma of
+// `baseImg` and `refImg` between 0 and 1. The images are halved for every
+// scale as long as they cover a window. The weights of missing coarse
+// scales are redistributed proportionally.
+func msssim(baseImg, refImg *img) float64 {
+	base, ref := baseImg.i, refImg.i
+	var l float64
+	var cs []float64
+	for n := range msssimWeights {
+		if n > 0 {
+			if base.Bounds().Dx() < 2*ssimWindow || base.Bounds().Dy() < 2*ssimWindow {
+				break
+			}
+			base, ref = downscale(base, 2), downscale(ref, 2)
+		}
+		var c float64
+		l, c = ssimComponents(lumaValues(base), lumaValues(ref), base.Bounds().Dx(), base.Bounds().Dy())
+		// negative correlation is as dissimilar as no correlation
+		cs = append(cs, math.Max(c, 0.0))
+	}
+
+	var total float64
+	for n := range cs {
+		total += msssimWeights[n]
+	}
+	value := math.Pow(l, msssimWeights[len(cs)-1]/total)
+	for n, c := range cs {
+		value *= math.Pow(c, msssimWeights[n]/total)
+	}
+	return value
+}
+
+// compareMSSSIM compares `baseImg` and `refImg` by MS-SSIM. The score
+// is the dissimilarity 1-MS-SSIM.
+func compareMSSSIM(baseImg, refImg *img) difference {
+	diff := newDifference()
+	value := msssim(baseImg, refImg)
+	diff.msssim = &value
+	diff.rawScore = 1.0 - value
+	diff.score = math.Min(math.Max(diff.rawScore, 0.0), 1.0)
+	return diff
+}
+
+// maxChromaDistance returns the maximum distance of two colors in the
+// U-V plane of Y'UV for channel values between 0 and 1. The distance
+// is convex in both colors, hence the maximum is found at the corners
+// of the RGB cube.
+func maxChromaDistance() float64 {
+	var corners [][2]float64
+	for n := 0; n < 8; n++ {
+		_, u, v := toYUV(float64(n&1), float64(n>>1&1), float64(n>>2&1))
+		corners = append(corners, [2]float64{u, v})
+	}
+	var max float64
+	for _, a := range corners {
+		for _, b := range corners {
+			max = math.Max(max, math.Hypot(a[0]-b[0], a[1]-b[1]))
+		}
+	}
+	return max
+}
+
+// chromaDifference returns the mean distance of the colors of `base`
+// and `ref` of the same dimensions in the U-V plane of Y'UV between
+// 0 and 1. Unlike luma, this measures shifts of hue and saturation.
+func chromaDifference(base, ref image.Image) float64 {
+	bb, rb := base.Bounds(), ref.Bounds()
+	if bb.Empty() {
+		return 0.0
+	}
+	var sum float64
+	for y := 0; y < bb.Dy(); y++ {
+		for x := 0; x < bb.Dx(); x++ {
+			r1, g1, b1, _ := base.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			r2, g2, b2, _ := ref.At(rb.Min.X+x, rb.Min.Y+y).RGBA()
+			_, u1, v1 := toYUV(float64(r1)/maxChannel, float64(g1)/maxChannel, float64(b1)/maxChannel)
+			_, u2, v2 := toYUV(float64(r2)/maxChannel, float64(g2)/maxChannel, float64(b2)/maxChannel)
+			sum += math.Hypot(u1-u2, v1-v2)
+		}
+	}
+	return sum / float64(bb.Dx()*bb.Dy()) / maxChromaDistance()
+}
+
+// defaultSSIMChromaWeight is the weight of the chroma difference of
+// compareSSIMColor unless given by --ssim-chroma-weight
+const defaultSSIMChromaWeight = 0.5
+
+// compareSSIMColor compares `baseImg` and `refImg` by the SSIM of their
+// luma combined with their chroma difference, since SSIM alone ignores
+// color. The score is the dissimilarity 1-SSIM weighted by 1-`weight`
+// plus the chroma difference weighted by `weight`, between 0 and 1.
+func compareSSIMColor(baseImg, refImg *img, weight float64) difference {
+	l, cs := ssimComponents(lumaValues(baseImg.i), lumaValues(refImg.i), baseImg.w, baseImg.h)
+	// negative correlation is as dissimilar as no correlation
+	ssim := l * math.Max(cs, 0.0)
+	chroma := chromaDifference(baseImg.i, refImg.i)
+
+	diff := newDifference()
+	diff.rawScore = (1.0-weight)*(1.0-ssim) + weight*chroma
+	diff.score = math.Min(math.Max(diff.rawScore, 0.0), 1.0)
+	return diff
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestMSSSIM(t *testing.T) {
+	base := checkerboard(64, 64, 4)
+	if value := msssim(base, base); math.Abs(value-1.0) > 1e-9 {
+		t.Fatalf("Identical images must have MS-SSIM 1; got %f", value)
+	}
+
+	// slight noise keeps the structure
+	noisy := imgFromImage(crop(base.i, base.i.Bounds()))
+	for n := 0; n < 64; n++ {
+		noisy.i.(*image.NRGBA).SetNRGBA(n, (n*7)%64, color.NRGBA{200, 200, 200, 255})
+	}
+	inverted := checkerboard(64, 64, 4)
+	for n, v := range inverted.i.(*image.Gray).Pix {
+		inverted.i.(*image.Gray).Pix[n] = 255 - v
+	}
+	similar, different := msssim(base, noisy), msssim(base, inverted)
+	if similar <= different || similar <= 0.5 || different < 0.0 {
+		t.Fatalf("Expected noise to be more similar than inversion; got %f and %f", similar, different)
+	}
+
+	// images smaller than a window
+	small := solidImage(3, 2, color.NRGBA{0, 0, 0, 255})
+	if diff := compareMSSSIM(small, small); diff.score != 0.0 || *diff.msssim != 1.0 {
+		t.Fatalf("Identical small images must have score 0; got %f", diff.score)
+	}
+}
+
+func TestMSSSIMTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("result").Parse(TEMPLATE))
+	var out bytes.Buffer
+	value := 0.75
+	if err := tmpl.Execute(&out, result{MSSSIM: &value}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "ms-ssim:                0.75\n") {
+		t.Fatalf("Expected the MS-SSIM in the output; got '%s'", out.String())
+	}
+}
+
+func TestCompareSSIMColor(t *testing.T) {
+	// same luma, different hue
+	gray := solidImage(16, 16, color.NRGBA{128, 128, 128, 255})
+	tinted := solidImage(16, 16, color.NRGBA{128, 128, 128, 255})
+	draw.Draw(tinted.i.(*image.NRGBA), image.Rect(0, 0, 16, 8), image.NewUniform(color.NRGBA{168, 108, 128, 255}), image.ZP, draw.Src)
+	lumaOnly := compareSSIMColor(gray, tinted, 0.0)
+	combined := compareSSIMColor(gray, tinted, 0.5)
+	if combined.score <= lumaOnly.score {
+		t.Fatalf("Expected the chroma difference to increase the score; got %f and %f", lumaOnly.score, combined.score)
+	}
+
+	if diff := compareSSIMColor(gray, gray, 0.5); diff.score > 1e-9 {
+		t.Fatalf("Expected no difference of identical images; got %f", diff.score)
+	}
+
+	// complementary colors differ most in chroma
+	if d := chromaDifference(solidImage(4, 4, color.NRGBA{255, 0, 255, 255}).i, solidImage(4, 4, color.NRGBA{0, 255, 0, 255}).i); d < 0.9 || d > 1.0 {
+		t.Fatalf("Expected a chroma difference near 1 of magenta and green; got %f", d)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// stateEntry is the recorded result of a pair with the modification
+// times of both files and the fingerprint of the settings at the time
+// of the comparison
+type stateEntry struct {
+	Base        string    `json:"base"`
+	Ref         string    `json:"ref"`
+	BaseModTime time.Time `json:"base_modtime"`
+	RefModTime  time.Time `json:"ref_modtime"`
+	Percentage  float64   `json:"percentage"`
+	Score       float64   `json:"score"`
+	Identical   bool      `json:"identical"`
+	Settings    string    `json:"settings"`
+}
+
+// compareState holds the recorded results of a batch keyed by the
+// filepaths of the base and the reference image
+type compareState struct {
+	entries  map[[2]string]stateEntry
+	settings string
+}
+
+// readState reads the state file at `filepath` for a batch with the
+// settings fingerprint `settings`. A missing file yields an empty
+// state, e.g. in the first run.
+func readState(filepath, settings string) (*compareState, error) {
+	state := &compareState{entries: make(map[[2]string]stateEntry), settings: settings}
+	data, err := ioutil.ReadFile(filepath)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []stateEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		state.entries[[2]string{e.Base, e.Ref}] = e
+	}
+	return state, nil
+}
+
+// modTimes returns the modification times of the files at `base` and `ref`
+func modTimes(base, ref string) (time.Time, time.Time, error) {
+	baseInfo, err := os.Stat(base)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	refInfo, err := os.Stat(ref)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return baseInfo.ModTime(), refInfo.ModTime(), nil
+}
+
+// settingsFingerprint returns a digest of the settings which may affect
+// the result of a pair. Settings are included unless they only concern
+// the output or the batch itself, hence a new option invalidates the
+// recorded results rather than silently reusing them. Files given in
+// the settings, e.g. the --overlay, are included by their modification
+// time, hence editing them compares every pair again.
+func settingsFingerprint(s *Settings) string {
+	c := comparisonSettings(*s)
+	// regions of the PNG text chunks are read per image
+	c.NamedRegions = nil
+	data, err := json.Marshal(c)
+	if err != nil {
+		// unreachable as Settings holds no channels or functions
+		panic(err)
+	}
+	paths := append([]string{}, s.Refs...)
+	if s.Overlay != "" {
+		paths = append(paths, s.Overlay)
+	}
+	for _, path := range paths {
+		// a missing file fails the comparison anyway
+		if info, err := os.Stat(path); err == nil {
+			data = append(data, info.ModTime().String()...)
+		}
+	}
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// unchanged returns the recorded result of the pair `base` and `ref`
+// if neither file nor the settings changed since
+func (c *compareState) unchanged(base, ref string, baseTime, refTime time.Time) (stateEntry, bool) {
+	e, ok := c.entries[[2]string{base, ref}]
+	if !ok || !e.BaseModTime.Equal(baseTime) || !e.RefModTime.Equal(refTime) || e.Settings != c.settings {
+		return stateEntry{}, false
+	}
+	return e, true
+}
+
+// record stores the result `diff` of the pair `base` and `ref` whose
+// files had the modification times `baseTime` and `refTime` before
+// they were read
+func (c *compareState) record(base, ref string, baseTime, refTime time.Time, diff difference) {
+	c.entries[[2]string{base, ref}] = stateEntry{
+		Base:        base,
+		Ref:         ref,
+		BaseModTime: baseTime,
+		RefModTime:  refTime,
+		Percentage:  diff.percentage(),
+		Score:       diff.score,
+		Identical:   diff.identical,
+		Settings:    c.settings,
+	}
+}
+
+// write stores the state at `filepath` as JSON array sorted by filepaths
+func (c *compareState) write(filepath string) error {
+	entries := make(stateEntries, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	sort.Sort(entries)
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath, append(data, '\n'), 0644)
+}
+
+// stateEntries sorts entries by base and reference filepath
+type stateEntries []stateEntry
+
+func (e stateEntries) Len() int      { return len(e) }
+func (e stateEntries) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e stateEntries) Less(i, j int) bool {
+	if e[i].Base != e[j].Base {
+		return e[i].Base < e[j].Base
+	}
+	return e[i].Ref < e[j].Ref
+}
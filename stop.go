@@ -0,0 +1,45 @@
+package main
+
+import "sync"
+
+// stopSignal stops running comparisons before their completion, e.g. on
+// SIGINT or once the --timeout passes. The pixel comparison polls it
+// between rows, batches and the similarity matrix between pairs.
+type stopSignal struct {
+	done chan struct{}
+	once sync.Once
+	err  *stopError
+}
+
+// newStopSignal returns a signal which did not stop yet
+func newStopSignal() *stopSignal {
+	return &stopSignal{done: make(chan struct{})}
+}
+
+// stop closes the signal with the reason `err`. Only the first call
+// has an effect.
+func (st *stopSignal) stop(err *stopError) {
+	st.once.Do(func() {
+		st.err = err
+		close(st.done)
+	})
+}
+
+// channel returns a channel which is closed once the signal stopped.
+// A nil signal never stops, hence its channel is nil.
+func (st *stopSignal) channel() <-chan struct{} {
+	if st == nil {
+		return nil
+	}
+	return st.done
+}
+
+// stopped returns the reason once the signal stopped and nil before
+func (st *stopSignal) stopped() error {
+	select {
+	case <-st.channel():
+		return st.err
+	default:
+		return nil
+	}
+}
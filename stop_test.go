@@ -0,0 +1,63 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestStopSignal(t *testing.T) {
+	var none *stopSignal
+	if none.stopped() != nil || none.channel() != nil {
+		t.Fatal("A nil signal must never stop")
+	}
+
+	st := newStopSignal()
+	if st.stopped() != nil {
+		t.Fatal("A new signal must not be stopped")
+	}
+	st.stop(&stopError{130, 0, "comparing"})
+	st.stop(&stopError{102, 0, "comparing"})
+	err, ok := st.stopped().(*stopError)
+	if !ok || err.code != 130 || err.Error() != "interrupted (phase: comparing)" {
+		t.Fatalf("Expected the first reason to stop the signal; got %v", err)
+	}
+}
+
+func TestStopComparison(t *testing.T) {
+	st := newStopSignal()
+	st.stop(&stopError{130, 0, "comparing"})
+	s := newSettings()
+	s.stop = st
+	base := solidImage(64, 64, color.NRGBA{0, 0, 0, 255})
+	ref := solidImage(64, 64, color.NRGBA{255, 255, 255, 255})
+	for _, workers := range []int{1, 4} {
+		s.MaxWorkers = workers
+		var p progress
+		_, err := compareImages(&s, base, ref, 0, base.h, &p)
+		if errorCode(&s, err) != 130 {
+			t.Fatalf("Expected the stopped comparison to fail with return code 130; got %v", err)
+		}
+		if _, pixels := p.difference(); pixels >= base.w*base.h {
+			t.Fatalf("Expected the stopped comparison not to complete; got %d pixels", pixels)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var p progress
+	done := make(chan struct{})
+	for n := 0; n < 4; n++ {
+		go func() {
+			for y := 0; y < 100; y++ {
+				p.add(rowResult{cul: 0.5, pixels: 2})
+			}
+			done <- struct{}{}
+		}()
+	}
+	for n := 0; n < 4; n++ {
+		<-done
+	}
+	if diff, pixels := p.difference(); pixels != 800 || diff.rawScore != 0.25 {
+		t.Fatalf("Expected 800 pixels with a raw score of 0.25; got %d and %f", pixels, diff.rawScore)
+	}
+}
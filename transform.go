@@ -0,0 +1,286 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// paddingModes are the supported handlings of pixels out of bounds
+var paddingModes = []string{"clamp", "wrap", "zero"}
+
+// isPaddingMode reports whether `mode` is one of the paddingModes
+func isPaddingMode(mode string) bool {
+	for _, m := range paddingModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// padCoordinate maps coordinate `v` out of [0,size) into it according to
+// padding `mode`. It returns false if the pixel is transparent black,
+// i.e. for mode 'zero'. The empty mode clamps.
+func padCoordinate(v, size int, mode string) (int, bool) {
+	if v >= 0 && v < size {
+		return v, true
+	}
+	switch mode {
+	case "wrap":
+		return (v%size + size) % size, true
+	case "zero":
+		return v, false
+	}
+	return clampInt(v, 0, size-1), true
+}
+
+// paddedAt returns the un-alpha-scaled color of pixel (x,y) of `i` like
+// pixelAt, where pixels out of bounds are sampled according to padding `mode`
+func paddedAt(i *img, x, y int, mode string) (float64, float64, float64, float64) {
+	px, okX := padCoordinate(x, i.w, mode)
+	py, okY := padCoordinate(y, i.h, mode)
+	if !okX || !okY {
+		return 0.0, 0.0, 0.0, 0.0
+	}
+	return pixelAt(i, px, py)
+}
+
+// shiftedImage returns `i` with its content shifted by `shift`, i.e.
+// pixel (x,y) of the result is pixel (x+dx,y+dy) of `i`, where pixels
+// out of bounds are sampled according to padding `mode`
+func shiftedImage(i *img, shift image.Point, mode string) *img {
+	dst := image.NewNRGBA64(image.Rect(0, 0, i.w, i.h))
+	round := func(v float64) uint16 {
+		return uint16(math.Floor(v + 0.5))
+	}
+	for y := 0; y < i.h; y++ {
+		for x := 0; x < i.w; x++ {
+			r, g, b, a := paddedAt(i, x+shift.X, y+shift.Y, mode)
+			dst.SetNRGBA64(x, y, color.NRGBA64{round(r), round(g), round(b), round(a)})
+		}
+	}
+	return imgFromImage(dst)
+}
+
+// rotations maps clockwise rotations in degrees to the EXIF orientations
+// applied by orient to rotate an image by them
+var rotations = map[int]int{90: 6, 180: 3, 270: 8}
+
+// orient rotates and mirrors `i` according to EXIF orientation `o`,
+// such that the result is displayed upright
+func orient(i image.Image, o int) image.Image {
+	b := i.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// src maps destination coordinates to source coordinates
+	var src func(x, y int) (int, int)
+	dw, dh := w, h
+	switch o {
+	case 2: // mirrored horizontally
+		src = func(x, y int) (int, int) { return w - 1 - x, y }
+	case 3: // rotated by 180°
+		src = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 4: // mirrored vertically
+		src = func(x, y int) (int, int) { return x, h - 1 - y }
+	case 5: // transposed
+		dw, dh = h, w
+		src = func(x, y int) (int, int) { return y, x }
+	case 6: // rotated by 90° counterclockwise
+		dw, dh = h, w
+		src = func(x, y int) (int, int) { return y, h - 1 - x }
+	case 7: // transversed
+		dw, dh = h, w
+		src = func(x, y int) (int, int) { return w - 1 - y, h - 1 - x }
+	case 8: // rotated by 90° clockwise
+		dw, dh = h, w
+		src = func(x, y int) (int, int) { return w - 1 - y, x }
+	default:
+		return i
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := src(x, y)
+			dst.Set(x, y, i.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// downscale reduces the dimensions of `i` by `factor` averaging
+// blocks of `factor`×`factor` pixels. Incomplete blocks at the right
+// and bottom border are averaged over their existing pixels.
+func downscale(i image.Image, factor int) image.Image {
+	b := i.Bounds()
+	w, h := (b.Dx()+factor-1)/factor, (b.Dy()+factor-1)/factor
+	dst := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var r, g, bl, a, n uint64
+			for sy := y * factor; sy < (y+1)*factor && sy < b.Dy(); sy++ {
+				for sx := x * factor; sx < (x+1)*factor && sx < b.Dx(); sx++ {
+					// premultiplied values average correctly
+					cr, cg, cb, ca := i.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// resize reduces the dimensions of `i` to `w`×`h` averaging the source
+// pixels covered by each destination pixel. Unlike downscale, the factor
+// need not be integral. `w` and `h` must not exceed the dimensions of `i`.
+func resize(i image.Image, w, h int) image.Image {
+	b := i.Bounds()
+	dst := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*b.Dy()/h, (y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := x*b.Dx()/w, (x+1)*b.Dx()/w
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					// premultiplied values average correctly
+					cr, cg, cb, ca := i.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// equalize applies histogram equalization to the luma of `i`.
+// The chroma and the alpha channel are retained.
+func equalize(i image.Image) image.Image {
+	b := i.Bounds()
+	dst := normalize(i)
+
+	// histogram of the 8-bit luma
+	var histogram [256]int
+	lumaAt := func(n int) int {
+		p := dst.Pix[n : n+3]
+		return int(luma(float64(p[0]), float64(p[1]), float64(p[2])) + 0.5)
+	}
+	for n := 0; n < len(dst.Pix); n += 4 {
+		histogram[lumaAt(n)]++
+	}
+
+	// cumulative distribution function
+	var cdf [256]int
+	sum, cdfMin := 0, 0
+	for v, count := range histogram {
+		sum += count
+		cdf[v] = sum
+		if cdfMin == 0 {
+			cdfMin = sum
+		}
+	}
+	total := b.Dx() * b.Dy()
+	if total == cdfMin {
+		// uniform luma cannot be equalized
+		return dst
+	}
+
+	for n := 0; n < len(dst.Pix); n += 4 {
+		p := dst.Pix[n : n+3]
+		yPrime, u, v := toYUV(float64(p[0]), float64(p[1]), float64(p[2]))
+		yPrime = float64(cdf[lumaAt(n)]-cdfMin) / float64(total-cdfMin) * 255
+		r, g, bl := fromYUV(yPrime, u, v)
+		p[0], p[1], p[2] = clamp8(r), clamp8(g), clamp8(bl)
+	}
+	return dst
+}
+
+// clamp8 rounds `v` to the nearest 8-bit value
+func clamp8(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// crop copies rectangle `r` of `i` into a new image with origin (0,0)
+func crop(i image.Image, r image.Rectangle) image.Image {
+	dst := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), i, i.Bounds().Min.Add(r.Min), draw.Src)
+	return dst
+}
+
+// composite returns `overlay` composited over `base` of the same
+// dimensions in linear light like --correct-alpha-blend. The alpha
+// channels combine by the over operator.
+func composite(base, overlay image.Image) image.Image {
+	b, o := base.Bounds(), overlay.Bounds().Min
+	dst := image.NewNRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r1, g1, b1, a1 := toNRGBA(base.At(b.Min.X+x, b.Min.Y+y).RGBA())
+			r2, g2, b2, a2 := toNRGBA(overlay.At(o.X+x, o.Y+y).RGBA())
+			alpha := a2 / maxChannel
+			dst.SetNRGBA64(x, y, color.NRGBA64{
+				uint16(blendLinear(r1, r2, alpha) + 0.5),
+				uint16(blendLinear(g1, g2, alpha) + 0.5),
+				uint16(blendLinear(b1, b2, alpha) + 0.5),
+				uint16(a2 + a1*(1-alpha) + 0.5),
+			})
+		}
+	}
+	return dst
+}
+
+// edgeThreshold is the gradient magnitude of the luma above which
+// a pixel is considered as part of an edge
+const edgeThreshold = 0.1
+
+// edgeMap marks the pixels of `i` whose luma gradient magnitude by the
+// Sobel operator exceeds edgeThreshold. The magnitude is normalized, such
+// that a step from black to white has magnitude 1. Border pixels repeat.
+func edgeMap(i image.Image) []bool {
+	b := i.Bounds()
+	w, h := b.Dx(), b.Dy()
+	lumas := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := i.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			lumas[y*w+x] = luma(float64(r), float64(g), float64(bl)) / maxChannel
+		}
+	}
+	at := func(x, y int) float64 {
+		x, y = clampInt(x, 0, w-1), clampInt(y, 0, h-1)
+		return lumas[y*w+x]
+	}
+
+	edges := make([]bool, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			edges[y*w+x] = math.Sqrt(gx*gx+gy*gy)/4 > edgeThreshold
+		}
+	}
+	return edges
+}
+
+// clampInt restricts `v` to [min,max]
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
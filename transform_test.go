@@ -0,0 +1,176 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestOrient(t *testing.T) {
+	a := color.NRGBA{255, 0, 0, 255}
+	b := color.NRGBA{0, 0, 255, 255}
+	i := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	i.SetNRGBA(0, 0, a)
+	i.SetNRGBA(1, 0, b)
+
+	test := func(o int, expected []color.NRGBA, w, h int) {
+		oriented := orient(i, o)
+		if oriented.Bounds().Dx() != w || oriented.Bounds().Dy() != h {
+			t.Fatalf("Orientation %d must yield %d×%d image; got %v", o, w, h, oriented.Bounds())
+		}
+		for n, c := range expected {
+			x, y := n%w, n/w
+			if color.NRGBAModel.Convert(oriented.At(x, y)) != c {
+				t.Fatalf("Orientation %d: unexpected color at (%d,%d)", o, x, y)
+			}
+		}
+	}
+
+	test(1, []color.NRGBA{a, b}, 2, 1)
+	test(2, []color.NRGBA{b, a}, 2, 1)
+	test(3, []color.NRGBA{b, a}, 2, 1)
+	test(6, []color.NRGBA{a, b}, 1, 2)
+	test(8, []color.NRGBA{b, a}, 1, 2)
+}
+
+func TestDownscale(t *testing.T) {
+	i := image.NewNRGBA(image.Rect(0, 0, 5, 4))
+	for x := 0; x < 5; x += 2 {
+		for y := 0; y < 4; y++ {
+			i.SetNRGBA(x, y, color.NRGBA{255, 255, 255, 255})
+		}
+	}
+	small := downscale(i, 2)
+	if small.Bounds().Dx() != 3 || small.Bounds().Dy() != 2 {
+		t.Fatalf("Expected 3×2 image; got %v", small.Bounds())
+	}
+	if r, _, _, _ := small.At(0, 0).RGBA(); r != 0xFFFF/2 {
+		t.Fatalf("Expected average of black and white; got %d", r)
+	}
+	if r, _, _, _ := small.At(2, 1).RGBA(); r != 0xFFFF {
+		t.Fatalf("Incomplete block must average existing pixels; got %d", r)
+	}
+}
+
+func TestResize(t *testing.T) {
+	// columns alternate between white and black
+	i := image.NewNRGBA(image.Rect(0, 0, 6, 3))
+	for x := 0; x < 6; x += 2 {
+		for y := 0; y < 3; y++ {
+			i.SetNRGBA(x, y, color.NRGBA{255, 255, 255, 255})
+		}
+	}
+	small := resize(i, 4, 2)
+	if small.Bounds().Dx() != 4 || small.Bounds().Dy() != 2 {
+		t.Fatalf("Expected 4×2 image; got %v", small.Bounds())
+	}
+	if r, _, _, _ := small.At(0, 0).RGBA(); r != 0xFFFF {
+		t.Fatalf("Expected the single covered white column; got %d", r)
+	}
+	if r, _, _, _ := small.At(1, 1).RGBA(); r != 0xFFFF/2 {
+		t.Fatalf("Expected average of black and white; got %d", r)
+	}
+}
+
+func TestComposite(t *testing.T) {
+	base := solidImage(3, 1, color.NRGBA{0, 0, 0, 255})
+	overlay := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	overlay.SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	overlay.SetNRGBA(1, 0, color.NRGBA{255, 255, 255, 128})
+
+	c := composite(base.i, overlay)
+	expected := []uint8{255, 188, 0}
+	for x, v := range expected {
+		r, _, _, a := c.At(x, 0).RGBA()
+		if uint8(r>>8) != v || a != 0xFFFF {
+			t.Fatalf("Expected opaque gray %d at x=%d; got %d with alpha %d", v, x, r>>8, a)
+		}
+	}
+}
+
+func TestEqualize(t *testing.T) {
+	// low contrast gradient between gray levels 100 and 131
+	i := image.NewNRGBA(image.Rect(0, 0, 32, 1))
+	for x := 0; x < 32; x++ {
+		i.SetNRGBA(x, 0, color.NRGBA{uint8(100 + x), uint8(100 + x), uint8(100 + x), 255})
+	}
+	equalized := equalize(i)
+	if r, _, _, _ := equalized.At(0, 0).RGBA(); r != 0 {
+		t.Fatalf("Darkest pixel must become black; got %d", r)
+	}
+	if r, _, _, _ := equalized.At(31, 0).RGBA(); r != 0xFFFF {
+		t.Fatalf("Brightest pixel must become white; got %d", r)
+	}
+}
+
+func TestRotateRef(t *testing.T) {
+	// the top row of the reference becomes its right column
+	base := image.NewNRGBA(image.Rect(0, 0, 1, 2))
+	base.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	ref := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	ref.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+
+	s := newSettings()
+	s.RotateRef = 90
+	baseImg, refImg := imgFromImage(base), imgFromImage(ref)
+	if err := preprocess(&s, baseImg, refImg); err != nil {
+		t.Fatal(err)
+	}
+	if refImg.w != 1 || refImg.h != 2 || !identicalPixels(baseImg.i, refImg.i) {
+		t.Fatalf("Expected the reference rotated clockwise to match the base")
+	}
+
+	// rotating by 180° keeps the dimensions, which differ from the base
+	s.RotateRef = 180
+	if err := preprocess(&s, imgFromImage(base), imgFromImage(ref)); err == nil {
+		t.Fatal("Expected an error for dimensions not matching after rotation")
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--rotate-ref", "45", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for a rotation by 45°")
+	}
+}
+
+func TestPadding(t *testing.T) {
+	for _, c := range []struct {
+		v, expected int
+		mode        string
+		ok          bool
+	}{
+		{-1, 0, "clamp", true},
+		{5, 3, "clamp", true},
+		{-1, 3, "wrap", true},
+		{9, 1, "wrap", true},
+		{-1, -1, "zero", false},
+		{2, 2, "zero", true},
+		{4, 3, "", true},
+	} {
+		if v, ok := padCoordinate(c.v, 4, c.mode); v != c.expected || ok != c.ok {
+			t.Fatalf("Expected %d (%t) for %d padded by '%s'; got %d (%t)", c.expected, c.ok, c.v, c.mode, v, ok)
+		}
+	}
+
+	// a cyclic shift is matched exactly with wrapping
+	colors := []color.NRGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}}
+	base := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	ref := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	for x, c := range colors {
+		base.SetNRGBA(x, 0, c)
+		ref.SetNRGBA((x+1)%4, 0, c)
+	}
+	s := newSettings()
+	s.AlignWindow, s.Padding = 2, "wrap"
+	diff, err := comparePrepared(&s, imgFromImage(base), imgFromImage(ref), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.shift == nil || *diff.shift != image.Pt(1, 0) || diff.score != 0.0 {
+		t.Fatalf("Expected shift (1,0) without difference; got %v and %f", diff.shift, diff.score)
+	}
+
+	s = newSettings()
+	if err := parseArguments(&s, []string{"--padding", "mirror", "a.png", "b.png"}); err == nil {
+		t.Fatal("Expected an error for an unknown padding mode")
+	}
+}